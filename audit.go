@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mdigger/rest"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// максимальное количество записей журнала изменений в ответе
+var auditLimit = 1000
+
+// поля, значения которых не сохраняются в журнале изменений
+var auditHidden = map[string]bool{"password": true, "secret": true}
+
+// AuditEntry описывает запись журнала изменений группы.
+type AuditEntry struct {
+	ID        string                  `bson:"_id" json:"id"`
+	Group     string                  `bson:"group" json:"-"`
+	Time      time.Time               `bson:"time" json:"time"`
+	Actor     string                  `bson:"actor" json:"actor"`
+	ActorType string                  `bson:"actorType" json:"actorType"`
+	Action    string                  `bson:"action" json:"action"`
+	Target    string                  `bson:"target,omitempty" json:"target,omitempty"`
+	Changes   map[string]*AuditChange `bson:"changes,omitempty" json:"changes,omitempty"`
+	IP        string                  `bson:"ip,omitempty" json:"ip,omitempty"`
+}
+
+// AuditChange описывает значение поля до и после изменения.
+type AuditChange struct {
+	Before interface{} `bson:"before,omitempty" json:"before,omitempty"`
+	After  interface{} `bson:"after,omitempty" json:"after,omitempty"`
+}
+
+// auditDiff возвращает список измененных полей документа. Документы
+// сравниваются по значениям полей верхнего уровня в формате JSON. Пустое
+// значение before означает создание документа, а after — его удаление.
+func auditDiff(before, after interface{}) map[string]*AuditChange {
+	fields := func(doc interface{}) map[string]interface{} {
+		var result map[string]interface{}
+		if doc == nil || reflect.ValueOf(doc).Kind() == reflect.Ptr &&
+			reflect.ValueOf(doc).IsNil() {
+			return result
+		}
+		if data, err := json.Marshal(doc); err == nil {
+			json.Unmarshal(data, &result)
+		}
+		return result
+	}
+	old, cur := fields(before), fields(after)
+	var changes = make(map[string]*AuditChange)
+	for name, value := range old {
+		if !reflect.DeepEqual(value, cur[name]) {
+			changes[name] = &AuditChange{Before: value, After: cur[name]}
+		}
+	}
+	for name, value := range cur {
+		if _, ok := old[name]; !ok {
+			changes[name] = &AuditChange{After: value}
+		}
+	}
+	for name := range changes {
+		if auditHidden[name] {
+			changes[name] = new(AuditChange) // отмечаем только факт изменения
+		}
+	}
+	if len(changes) == 0 {
+		return nil
+	}
+	return changes
+}
+
+// адреса прокси, которым разрешено передавать адрес клиента в заголовке
+// X-Forwarded-For
+var trustedProxies []*net.IPNet
+
+// ParseTrustedProxies разбирает список адресов и подсетей доверенных прокси,
+// разделенных запятыми.
+func ParseTrustedProxies(s string) ([]*net.IPNet, error) {
+	var proxies []*net.IPNet
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		if !strings.ContainsRune(item, '/') {
+			if ip := net.ParseIP(item); ip != nil && ip.To4() != nil {
+				item += "/32"
+			} else {
+				item += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, err
+		}
+		proxies = append(proxies, network)
+	}
+	return proxies, nil
+}
+
+// trustedProxy возвращает true, если адрес принадлежит доверенному прокси.
+func trustedProxy(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteIP возвращает IP-адрес клиента. Заголовок X-Forwarded-For
+// учитывается, только если запрос получен от доверенного прокси: из него
+// берется самый правый адрес, не принадлежащий доверенным прокси. Адреса
+// левее него задает сам клиент, и доверять им нельзя.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !trustedProxy(host) {
+		return host
+	}
+	hops := strings.Split(strings.Join(r.Header["X-Forwarded-For"], ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		if !trustedProxy(hop) {
+			return hop
+		}
+		host = hop // запрос прошел через несколько доверенных прокси
+	}
+	return host
+}
+
+// audit сохраняет в журнале изменений группы запись о действии, выполненном
+// владельцем токена из запроса. Ошибка сохранения записи только выводится в
+// лог и не прерывает обработку запроса.
+func (s *Store) audit(c *rest.Context, action, target string, before, after interface{}) {
+	token := GetToken(c)
+	if token == nil {
+		return
+	}
+	s.logAudit(c, token, action, target, auditDiff(before, after))
+}
+
+// logAudit сохраняет запись в журнале изменений группы.
+func (s *Store) logAudit(c *rest.Context, token *Token, action, target string,
+	changes map[string]*AuditChange) {
+	entry := &AuditEntry{
+		ID:        bson.NewObjectId().Hex(),
+		Group:     token.Group,
+		Time:      time.Now().UTC(),
+		Actor:     token.Id,
+		ActorType: token.Type,
+		Action:    action,
+		Target:    target,
+		Changes:   changes,
+		IP:        remoteIP(c.Request),
+	}
+	session, coll := s.collContext(c.Request.Context(), "audit")
+	defer session.Close()
+	if err := coll.Insert(entry); err != nil {
+		llog.Error("Error saving audit entry", "action", action, "err", err)
+	}
+}
+
+// AuditLogin сохраняет в журнале изменений запись об авторизации. Неудачные
+// попытки авторизации существующих пользователей и устройств сохраняются в
+// журнале их основной группы, чтобы их видели администраторы группы.
+// Попытки авторизации с неизвестным логином сохраняются без группы.
+func (s *Store) AuditLogin(c *rest.Context, kind, login string, token *Token, err error) {
+	action := kind + ".login"
+	if err != nil {
+		token = &Token{Type: kind, Id: login, Group: s.loginGroup(c.Request.Context(), kind, login)}
+		action += ".failed"
+	}
+	s.logAudit(c, token, action, login, nil)
+}
+
+// loginGroup возвращает основную группу пользователя или устройства с
+// указанным логином или пустую строку, если логин неизвестен.
+func (s *Store) loginGroup(ctx context.Context, kind, login string) string {
+	switch kind {
+	case "user":
+		if user, err := s.model(ctx).Users.Login(login); err == nil {
+			return user.GroupID
+		}
+	case "device":
+		if device, err := s.model(ctx).Devices.Login(login); err == nil {
+			return device.GroupID
+		}
+	}
+	return ""
+}
+
+// AuditList возвращает журнал изменений группы, начиная с самых новых
+// записей. Записи можно отфильтровать по времени (from, to в формате
+// RFC 3339), автору изменений (actor), объекту (target) и действию (action).
+// Параметр limit ограничивает количество записей в ответе.
+func (s *Store) AuditList(c *rest.Context) error {
+	token := GetToken(c)
+	if token == nil {
+		return ErrBadToken
+	}
+	params := c.Request.URL.Query()
+	var query = bson.M{"group": token.Group}
+	for _, name := range []string{"actor", "target", "action"} {
+		if value := params.Get(name); value != "" {
+			query[name] = value
+		}
+	}
+	var period = bson.M{}
+	for name, operator := range map[string]string{"from": "$gte", "to": "$lt"} {
+		value := params.Get(name)
+		if value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return sendProblem(c, http.StatusBadRequest, "bad "+name+" time")
+		}
+		period[operator] = t
+	}
+	if len(period) > 0 {
+		query["time"] = period
+	}
+	limit := auditLimit
+	if value := params.Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			return sendProblem(c, http.StatusBadRequest, "bad limit")
+		}
+		if n < limit {
+			limit = n
+		}
+	}
+	session, coll := s.collContext(c.Request.Context(), "audit")
+	defer session.Close()
+	var entries = make([]*AuditEntry, 0)
+	if err := coll.Find(query).Sort("-time").Limit(limit).All(&entries); err != nil {
+		return err
+	}
+	total, err := coll.Find(query).Count()
+	if err != nil {
+		return err
+	}
+	c.Header().Set("X-Total-Count", strconv.Itoa(total))
+	return c.Send(entries)
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/geotrace/geo"
+	"github.com/mdigger/rest"
+)
+
+func TestAuditDiff(t *testing.T) {
+	changes := auditDiff(
+		rest.JSON{"name": "old", "radius": 10, "password": "a"},
+		rest.JSON{"name": "new", "radius": 10, "password": "b", "users": []string{"test"}})
+	if len(changes) != 3 {
+		t.Fatalf("bad changes count: %d", len(changes))
+	}
+	if changes["name"].Before != "old" || changes["name"].After != "new" {
+		t.Error("bad name change")
+	}
+	if changes["password"].Before != nil || changes["password"].After != nil {
+		t.Error("password must be hidden")
+	}
+	if changes["users"].Before != nil || changes["users"].After == nil {
+		t.Error("bad users change")
+	}
+	if auditDiff(rest.JSON{"name": "test"}, rest.JSON{"name": "test"}) != nil {
+		t.Error("unchanged document must have no changes")
+	}
+	if len(auditDiff(nil, rest.JSON{"name": "test"})) != 1 {
+		t.Error("bad created document changes")
+	}
+}
+
+func TestAuditList(t *testing.T) {
+	token, err := getUserToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := request(TestRequest{
+		"Создание места для журнала изменений",
+		"POST",
+		"places",
+		rest.JSON{
+			"name": "test_audit_place",
+			"circle": rest.JSON{
+				"center": geo.Point{88, 55},
+				"radius": 100,
+			},
+		},
+		201,
+	}, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var created struct {
+		ID string `json:"id"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := request(TestRequest{
+		"Удаление места для журнала изменений",
+		"DELETE",
+		fmt.Sprintf("places/%s", created.ID),
+		nil,
+		204,
+	}, token); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err = request(TestRequest{
+		"Получение журнала изменений места",
+		"GET",
+		fmt.Sprintf("audit?target=%s&actor=test", created.ID),
+		nil,
+		200,
+	}, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entries []AuditEntry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("bad audit entries count: %d", len(entries))
+	}
+	if entries[0].Action != "place.delete" || entries[1].Action != "place.create" {
+		t.Errorf("bad audit actions: %s, %s", entries[0].Action, entries[1].Action)
+	}
+	if entries[1].Changes["name"] == nil ||
+		entries[1].Changes["name"].After != "test_audit_place" {
+		t.Error("bad created place changes")
+	}
+
+	// неудачная авторизация видна в журнале основной группы пользователя
+	if _, err := getToken("user", "test", "bad_password"); err == nil {
+		t.Fatal("login with bad password must fail")
+	}
+	resp, err = request(TestRequest{
+		"Журнал неудачных авторизаций",
+		"GET",
+		"audit?action=user.login.failed&actor=test",
+		nil,
+		200,
+	}, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries = nil
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) == 0 {
+		t.Error("failed login not found in group audit")
+	}
+
+	for _, test := range []TestRequest{
+		{
+			"Журнал авторизаций пользователя за период",
+			"GET",
+			"audit?action=user.login&from=2016-01-01T00:00:00Z&limit=10",
+			nil,
+			200,
+		},
+		{
+			"Ошибка в формате времени",
+			"GET",
+			"audit?from=yesterday",
+			nil,
+			400,
+		},
+	} {
+		if _, err := request(test, token); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestRemoteIP(t *testing.T) {
+	proxies, err := ParseTrustedProxies("10.0.0.0/8, 192.168.1.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(saved []*net.IPNet) { trustedProxies = saved }(trustedProxies)
+	trustedProxies = proxies
+	for _, test := range []struct {
+		remote, forwarded, ip string
+	}{
+		{"1.2.3.4:5000", "", "1.2.3.4"},
+		{"1.2.3.4:5000", "5.6.7.8", "1.2.3.4"}, // не прокси
+		{"10.0.0.1:5000", "", "10.0.0.1"},
+		{"10.0.0.1:5000", "5.6.7.8", "5.6.7.8"},
+		{"10.0.0.1:5000", "9.9.9.9, 5.6.7.8", "5.6.7.8"}, // первый задал клиент
+		{"10.0.0.1:5000", "5.6.7.8, 192.168.1.1", "5.6.7.8"},
+		{"10.0.0.1:5000", "10.1.1.1", "10.1.1.1"},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = test.remote
+		if test.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", test.forwarded)
+		}
+		if ip := remoteIP(r); ip != test.ip {
+			t.Errorf("%s %q: %s != %s", test.remote, test.forwarded, ip, test.ip)
+		}
+	}
+	if _, err := ParseTrustedProxies("10.0.0.0/33"); err == nil {
+		t.Error("must be error")
+	}
+}
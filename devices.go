@@ -1,22 +1,249 @@
 package main
 
 import (
+	"context"
+	"net/http"
+	"time"
+
 	"github.com/geotrace/model"
 	"github.com/mdigger/rest"
+	"gopkg.in/mgo.v2"
 )
 
 // DevicesList отдает список устройств, зарегистрированных для данной группы.
+// Если в запросе указан параметр include=position (или position=true), то
+// для каждого устройства добавляется его последнее известное местоположение.
+// Список поддерживает постраничный вывод, сортировку и фильтрацию (см.
+// ListQuery), а также выбор возвращаемых полей.
 func (s *Store) DevicesList(c *rest.Context) error {
 	token := GetToken(c)
 	if token == nil {
 		return ErrBadToken
 	}
-	devices, err := (*model.Devices)(s.db).List(token.Group)
+	includes, err := parseIncludes(c, "position")
+	if err != nil {
+		return badRequest(c, err)
+	}
+	query, err := parseListQuery(c)
+	if err != nil {
+		return err
+	}
+	withPosition := includes["position"] || c.Request.URL.Query().Get("position") == "true"
+	var devices = make([]model.Device, 0)
+	var page *listPage
+	if query.Supports(devicesSource) {
+		// выборка выполняется в MongoDB, а местоположение добавляется только
+		// к отдаваемым устройствам
+		page, err = query.Find(s, devicesSource, devicesSource.Group(token.Group), &devices)
+		if err != nil {
+			return err
+		}
+		if !withPosition {
+			return sendPage(c, devices, page)
+		}
+	} else {
+		// выборка по местоположению выполняется в памяти
+		devices, err = s.model(c.Request.Context()).Devices.List(token.Group)
+		if err != nil && err != model.ErrNotFound {
+			return err
+		}
+		if !withPosition {
+			return sendList(c, query, devices, devicesSource.Key())
+		}
+	}
+	positions, err := s.positions(c.Request.Context(), token.Group)
+	if err != nil {
+		return err
+	}
+	var result = make([]*DeviceInfo, len(devices))
+	for i, device := range devices {
+		result[i] = &DeviceInfo{Device: device}
+		if position, ok := positions[device.ID]; ok {
+			position.Online = position.Online &&
+				time.Since(position.Time) < deviceOffline
+			result[i].Position = position
+		}
+	}
+	if page != nil {
+		return sendPage(c, result, page)
+	}
+	return sendList(c, query, result, devicesSource.Key())
+}
+
+// device возвращает описание устройства группы.
+func (s *Store) device(ctx context.Context, group, id string) (*model.Device, error) {
+	device, err := s.model(ctx).Devices.Get(group, id)
+	if isNotFound(err) {
+		return nil, model.ErrNotFound
+	}
+	return device, err
+}
+
+// DeviceGet возвращает описание устройства группы. Версия описания
+// отдается в заголовке ETag (см. sendVersion). С параметром include=position добавляется
+// последнее известное местоположение устройства.
+func (s *Store) DeviceGet(c *rest.Context) error {
+	token := GetToken(c)
+	if token == nil {
+		return ErrBadToken
+	}
+	includes, err := parseIncludes(c, "position")
+	if err != nil {
+		return badRequest(c, err)
+	}
+	device, err := s.device(c.Request.Context(), token.Group, c.Param("device-id"))
+	if err == model.ErrNotFound {
+		return notFound(c)
+	}
+	if err != nil {
+		return err
+	}
+	version, err := s.version("devicemeta", device.ID)
+	if err != nil {
+		return err
+	}
+	if !includes["position"] {
+		return sendVersion(c, version, includes, device)
+	}
+	position, err := s.position(c.Request.Context(), device.ID)
+	if err != nil && err != mgo.ErrNotFound {
+		return err
+	}
+	if position != nil {
+		position.Online = position.Online &&
+			time.Since(position.Time) < deviceOffline
+	}
+	return sendVersion(c, version, includes, &DeviceInfo{Device: *device, Position: position})
+}
+
+// deviceChange описывает поля устройства, которые можно изменить через API.
+// Идентификатор, группа и пароль устройства не изменяются, а остальные поля
+// запроса игнорируются.
+type deviceChange struct {
+	Name string `json:"name"`
+}
+
+// apply возвращает копию описания устройства с измененными полями.
+func (d *deviceChange) apply(device *model.Device) *model.Device {
+	changed := *device
+	changed.Name = d.Name
+	return &changed
+}
+
+// DeviceChange изменяет описание устройства группы. Если указан заголовок
+// If-Match, то описание изменяется только при совпадении версии.
+func (s *Store) DeviceChange(c *rest.Context) error {
+	token := GetToken(c)
+	if token == nil {
+		return ErrBadToken
+	}
+	device, err := s.device(c.Request.Context(), token.Group, c.Param("device-id"))
+	if err == model.ErrNotFound {
+		return notFound(c)
+	}
+	if err != nil {
+		return err
+	}
+	data := new(deviceChange)
+	if err := bind(c, data); err != nil {
+		return err
+	}
+	return s.saveDevice(c, token.Group, device, data.apply(device))
+}
+
+// DevicePatch частично изменяет описание устройства группы. Изменения
+// принимаются в формате JSON Merge Patch или JSON Patch.
+func (s *Store) DevicePatch(c *rest.Context) error {
+	token := GetToken(c)
+	if token == nil {
+		return ErrBadToken
+	}
+	device, err := s.device(c.Request.Context(), token.Group, c.Param("device-id"))
 	if err == model.ErrNotFound {
-		return c.Send(rest.ErrNotFound)
+		return notFound(c)
 	}
 	if err != nil {
 		return err
 	}
-	return c.Send(devices)
+	patched := new(deviceChange)
+	if err := patchRequest(c, device, patched); err != nil {
+		if err == ErrUnsupportedPatch {
+			return sendProblem(c, http.StatusUnsupportedMediaType, err.Error())
+		}
+		return badRequest(c, err)
+	}
+	return s.saveDevice(c, token.Group, device, patched.apply(device))
+}
+
+// saveDevice сохраняет измененное описание устройства группы. Предыдущее
+// описание before используется для записи в журнал изменений.
+func (s *Store) saveDevice(c *rest.Context, group string, before, device *model.Device) error {
+	version, err := s.checkVersion(c, "devicemeta", device.ID)
+	if version == 0 {
+		return err
+	}
+	if err := s.model(c.Request.Context()).Devices.Update(group, device); err != nil {
+		if err == model.ErrNotFound {
+			return notFound(c)
+		}
+		return err
+	}
+	if version, err = s.commitVersion("devicemeta", group, device.ID, version); err != nil {
+		return err
+	}
+	s.audit(c, "device.change", device.ID, before, device)
+	c.Header().Set("ETag", versionTag(version))
+	return c.Send(nil)
+}
+
+// DeviceDelete перемещает устройство группы в корзину, откуда его можно
+// восстановить до истечения срока хранения. Если указан заголовок If-Match,
+// то устройство удаляется только при совпадении версии.
+func (s *Store) DeviceDelete(c *rest.Context) error {
+	token := GetToken(c)
+	if token == nil {
+		return ErrBadToken
+	}
+	id := c.Param("device-id")
+	device, err := s.device(c.Request.Context(), token.Group, id)
+	if err == model.ErrNotFound {
+		return notFound(c)
+	}
+	if err != nil {
+		return err
+	}
+	if c.Request.Header.Get("If-Match") != "" {
+		if version, err := s.checkVersion(c, "devicemeta", id); version == 0 {
+			return err
+		}
+	}
+	// хеш пароля в корзине не хранится: восстановленное устройство получает
+	// новый пароль
+	snapshot := *device
+	snapshot.Password = nil
+	// запись в корзине создается до удаления, чтобы устройство не пропало,
+	// и удаляется, если удалить устройство не удалось
+	trash := &TrashItem{
+		Kind:   "device",
+		Target: device.ID,
+		Name:   device.Name,
+		Device: &snapshot,
+	}
+	if err := s.toTrash(c.Request.Context(), token, trash); err != nil {
+		return err
+	}
+	if err := s.model(c.Request.Context()).Devices.Delete(token.Group, id); err != nil {
+		s.dropTrash(trash)
+		if err == model.ErrNotFound {
+			return notFound(c)
+		}
+		return err
+	}
+	session, coll := s.coll("devicemeta")
+	defer session.Close()
+	if err := coll.RemoveId(id); err != nil && err != mgo.ErrNotFound {
+		return err
+	}
+	s.audit(c, "device.delete", id, device, nil)
+	return c.Send(nil)
 }
@@ -38,3 +38,25 @@ func TestDevices(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestDeviceChange(t *testing.T) {
+	device := &model.Device{
+		ID:       "test",
+		GroupID:  "test_group",
+		Name:     "old",
+		Password: model.Password("hash"),
+	}
+	var data deviceChange
+	body := `{"id":"other","groupId":"other","name":"new","password":"secret"}`
+	if err := json.Unmarshal([]byte(body), &data); err != nil {
+		t.Fatal(err)
+	}
+	changed := data.apply(device)
+	if changed.Name != "new" || changed.ID != "test" || changed.GroupID != "test_group" ||
+		string(changed.Password) != "hash" {
+		t.Errorf("bad changed device: %+v", changed)
+	}
+	if device.Name != "old" {
+		t.Error("original device changed")
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/geotrace/model"
+	"github.com/mdigger/rest"
+	"gopkg.in/mgo.v2"
+)
+
+// ProblemType задает тип содержимого ответа с описанием ошибки (RFC 7807).
+const ProblemType = "application/problem+json"
+
+// базовый адрес для идентификаторов типов ошибок
+var ProblemBase = "https://api.geotrace/problems/"
+
+// Коды ошибок, соответствующие статусам HTTP. Используются, если для ошибки
+// не задан более точный код.
+var problemCodes = map[int]string{
+	http.StatusBadRequest:            "bad_request",
+	http.StatusUnauthorized:          "unauthorized",
+	http.StatusForbidden:             "forbidden",
+	http.StatusNotFound:              "not_found",
+	http.StatusMethodNotAllowed:      "method_not_allowed",
+	http.StatusNotAcceptable:         "not_acceptable",
+	http.StatusConflict:              "conflict",
+	http.StatusPreconditionFailed:    "precondition_failed",
+	http.StatusRequestEntityTooLarge: "body_too_large",
+	http.StatusUnsupportedMediaType:  "unsupported_media_type",
+	http.StatusTooManyRequests:       "rate_limited",
+	http.StatusInternalServerError:   "internal_error",
+	http.StatusServiceUnavailable:    "unavailable",
+}
+
+// Коды и статусы ошибок приложения и хранилища. Все известные ошибки
+// приводятся к ответу здесь, в одном месте.
+var knownErrors = map[error]struct {
+	status int
+	code   string
+}{
+	model.ErrNotFound:     {http.StatusNotFound, "not_found"},
+	mgo.ErrNotFound:       {http.StatusNotFound, "not_found"},
+	model.ErrBadPlaceData: {http.StatusBadRequest, "bad_place_data"},
+	ErrBadToken:           {http.StatusUnauthorized, "bad_token"},
+	ErrBadPassword:        {http.StatusForbidden, "bad_credentials"},
+	ErrUserDisabled:       {http.StatusForbidden, "user_disabled"},
+	ErrNotMember:          {http.StatusForbidden, "not_member"},
+	ErrVersionConflict:    {http.StatusPreconditionFailed, "version_mismatch"},
+	ErrBadPatch:           {http.StatusBadRequest, "bad_patch"},
+	ErrPatchTestFailed:    {http.StatusBadRequest, "patch_test_failed"},
+	ErrUnsupportedPatch:   {http.StatusUnsupportedMediaType, "unsupported_patch"},
+	ErrBadLimit:           {http.StatusBadRequest, "bad_limit"},
+	ErrBadCursor:          {http.StatusBadRequest, "bad_cursor"},
+	ErrBadFilter:          {http.StatusBadRequest, "bad_filter"},
+	ErrBadPoint:           {http.StatusBadRequest, "bad_point"},
+	ErrBadSchedule:        {http.StatusBadRequest, "bad_schedule"},
+	ErrBadEventData:       {http.StatusBadRequest, "bad_event_data"},
+	ErrBadWebhookData:     {http.StatusBadRequest, "bad_webhook_data"},
+	ErrBadGroupData:       {http.StatusBadRequest, "bad_group_data"},
+	ErrBadProfile:         {http.StatusBadRequest, "bad_profile"},
+	ErrBadImportFormat:    {http.StatusUnsupportedMediaType, "bad_import_format"},
+	ErrBodyTooLarge:       {http.StatusRequestEntityTooLarge, "body_too_large"},
+}
+
+// FieldError описывает ошибку в значении поля запроса.
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+// Problem описывает ошибку в формате RFC 7807. Код ошибки code не меняется
+// от версии к версии и может использоваться клиентами для ее обработки.
+type Problem struct {
+	Type     string        `json:"type"`
+	Title    string        `json:"title"`
+	Status   int           `json:"status"`
+	Code     string        `json:"code"`
+	Detail   string        `json:"detail,omitempty"`
+	Instance string        `json:"instance,omitempty"`
+	Errors   []*FieldError `json:"errors,omitempty"`
+}
+
+// NewProblem возвращает описание ошибки с указанным статусом HTTP. Если код
+// ошибки не указан, то он выбирается по статусу.
+func NewProblem(status int, code, detail string, errors ...*FieldError) *Problem {
+	if code == "" {
+		if code = problemCodes[status]; code == "" {
+			code = "error"
+		}
+	}
+	return &Problem{
+		Type:   ProblemBase + code,
+		Title:  http.StatusText(status),
+		Status: status,
+		Code:   code,
+		Detail: detail,
+		Errors: errors,
+	}
+}
+
+// Error возвращает описание ошибки.
+func (p *Problem) Error() string {
+	if p.Detail != "" {
+		return p.Detail
+	}
+	return p.Title
+}
+
+// errorProblem возвращает описание ошибки для ответа. Неизвестные ошибки
+// считаются внутренними, и их описание возвращается только в режиме отладки.
+func errorProblem(err error) *Problem {
+	if problem, ok := err.(*Problem); ok {
+		return problem
+	}
+	if known, ok := knownErrors[err]; ok {
+		return NewProblem(known.status, known.code, err.Error())
+	}
+	problem := NewProblem(http.StatusInternalServerError, "", "")
+	if rest.Debug {
+		problem.Detail = err.Error()
+	}
+	return problem
+}
+
+// sendProblem отдает в ответ описание ошибки с указанным статусом.
+func sendProblem(c *rest.Context, status int, detail string) error {
+	return writeProblem(c, NewProblem(status, "", detail))
+}
+
+// sendError отдает в ответ описание ошибки приложения или хранилища.
+func sendError(c *rest.Context, err error) error {
+	return writeProblem(c, errorProblem(err))
+}
+
+// badRequest отдает в ответ ошибку в данных запроса. Для известных ошибок и
+// описаний ошибок используются их статус и код.
+func badRequest(c *rest.Context, err error) error {
+	if _, ok := err.(*Problem); ok {
+		return sendError(c, err)
+	}
+	if _, ok := knownErrors[err]; ok {
+		return sendError(c, err)
+	}
+	return sendProblem(c, http.StatusBadRequest, err.Error())
+}
+
+// notFound отдает в ответ ошибку об отсутствии документа.
+func notFound(c *rest.Context) error {
+	return sendError(c, model.ErrNotFound)
+}
+
+// writeProblem отдает в ответ описание ошибки в формате
+// application/problem+json. Описание внутренних ошибок возвращается только в
+// режиме отладки.
+func writeProblem(c *rest.Context, problem *Problem) error {
+	if problem.Status >= http.StatusInternalServerError && !rest.Debug {
+		problem.Detail = ""
+	}
+	problem.Instance = c.Request.URL.Path
+	data, err := json.Marshal(problem)
+	if err != nil {
+		return err
+	}
+	c.ContentType = ProblemType
+	return c.Status(problem.Status).Send(data)
+}
+
+// serveProblem отдает в ответ на HTTP-запрос r описание ошибки без
+// использования rest.Context.
+func serveProblem(w http.ResponseWriter, r *http.Request, problem *Problem) {
+	problem.Instance = r.URL.Path
+	header := w.Header()
+	header.Set("Content-Type", ProblemType)
+	header.Del("Content-Length")
+	w.WriteHeader(problem.Status)
+	json.NewEncoder(w).Encode(problem)
+}
+
+// MuxProblems отдает ошибки 404 и 405, которые ServeMux возвращает для
+// неизвестных путей и методов, в формате RFC 7807. Ответы обработчиков API,
+// ошибки которых уже имеют этот формат, передаются без изменений.
+func MuxProblems(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(&muxResponse{ResponseWriter: w, request: r}, r)
+	})
+}
+
+// muxResponse заменяет ответ ServeMux с ошибкой 404 или 405 описанием ошибки
+// в формате RFC 7807.
+type muxResponse struct {
+	http.ResponseWriter
+	request  *http.Request
+	replaced bool // ответ ServeMux заменен, и его тело отбрасывается
+}
+
+func (w *muxResponse) WriteHeader(status int) {
+	if !w.replaced && (status == http.StatusNotFound || status == http.StatusMethodNotAllowed) &&
+		w.Header().Get("Content-Type") != ProblemType {
+		w.replaced = true
+		serveProblem(w.ResponseWriter, w.request, NewProblem(status, "", ""))
+		return
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *muxResponse) Write(data []byte) (int, error) {
+	if w.replaced {
+		return len(data), nil
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+// Problems отдает ошибки, возвращаемые обработчиком, в формате RFC 7807.
+// Внутренние ошибки дополнительно выводятся в лог.
+func Problems(h rest.Handler) rest.Handler {
+	return func(c *rest.Context) error {
+		err := h(c)
+		if err == nil {
+			return nil
+		}
+		problem := errorProblem(err)
+		if problem.Status >= http.StatusInternalServerError {
+			var id string
+			if info := requestInfo(c.Request); info != nil {
+				id = info.ID
+			}
+			llog.Error("Internal error", "request", id, "method", c.Request.Method,
+				"path", c.Request.URL.Path, "err", err)
+		}
+		return writeProblem(c, problem)
+	}
+}
+
+// ErrBodyTooLarge возвращается, если тело запроса больше допустимого размера.
+var ErrBodyTooLarge = errors.New("request body too large")
+
+// readBody читает тело запроса размером не больше max байт. Если тело
+// запроса больше, то чтение прерывается и возвращается ErrBodyTooLarge.
+func readBody(c *rest.Context, max int64) ([]byte, error) {
+	data, err := ioutil.ReadAll(http.MaxBytesReader(c.ResponseWriter, c.Request.Body, max))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return nil, ErrBodyTooLarge
+	}
+	return data, err
+}
+
+// bind разбирает тело запроса в v. Ошибка разбора возвращается как ошибка
+// запроса с кодом bad_body.
+func bind(c *rest.Context, v interface{}) error {
+	if err := c.Bind(v); err != nil {
+		return NewProblem(http.StatusBadRequest, "bad_body", err.Error())
+	}
+	return nil
+}
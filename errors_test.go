@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/geotrace/model"
+	"github.com/mdigger/rest"
+)
+
+func TestErrorProblem(t *testing.T) {
+	debug := rest.Debug
+	defer func() { rest.Debug = debug }()
+	for _, test := range []struct {
+		err    error
+		debug  bool
+		status int
+		code   string
+		detail string
+	}{
+		{model.ErrNotFound, false, 404, "not_found", model.ErrNotFound.Error()},
+		{ErrBadToken, false, 401, "bad_token", ErrBadToken.Error()},
+		{ErrVersionConflict, false, 412, "version_mismatch", ErrVersionConflict.Error()},
+		{ErrBadLimit, false, 400, "bad_limit", ErrBadLimit.Error()},
+		{NewProblem(409, "", "conflict detail"), false, 409, "conflict", "conflict detail"},
+		{errors.New("db is down"), false, 500, "internal_error", ""},
+		{errors.New("db is down"), true, 500, "internal_error", "db is down"},
+	} {
+		rest.Debug = test.debug
+		req, _ := http.NewRequest("GET", "/api/v0/test", nil)
+		w := httptest.NewRecorder()
+		c := &rest.Context{Request: req, ResponseWriter: w}
+		if err := Problems(func(*rest.Context) error { return test.err })(c); err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != test.status {
+			t.Errorf("%v: status %d != %d", test.err, w.Code, test.status)
+		}
+		if ct := w.Header().Get("Content-Type"); ct != ProblemType {
+			t.Errorf("%v: content type %q", test.err, ct)
+		}
+		var problem Problem
+		if err := json.Unmarshal(w.Body.Bytes(), &problem); err != nil {
+			t.Fatal(err)
+		}
+		if problem.Code != test.code || problem.Detail != test.detail ||
+			problem.Status != test.status || problem.Instance != "/api/v0/test" ||
+			problem.Type != ProblemBase+test.code {
+			t.Errorf("%v: bad problem %+v", test.err, problem)
+		}
+	}
+}
+
+func TestProblemResponse(t *testing.T) {
+	token, err := getUserToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		TestRequest
+		code string
+	}{
+		{TestRequest{"Несуществующее место", "GET", "places/unknown", nil, 404}, "not_found"},
+		{TestRequest{"Нет токена", "GET", "places", nil, 401}, "unauthorized"},
+		{TestRequest{"Неверный лимит", "GET", "places?limit=0", nil, 400}, "bad_limit"},
+		{TestRequest{"Неверные данные", "POST", "places", "bad", 400}, "bad_body"},
+	} {
+		var auth = token
+		if test.Status == http.StatusUnauthorized {
+			auth = nil
+		}
+		resp, err := request(test.TestRequest, auth)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ct := resp.Header.Get("Content-Type"); ct != ProblemType {
+			t.Errorf("%s: content type %q", test.Name, ct)
+		}
+		var problem Problem
+		err = json.NewDecoder(resp.Body).Decode(&problem)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if problem.Code != test.code || problem.Status != test.Status {
+			t.Errorf("%s: bad problem %+v", test.Name, problem)
+		}
+	}
+}
+
+func TestMuxProblems(t *testing.T) {
+	handler := MuxProblems(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v0/unknown": // ответ ServeMux для неизвестного пути
+			http.NotFound(w, r)
+		case "/api/v0/places":
+			w.Header().Set("Allow", "GET, POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		default: // ошибка обработчика API
+			w.Header().Set("Content-Type", ProblemType)
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"code":"not_found","detail":"place not found"}`))
+		}
+	}))
+	for _, test := range []struct {
+		method, path string
+		status       int
+		code         string
+		detail       string
+	}{
+		{"GET", "/api/v0/unknown", http.StatusNotFound, "not_found", ""},
+		{"DELETE", "/api/v0/places", http.StatusMethodNotAllowed, "method_not_allowed", ""},
+		{"GET", "/api/v0/places/test", http.StatusNotFound, "not_found", "place not found"},
+	} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(test.method, test.path, nil))
+		var problem Problem
+		if err := json.Unmarshal(w.Body.Bytes(), &problem); err != nil {
+			t.Errorf("%s %s: %v %q", test.method, test.path, err, w.Body.String())
+			continue
+		}
+		if w.Code != test.status || w.Header().Get("Content-Type") != ProblemType ||
+			problem.Code != test.code || problem.Detail != test.detail {
+			t.Errorf("%s %s: bad response %d %v %+v", test.method, test.path,
+				w.Code, w.Header(), problem)
+		}
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("DELETE", "/api/v0/places", nil))
+	if w.Header().Get("Allow") != "GET, POST" {
+		t.Errorf("allowed methods lost: %v", w.Header())
+	}
+}
+
+func TestReadBody(t *testing.T) {
+	read := func(body string) ([]byte, error) {
+		r := httptest.NewRequest("POST", "/api/v0/import/places", strings.NewReader(body))
+		return readBody(&rest.Context{Request: r, ResponseWriter: httptest.NewRecorder()}, 4)
+	}
+	if data, err := read("test"); err != nil || string(data) != "test" {
+		t.Errorf("bad body: %q %v", data, err)
+	}
+	if _, err := read("tests"); err != ErrBodyTooLarge {
+		t.Errorf("body must be too large: %v", err)
+	}
+	if problem := errorProblem(ErrBodyTooLarge); problem.Status != http.StatusRequestEntityTooLarge {
+		t.Errorf("bad status: %d", problem.Status)
+	}
+}
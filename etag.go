@@ -0,0 +1,164 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/mdigger/rest"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var ErrVersionConflict = errors.New("document version mismatch")
+
+// versionTag возвращает значение заголовка ETag для документа с указанной
+// версией.
+func versionTag(version int) string {
+	return fmt.Sprintf(`"%d"`, version)
+}
+
+// dataTag возвращает слабое значение заголовка ETag, вычисленное по
+// содержимому ответа.
+func dataTag(data interface{}) (string, error) {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return "", err
+	}
+	sum := sha1.Sum(raw)
+	return `W/"` + hex.EncodeToString(sum[:]) + `"`, nil
+}
+
+// matchTag возвращает true, если значение ETag присутствует в списке значений
+// заголовка If-Match или If-None-Match. При слабом сравнении (weak) значения
+// сравниваются без учета префикса W/, а при строгом слабые значения никогда
+// не совпадают (RFC 7232, раздел 2.3.2).
+func matchTag(header, tag string, weak bool) bool {
+	if weak {
+		tag = strings.TrimPrefix(tag, "W/")
+	} else if strings.HasPrefix(tag, "W/") {
+		return strings.TrimSpace(header) == "*"
+	}
+	for _, value := range strings.Split(header, ",") {
+		value = strings.TrimSpace(value)
+		if weak {
+			value = strings.TrimPrefix(value, "W/")
+		}
+		if value == "*" || value == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// ifMatch возвращает true, если в запросе не указан заголовок If-Match или
+// его значение строго соответствует текущему ETag документа.
+func ifMatch(c *rest.Context, tag string) bool {
+	header := c.Request.Header.Get("If-Match")
+	return header == "" || matchTag(header, tag, false)
+}
+
+// notModified устанавливает заголовок ETag ответа и возвращает true, если
+// значение совпадает с заголовком If-None-Match запроса. В этом случае в
+// ответ уже отправлен статус 304 и больше ничего отправлять не нужно.
+func notModified(c *rest.Context, tag string) bool {
+	c.Header().Set("ETag", tag)
+	header := c.Request.Header.Get("If-None-Match")
+	if header == "" || !matchTag(header, tag, true) {
+		return false
+	}
+	c.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// sendTagged отдает данные с заголовком ETag, вычисленным по их содержимому,
+// или статус 304, если данные не изменились.
+func sendTagged(c *rest.Context, data interface{}) error {
+	tag, err := dataTag(data)
+	if err != nil {
+		return err
+	}
+	if notModified(c, tag) {
+		return nil
+	}
+	return c.Send(data)
+}
+
+// sendVersion отдает описание документа с версией version или статус 304,
+// если оно не изменилось. Версия описывает только сам документ, поэтому
+// используется в качестве ETag, только если в запросе не указаны параметры
+// fields и include. Для выбранных полей и связанных данных ETag вычисляется
+// по содержимому ответа.
+func sendVersion(c *rest.Context, version int, includes map[string]bool, data interface{}) error {
+	if len(includes) == 0 && c.Request.URL.Query().Get("fields") == "" {
+		if notModified(c, versionTag(version)) {
+			return nil
+		}
+		return c.Send(data)
+	}
+	data, err := selectFields(c, data)
+	if err != nil {
+		return err
+	}
+	return sendTagged(c, data)
+}
+
+// version возвращает текущую версию документа из коллекции дополнительных
+// параметров. Для документов без сохраненной версии возвращается 0.
+func (s *Store) version(collection, id string) (int, error) {
+	session, coll := s.coll(collection)
+	defer session.Close()
+	var doc struct {
+		Version int `bson:"version"`
+	}
+	err := coll.FindId(id).Select(bson.M{"version": 1}).One(&doc)
+	if err != nil && err != mgo.ErrNotFound {
+		return 0, err
+	}
+	return doc.Version, nil
+}
+
+// commitVersion сохраняет новую версию документа в коллекции дополнительных
+// параметров после его изменения. Версия меняется, только если предыдущая
+// версия не изменилась после проверки в checkVersion. Если документ за это
+// время изменил другой запрос, то версия все равно увеличивается, чтобы ETag
+// не совпал ни с одним из отданных ранее. Возвращает сохраненную версию.
+func (s *Store) commitVersion(collection, group, id string, version int) (int, error) {
+	session, coll := s.coll(collection)
+	defer session.Close()
+	var query = bson.M{"_id": id, "version": version - 1}
+	if version == 1 { // версия может быть еще не сохранена
+		query["version"] = bson.M{"$in": []interface{}{0, nil}}
+	}
+	_, err := coll.Upsert(query, bson.M{"$set": bson.M{"group": group, "version": version}})
+	if !mgo.IsDup(err) {
+		return version, err
+	}
+	// документ с другой версией уже существует: его изменил другой запрос
+	llog.Warn("Concurrent document change", "collection", collection, "id", id)
+	if err := coll.UpdateId(id, bson.M{"$inc": bson.M{"version": 1}}); err != nil {
+		return 0, err
+	}
+	return s.version(collection, id)
+}
+
+// checkVersion проверяет заголовок If-Match для документа перед его
+// изменением и возвращает следующую версию документа, которую нужно
+// сохранить с помощью commitVersion после успешного изменения. Возвращает 0,
+// если условие не выполнено, и в этом случае в ответ уже отправлена ошибка.
+// Сама версия до изменения документа не меняется, поэтому отклоненный запрос
+// не меняет ETag.
+func (s *Store) checkVersion(c *rest.Context, collection, id string) (int, error) {
+	version, err := s.version(collection, id)
+	if err != nil {
+		return 0, err
+	}
+	if !ifMatch(c, versionTag(version)) {
+		return 0, sendError(c, ErrVersionConflict)
+	}
+	return version + 1, nil
+}
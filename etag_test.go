@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/geotrace/geo"
+	"github.com/mdigger/rest"
+)
+
+func TestMatchTag(t *testing.T) {
+	for _, test := range []struct {
+		header, tag  string
+		weak, strong bool
+	}{
+		{`"1"`, `"1"`, true, true},
+		{`"2", "1"`, `"1"`, true, true},
+		{`*`, `"1"`, true, true},
+		{`W/"abc"`, `W/"abc"`, true, false},
+		{`"abc"`, `W/"abc"`, true, false},
+		{`W/"1"`, `"1"`, true, false},
+		{`"2"`, `"1"`, false, false},
+	} {
+		if matchTag(test.header, test.tag, true) != test.weak {
+			t.Errorf("bad weak match %q for %q", test.header, test.tag)
+		}
+		if matchTag(test.header, test.tag, false) != test.strong {
+			t.Errorf("bad strong match %q for %q", test.header, test.tag)
+		}
+	}
+}
+
+func TestPlaceVersions(t *testing.T) {
+	token, err := getUserToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := request(TestRequest{
+		"Создание места для проверки версий",
+		"POST",
+		"places",
+		rest.JSON{
+			"name": "test_version_place",
+			"circle": rest.JSON{
+				"center": geo.Point{88, 55},
+				"radius": 100,
+			},
+		},
+		201,
+	}, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tag := resp.Header.Get("ETag")
+	if tag != versionTag(1) {
+		t.Fatalf("bad ETag %q", tag)
+	}
+	var created struct {
+		ID string `json:"id"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+	url := fmt.Sprintf("places/%s", created.ID)
+	place := rest.JSON{
+		"name": "test_version_place_2",
+		"circle": rest.JSON{
+			"center": geo.Point{88, 55},
+			"radius": 200,
+		},
+	}
+	for _, test := range []struct {
+		TestRequest
+		header, value string
+	}{
+		{TestRequest{"Получение неизмененного места", "GET", url, nil, 304},
+			"If-None-Match", tag},
+		{TestRequest{"Версия не используется для связанных данных", "GET",
+			url + "?include=present", nil, 200}, "If-None-Match", tag},
+		{TestRequest{"Версия не используется для выбранных полей", "GET",
+			url + "?fields=name", nil, 200}, "If-None-Match", tag},
+		{TestRequest{"Ошибка изменения места с неверными данными", "PUT", url,
+			rest.JSON{"name": "test_version_place_2"}, 400}, "If-Match", tag},
+		{TestRequest{"Версия не изменилась после ошибки", "GET", url, nil, 304},
+			"If-None-Match", tag},
+		{TestRequest{"Изменение места с совпадающей версией", "PUT", url, place, 204},
+			"If-Match", tag},
+		{TestRequest{"Ошибка изменения места с устаревшей версией", "PUT", url, place, 412},
+			"If-Match", tag},
+		{TestRequest{"Ошибка удаления места с устаревшей версией", "DELETE", url, nil, 412},
+			"If-Match", tag},
+		{TestRequest{"Удаление места с совпадающей версией", "DELETE", url, nil, 204},
+			"If-Match", versionTag(2)},
+	} {
+		if _, err := requestWithHeader(test.TestRequest, token,
+			http.Header{test.header: {test.value}}); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestSendVersion(t *testing.T) {
+	send := func(url string, includes map[string]bool) string {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", url, nil)
+		c := &rest.Context{Request: r, ResponseWriter: w}
+		if err := sendVersion(c, 3, includes, rest.JSON{"id": "test", "name": "test"}); err != nil {
+			t.Fatal(err)
+		}
+		return w.Header().Get("ETag")
+	}
+	if tag := send("/api/v0/places/test", nil); tag != versionTag(3) {
+		t.Errorf("bad version tag: %q", tag)
+	}
+	if tag := send("/api/v0/places/test?fields=name", nil); !strings.HasPrefix(tag, `W/"`) {
+		t.Errorf("fields must have weak tag: %q", tag)
+	}
+	if tag := send("/api/v0/places/test?include=present",
+		map[string]bool{"present": true}); !strings.HasPrefix(tag, `W/"`) {
+		t.Errorf("include must have weak tag: %q", tag)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/geotrace/geo"
+	"github.com/mdigger/rest"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var ErrBadEventData = errors.New("bad event data")
+
+// Event описывает событие с координатами, полученное от устройства.
+type Event struct {
+	ID       string    `bson:"_id" json:"id"`
+	Group    string    `bson:"group" json:"-"`
+	Device   string    `bson:"device" json:"device,omitempty"`
+	Time     time.Time `bson:"time" json:"time"`
+	Location geo.Point `bson:"location" json:"location"`
+	Accuracy float64   `bson:"accuracy,omitempty" json:"accuracy,omitempty"`
+	Power    int       `bson:"power,omitempty" json:"power,omitempty"`
+}
+
+// eventRequest описывает событие в запросе устройства. Координаты задаются
+// указателем, чтобы отличить их отсутствие от точки [0,0].
+type eventRequest struct {
+	Event
+	Location *geo.Point `json:"location"`
+}
+
+// EventsAdd сохраняет события, переданные устройством, и обновляет последнее
+// известное местоположение устройства.
+func (s *Store) EventsAdd(c *rest.Context) error {
+	token := GetToken(c)
+	if token == nil {
+		return ErrBadToken
+	}
+	var requests []*eventRequest
+	if err := bindStrict(c, &requests); err != nil {
+		return err
+	}
+	if len(requests) == 0 {
+		return sendError(c, ErrBadEventData)
+	}
+	now := time.Now().UTC()
+	if err := validateEvents(requests, now); err != nil {
+		return err
+	}
+	var events = make([]*Event, len(requests))
+	var docs = make([]interface{}, len(events))
+	var ids = make([]string, len(events))
+	for i, request := range requests {
+		event := &request.Event
+		event.Location = *request.Location
+		events[i] = event
+		if event.Time.IsZero() {
+			event.Time = now
+		}
+		event.ID = bson.NewObjectId().Hex()
+		event.Group = token.Group
+		event.Device = token.Id
+		docs[i] = event
+		ids[i] = event.ID
+	}
+	session, coll := s.coll("events")
+	start := time.Now()
+	err := coll.Insert(docs...)
+	observeMongo("events.insert", start)
+	session.Close()
+	if err != nil {
+		return err
+	}
+	metricEvents.Add(float64(len(events)))
+	// события уже сохранены, поэтому ошибка обновления положения устройства
+	// не отменяет запрос
+	for _, event := range events {
+		if err := s.updatePosition(c.Request.Context(), event); err != nil {
+			llog.Error("Error update position", "device", event.Device, "err", err)
+		}
+	}
+	return c.Status(http.StatusCreated).Send(rest.JSON{"ids": ids})
+}
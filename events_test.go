@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/geotrace/geo"
+	"github.com/mdigger/rest"
+)
+
+func TestEvents(t *testing.T) {
+	token, err := getDeviceToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := getUserToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	if _, err := request(TestRequest{
+		"Ошибка публикации события с неверными координатами",
+		"POST",
+		"device/events",
+		[]rest.JSON{
+			{"location": geo.Point{200, 55}},
+		},
+		400,
+	}, token); err != nil {
+		t.Error(err)
+	}
+	if _, err := request(TestRequest{
+		"Ошибка публикации события без координат",
+		"POST",
+		"device/events",
+		[]rest.JSON{
+			{"time": now, "power": 50},
+		},
+		400,
+	}, token); err != nil {
+		t.Error(err)
+	}
+	if _, err := request(TestRequest{
+		"Ошибка публикации события из будущего",
+		"POST",
+		"device/events",
+		[]rest.JSON{
+			{"time": now.Add(24 * time.Hour), "location": geo.Point{37.6, 55.7}},
+		},
+		400,
+	}, token); err != nil {
+		t.Error(err)
+	}
+	if _, err := request(TestRequest{
+		"Ошибка публикации события с токеном пользователя",
+		"POST",
+		"device/events",
+		[]rest.JSON{
+			{"location": geo.Point{37.6, 55.7}},
+		},
+		403,
+	}, user); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := request(TestRequest{
+		"Публикация событий устройства",
+		"POST",
+		"device/events",
+		[]rest.JSON{
+			{
+				"time":     now.Add(-time.Minute),
+				"location": geo.Point{37.5, 55.7},
+				"power":    50,
+			},
+			{
+				"time":     now,
+				"location": geo.Point{37.6, 55.7},
+				"accuracy": 10,
+				"power":    15,
+			},
+		},
+		201,
+	}, token); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := request(TestRequest{
+		"Получение списка устройств с последним местоположением",
+		"GET",
+		"devices?position=true",
+		nil,
+		200,
+	}, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var devices []DeviceInfo
+	if err := json.NewDecoder(resp.Body).Decode(&devices); err != nil {
+		t.Fatal(err)
+	}
+	var found bool
+	for _, device := range devices {
+		if device.ID != "test" {
+			continue
+		}
+		found = true
+		if device.Position == nil {
+			t.Fatal("position not found")
+		}
+		if device.Position.Location != (geo.Point{37.6, 55.7}) ||
+			device.Position.Power != 15 || !device.Position.Online {
+			t.Errorf("bad position: %+v", device.Position)
+		}
+	}
+	if !found {
+		t.Error("device not found")
+	}
+}
+
+func TestEventRequest(t *testing.T) {
+	var requests []*eventRequest
+	body := `[{"location":[37.6,55.7],"power":50},{"power":40}]`
+	if err := json.Unmarshal([]byte(body), &requests); err != nil {
+		t.Fatal(err)
+	}
+	if requests[0].Location == nil || *requests[0].Location != (geo.Point{37.6, 55.7}) ||
+		requests[0].Power != 50 {
+		t.Errorf("bad event: %+v", requests[0])
+	}
+	if requests[1].Location != nil {
+		t.Error("missing location must be nil")
+	}
+}
+
+func TestGeofenceTransitions(t *testing.T) {
+	for _, test := range []struct {
+		prev, current, enter, exit []string
+	}{
+		{nil, []string{"a"}, []string{"a"}, nil},
+		{[]string{"a", "b"}, []string{"b", "c"}, []string{"c"}, []string{"a"}},
+		{[]string{"a"}, nil, nil, []string{"a"}},
+		{[]string{"a"}, []string{"a"}, nil, nil},
+	} {
+		enter, exit := geofenceTransitions(test.prev, test.current)
+		if !reflect.DeepEqual(enter, test.enter) || !reflect.DeepEqual(exit, test.exit) {
+			t.Errorf("%v -> %v: enter %v, exit %v", test.prev, test.current, enter, exit)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/geotrace/geo"
+	"github.com/geotrace/model"
+	"github.com/mdigger/rest"
+)
+
+// Форматы экспорта географических данных и соответствующие им типы
+// содержимого.
+var exportFormats = map[string]string{
+	"geojson": "application/geo+json",
+	"gpx":     "application/gpx+xml",
+	"kml":     "application/vnd.google-earth.kml+xml",
+}
+
+// exportFormat возвращает название формата экспорта, запрошенного в параметре
+// format или в заголовке Accept. Если запрошен обычный формат ответа, то
+// возвращается пустая строка.
+func exportFormat(c *rest.Context) string {
+	if format := c.Request.URL.Query().Get("format"); format != "" {
+		return strings.ToLower(format)
+	}
+	return acceptFormat(c.Request.Header.Get("Accept"))
+}
+
+// acceptFormat возвращает формат экспорта с наибольшим весом q в заголовке
+// Accept; при равном весе выбирается указанный раньше. Обычный формат ответа
+// (application/json и шаблоны */* и application/*) соответствует пустой
+// строке, как и заголовок без форматов экспорта или с весом 0 у всех.
+func acceptFormat(accept string) string {
+	var result string
+	var best float64
+	for _, item := range strings.Split(accept, ",") {
+		params := strings.Split(item, ";")
+		contentType := strings.ToLower(strings.TrimSpace(params[0]))
+		var q = 1.0
+		for _, param := range params[1:] {
+			name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if strings.EqualFold(strings.TrimSpace(name), "q") {
+				var err error
+				if q, err = strconv.ParseFloat(strings.TrimSpace(value), 64); err != nil {
+					q = 0
+				}
+			}
+		}
+		if q <= best {
+			continue
+		}
+		switch contentType {
+		case "application/json", "application/*", "*/*":
+			result, best = "", q
+			continue
+		}
+		for format, exportType := range exportFormats {
+			if contentType == exportType {
+				result, best = format, q
+			}
+		}
+	}
+	return result
+}
+
+// sendExport отдает данные в указанном формате экспорта.
+func sendExport(c *rest.Context, format string, data []byte) error {
+	c.ContentType = exportFormats[format]
+	return c.Send(data)
+}
+
+// Feature описывает объект GeoJSON.
+type Feature struct {
+	Type       string                 `json:"type"`
+	Geometry   *Geometry              `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+// Geometry описывает геометрию объекта GeoJSON.
+type Geometry struct {
+	Type        string      `json:"type"`
+	Coordinates interface{} `json:"coordinates"`
+}
+
+// FeatureCollection описывает коллекцию объектов GeoJSON.
+type FeatureCollection struct {
+	Type     string     `json:"type"`
+	Features []*Feature `json:"features"`
+}
+
+// PlacesGeoJSON возвращает описание мест в виде GeoJSON FeatureCollection.
+// Круги представляются точкой центра с радиусом в свойстве radius.
+func PlacesGeoJSON(places []model.Place) ([]byte, error) {
+	var fc = &FeatureCollection{
+		Type:     "FeatureCollection",
+		Features: make([]*Feature, 0, len(places)),
+	}
+	for _, place := range places {
+		feature := &Feature{
+			Type: "Feature",
+			Properties: map[string]interface{}{
+				"id":   place.ID,
+				"name": place.Name,
+			},
+		}
+		switch {
+		case place.Circle != nil:
+			feature.Geometry = &Geometry{"Point", place.Circle.Center}
+			feature.Properties["radius"] = place.Circle.Radius
+		case place.Polygon != nil:
+			feature.Geometry = &Geometry{"Polygon", *place.Polygon}
+		}
+		fc.Features = append(fc.Features, feature)
+	}
+	return json.Marshal(fc)
+}
+
+// TrackGeoJSON возвращает поездки маршрута в виде GeoJSON FeatureCollection,
+// где каждая поездка представлена линией LineString.
+func TrackGeoJSON(track *Track) ([]byte, error) {
+	var fc = &FeatureCollection{
+		Type:     "FeatureCollection",
+		Features: make([]*Feature, 0, len(track.Trips)),
+	}
+	for _, trip := range track.Trips {
+		fc.Features = append(fc.Features, &Feature{
+			Type:     "Feature",
+			Geometry: &Geometry{"LineString", trip.Points},
+			Properties: map[string]interface{}{
+				"device":   track.Device,
+				"start":    trip.Start,
+				"end":      trip.End,
+				"distance": trip.Distance,
+				"duration": trip.Duration,
+				"avgSpeed": trip.AvgSpeed,
+				"maxSpeed": trip.MaxSpeed,
+			},
+		})
+	}
+	return json.Marshal(fc)
+}
+
+// gpxPoint описывает точку трека в формате GPX.
+type gpxPoint struct {
+	Lat  float64    `xml:"lat,attr"`
+	Lon  float64    `xml:"lon,attr"`
+	Time *time.Time `xml:"time,omitempty"`
+}
+
+// gpxSegment описывает участок трека в формате GPX.
+type gpxSegment struct {
+	Points []gpxPoint `xml:"trkpt"`
+}
+
+// gpx описывает документ в формате GPX 1.1.
+type gpx struct {
+	XMLName  xml.Name     `xml:"http://www.topografix.com/GPX/1/1 gpx"`
+	Version  string       `xml:"version,attr"`
+	Creator  string       `xml:"creator,attr"`
+	Name     string       `xml:"trk>name"`
+	Segments []gpxSegment `xml:"trk>trkseg"`
+}
+
+// TrackGPX возвращает маршрут в формате GPX, где каждая поездка представлена
+// отдельным участком трека.
+func TrackGPX(track *Track) ([]byte, error) {
+	var doc = &gpx{
+		Version:  "1.1",
+		Creator:  TokenIssuer,
+		Name:     track.Device,
+		Segments: make([]gpxSegment, len(track.Trips)),
+	}
+	for i, trip := range track.Trips {
+		doc.Segments[i].Points = make([]gpxPoint, len(trip.Points))
+		for j, point := range trip.Points {
+			doc.Segments[i].Points[j] = gpxPoint{Lat: point[1], Lon: point[0]}
+			if j < len(trip.Times) {
+				t := trip.Times[j].UTC()
+				doc.Segments[i].Points[j].Time = &t
+			}
+		}
+	}
+	data, err := xml.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), data...), nil
+}
+
+// kmlPlacemark описывает линию поездки в формате KML.
+type kmlPlacemark struct {
+	Name        string `xml:"name"`
+	Coordinates string `xml:"LineString>coordinates"`
+}
+
+// kml описывает документ в формате KML 2.2.
+type kml struct {
+	XMLName    xml.Name       `xml:"http://www.opengis.net/kml/2.2 kml"`
+	Name       string         `xml:"Document>name"`
+	Placemarks []kmlPlacemark `xml:"Document>Placemark"`
+}
+
+// TrackKML возвращает маршрут в формате KML, где каждая поездка представлена
+// отдельной линией.
+func TrackKML(track *Track) ([]byte, error) {
+	var doc = &kml{
+		Name:       track.Device,
+		Placemarks: make([]kmlPlacemark, len(track.Trips)),
+	}
+	for i, trip := range track.Trips {
+		doc.Placemarks[i].Name = trip.Start.Format("2006-01-02 15:04:05")
+		doc.Placemarks[i].Coordinates = kmlCoordinates(trip.Points)
+	}
+	data, err := xml.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), data...), nil
+}
+
+// kmlCoordinates возвращает список координат в формате KML.
+func kmlCoordinates(points []geo.Point) string {
+	var coords = make([]string, len(points))
+	for i, point := range points {
+		coords[i] = fmt.Sprintf("%g,%g", point[0], point[1])
+	}
+	return strings.Join(coords, " ")
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/geotrace/geo"
+	"github.com/geotrace/model"
+	"github.com/mdigger/rest"
+)
+
+func TestPlacesGeoJSON(t *testing.T) {
+	data, err := PlacesGeoJSON([]model.Place{
+		{
+			ID:     "circle",
+			Name:   "Circle",
+			Circle: &geo.Circle{Center: geo.Point{37.6, 55.7}, Radius: 100},
+		},
+		{
+			ID:      "polygon",
+			Name:    "Polygon",
+			Polygon: &geo.Polygon{{{0, 0}, {1, 0}, {1, 1}, {0, 0}}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fc struct {
+		Type     string
+		Features []struct {
+			Geometry struct {
+				Type string
+			}
+			Properties map[string]interface{}
+		}
+	}
+	if err := json.Unmarshal(data, &fc); err != nil {
+		t.Fatal(err)
+	}
+	if fc.Type != "FeatureCollection" || len(fc.Features) != 2 {
+		t.Fatalf("bad feature collection: %s", data)
+	}
+	if fc.Features[0].Geometry.Type != "Point" ||
+		fc.Features[0].Properties["radius"] != 100.0 {
+		t.Errorf("bad circle feature: %s", data)
+	}
+	if fc.Features[1].Geometry.Type != "Polygon" {
+		t.Errorf("bad polygon feature: %s", data)
+	}
+}
+
+func TestTrackExport(t *testing.T) {
+	track := &Track{
+		Device: "test",
+		Trips: []*Trip{
+			{
+				Start:  time.Date(2016, 1, 1, 10, 0, 0, 0, time.UTC),
+				Points: []geo.Point{{37.5, 55.7}, {37.6, 55.8}},
+				Times: []time.Time{
+					time.Date(2016, 1, 1, 10, 0, 0, 0, time.UTC),
+					time.Date(2016, 1, 1, 10, 5, 0, 0, time.UTC),
+				},
+			},
+		},
+	}
+	data, err := TrackGeoJSON(track)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"LineString"`) {
+		t.Errorf("bad GeoJSON: %s", data)
+	}
+	data, err = TrackGPX(track)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc gpx
+	if err := xml.Unmarshal(data, &doc); err != nil {
+		t.Fatal(err)
+	}
+	if len(doc.Segments) != 1 || len(doc.Segments[0].Points) != 2 ||
+		doc.Segments[0].Points[1].Lat != 55.8 {
+		t.Errorf("bad GPX: %s", data)
+	}
+	if !strings.Contains(string(data), "<time>2016-01-01T10:05:00Z</time>") {
+		t.Errorf("GPX points without time: %s", data)
+	}
+	data, err = TrackKML(track)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "<coordinates>37.5,55.7 37.6,55.8</coordinates>") {
+		t.Errorf("bad KML: %s", data)
+	}
+}
+
+func TestAcceptFormat(t *testing.T) {
+	for accept, format := range map[string]string{
+		"":                 "",
+		"application/json": "",
+		"*/*":              "",
+		"application/gpx+xml, application/vnd.google-earth.kml+xml": "gpx",
+		"application/vnd.google-earth.kml+xml, application/gpx+xml": "kml",
+		"application/gpx+xml;q=0.5, application/geo+json":           "geojson",
+		"application/json, application/gpx+xml; q=0.1":              "",
+		"application/json;q=0.1, application/gpx+xml":               "gpx",
+		"application/gpx+xml, */*":                                  "gpx",
+		"application/gpx+xml;q=0":                                   "",
+		"Application/GEO+JSON; charset=utf-8":                       "geojson",
+		"application/geo+json;q=0.5, application/gpx+xml;q=0.5":     "geojson",
+	} {
+		if result := acceptFormat(accept); result != format {
+			t.Errorf("%q: %q != %q", accept, result, format)
+		}
+	}
+}
+
+func TestPlacesExport(t *testing.T) {
+	token, err := getUserToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []TestRequest{
+		{
+			"Создание места для экспорта",
+			"POST",
+			"places",
+			rest.JSON{
+				"name": "test_export_place",
+				"circle": rest.JSON{
+					"center": geo.Point{37.6, 55.7},
+					"radius": 100,
+				},
+			},
+			201,
+		},
+		{
+			"Экспорт списка мест в формате GeoJSON",
+			"GET",
+			"places?format=geojson",
+			nil,
+			200,
+		},
+		{
+			"Ошибка экспорта списка мест в неподдерживаемом формате",
+			"GET",
+			"places?format=gpx",
+			nil,
+			406,
+		},
+		{
+			"Экспорт маршрута устройства в формате GPX",
+			"GET",
+			"devices/test/track?format=gpx",
+			nil,
+			200,
+		},
+		{
+			"Ошибка получения маршрута несуществующего устройства",
+			"GET",
+			"devices/bad_device/track",
+			nil,
+			404,
+		},
+		{
+			"Ошибка получения маршрута за слишком большой период",
+			"GET",
+			"devices/test/track?from=2016-01-01T00:00:00Z&to=2016-03-01T00:00:00Z",
+			nil,
+			400,
+		},
+	} {
+		if _, err := request(test, token); err != nil {
+			t.Error(err)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/mdigger/rest"
+)
+
+// parseIncludes возвращает список связанных данных, которые нужно добавить в
+// ответ, из параметра запроса include. Названия указываются через запятую и
+// должны входить в список поддерживаемых.
+func parseIncludes(c *rest.Context, allowed ...string) (map[string]bool, error) {
+	var result = make(map[string]bool)
+	value := c.Request.URL.Query().Get("include")
+	if value == "" {
+		return result, nil
+	}
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		var ok bool
+		for _, allow := range allowed {
+			if name == allow {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return nil, fmt.Errorf("unsupported include %q", name)
+		}
+		result[name] = true
+	}
+	return result, nil
+}
+
+// selectFields оставляет в ответе только поля, перечисленные в параметре
+// запроса fields. Вложенные поля указываются через точку. Идентификатор
+// документа возвращается всегда. Если параметр не указан, то данные
+// возвращаются без изменений.
+func selectFields(c *rest.Context, data interface{}) (interface{}, error) {
+	value := c.Request.URL.Query().Get("fields")
+	if value == "" {
+		return data, nil
+	}
+	var fields = [][]string{{"id"}}
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			fields = append(fields, strings.Split(name, "."))
+		}
+	}
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	var doc interface{}
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return nil, err
+	}
+	return pickFields(doc, fields), nil
+}
+
+// pickFields возвращает копию документа только с указанными полями. Для
+// массивов поля выбираются в каждом элементе.
+func pickFields(doc interface{}, fields [][]string) interface{} {
+	switch doc := doc.(type) {
+	case []interface{}:
+		var result = make([]interface{}, len(doc))
+		for i, item := range doc {
+			result[i] = pickFields(item, fields)
+		}
+		return result
+	case map[string]interface{}:
+		var nested = make(map[string][][]string)
+		for _, path := range fields {
+			if _, ok := doc[path[0]]; !ok {
+				continue
+			}
+			if len(path) == 1 {
+				nested[path[0]] = nil // поле целиком
+			} else if paths, ok := nested[path[0]]; !ok || paths != nil {
+				nested[path[0]] = append(paths, path[1:])
+			}
+		}
+		var result = make(map[string]interface{}, len(nested))
+		for name, paths := range nested {
+			if paths == nil {
+				result[name] = doc[name]
+			} else {
+				result[name] = pickFields(doc[name], paths)
+			}
+		}
+		return result
+	}
+	return doc
+}
+
+// sendFields отдает данные, оставив в них только поля, перечисленные в
+// параметре запроса fields.
+func sendFields(c *rest.Context, data interface{}) error {
+	data, err := selectFields(c, data)
+	if err != nil {
+		return err
+	}
+	return c.Send(data)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/mdigger/rest"
+)
+
+func TestSelectFields(t *testing.T) {
+	data := []rest.JSON{
+		{"id": "1", "name": "test", "circle": rest.JSON{"center": []float64{88, 55}, "radius": 10},
+			"present": []rest.JSON{{"id": "d1", "name": "device", "position": rest.JSON{"time": "now"}}}},
+	}
+	for _, test := range []struct {
+		fields, result string
+	}{
+		{"", `[{"id":"1","name":"test","circle":{"center":[88,55],"radius":10},` +
+			`"present":[{"id":"d1","name":"device","position":{"time":"now"}}]}]`},
+		{"name", `[{"id":"1","name":"test"}]`},
+		{"circle.radius,name", `[{"id":"1","name":"test","circle":{"radius":10}}]`},
+		{"circle,circle.radius", `[{"id":"1","circle":{"center":[88,55],"radius":10}}]`},
+		{"present.name,unknown", `[{"id":"1","present":[{"name":"device"}]}]`},
+	} {
+		req, _ := http.NewRequest("GET", "/test?"+url.Values{"fields": {test.fields}}.Encode(), nil)
+		result, err := selectFields(&rest.Context{Request: req}, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		raw, err := json.Marshal(result)
+		if err != nil {
+			t.Fatal(err)
+		}
+		jsonEqual(t, raw, test.result)
+	}
+}
+
+func TestFieldsAndIncludes(t *testing.T) {
+	token, err := getUserToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := request(TestRequest{"Список устройств только с названиями", "GET",
+		"devices?fields=name&include=position", nil, 200}, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var devices []map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&devices); err != nil {
+		t.Fatal(err)
+	}
+	for _, device := range devices {
+		for name := range device {
+			if name != "id" && name != "name" {
+				t.Errorf("unexpected field %q", name)
+			}
+		}
+	}
+	for _, test := range []TestRequest{
+		{"Устройство с местоположением", "GET",
+			"devices/test?include=position", nil, 200},
+		{"Места с устройствами в них", "GET",
+			"places?include=present&fields=name,present.name", nil, 200},
+		{"Ошибка в связанных данных", "GET", "places?include=unknown", nil, 400},
+	} {
+		if _, err := request(test, token); err != nil {
+			t.Error(err)
+		}
+	}
+}
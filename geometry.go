@@ -0,0 +1,63 @@
+package main
+
+import (
+	"math"
+
+	"github.com/geotrace/geo"
+	"github.com/geotrace/model"
+)
+
+// earthRadius задает средний радиус Земли в метрах.
+const earthRadius = 6371008.8
+
+// Distance возвращает расстояние между двумя точками в метрах, вычисленное по
+// формуле гаверсинусов.
+func Distance(a, b geo.Point) float64 {
+	lat1, lat2 := a[1]*math.Pi/180, b[1]*math.Pi/180
+	dlat := lat2 - lat1
+	dlon := (b[0] - a[0]) * math.Pi / 180
+	h := math.Sin(dlat/2)*math.Sin(dlat/2) +
+		math.Cos(lat1)*math.Cos(lat2)*math.Sin(dlon/2)*math.Sin(dlon/2)
+	return 2 * earthRadius * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+// Contains возвращает true, если точка находится внутри места.
+func Contains(place *model.Place, point geo.Point) bool {
+	if place.Circle != nil {
+		return Distance(place.Circle.Center, point) <= place.Circle.Radius
+	}
+	if place.Polygon != nil && len(*place.Polygon) > 0 {
+		rings := *place.Polygon
+		if !inRing(rings[0], point) {
+			return false
+		}
+		for _, hole := range rings[1:] { // остальные контуры описывают дыры
+			if inRing(hole, point) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// inRing проверяет попадание точки внутрь замкнутого контура методом
+// трассировки луча.
+func inRing(ring []geo.Point, point geo.Point) bool {
+	var inside bool
+	for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+		a, b := ring[i], ring[j]
+		if (a[1] > point[1]) != (b[1] > point[1]) &&
+			point[0] < (b[0]-a[0])*(point[1]-a[1])/(b[1]-a[1])+a[0] {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+// validPoint возвращает true, если координаты точки находятся в допустимых
+// пределах.
+func validPoint(point geo.Point) bool {
+	return point[0] >= -180 && point[0] <= 180 &&
+		point[1] >= -90 && point[1] <= 90
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"math"
+	"testing"
+
+	"github.com/geotrace/geo"
+	"github.com/geotrace/model"
+)
+
+func TestDistance(t *testing.T) {
+	// расстояние между Москвой и Санкт-Петербургом около 634 км
+	d := Distance(geo.Point{37.6173, 55.7558}, geo.Point{30.3141, 59.9386})
+	if math.Abs(d-634000) > 5000 {
+		t.Errorf("bad distance: %f", d)
+	}
+	if d := Distance(geo.Point{10, 10}, geo.Point{10, 10}); d != 0 {
+		t.Errorf("bad zero distance: %f", d)
+	}
+}
+
+func TestContains(t *testing.T) {
+	circle := &model.Place{
+		Circle: &geo.Circle{Center: geo.Point{37.6, 55.7}, Radius: 500},
+	}
+	if !Contains(circle, geo.Point{37.601, 55.7}) {
+		t.Error("point must be inside circle")
+	}
+	if Contains(circle, geo.Point{37.7, 55.7}) {
+		t.Error("point must be outside circle")
+	}
+	polygon := &model.Place{
+		Polygon: &geo.Polygon{
+			{{0, 0}, {10, 0}, {10, 10}, {0, 10}, {0, 0}},
+			{{4, 4}, {6, 4}, {6, 6}, {4, 6}, {4, 4}},
+		},
+	}
+	for _, test := range []struct {
+		point  geo.Point
+		inside bool
+	}{
+		{geo.Point{1, 1}, true},
+		{geo.Point{5, 5}, false}, // внутри дыры
+		{geo.Point{11, 5}, false},
+	} {
+		if Contains(polygon, test.point) != test.inside {
+			t.Errorf("bad contains for %v", test.point)
+		}
+	}
+}
@@ -0,0 +1,15 @@
+module github.com/geotrace/api
+
+go 1.21
+
+require (
+	github.com/prometheus/client_golang v1.19.1
+	github.com/ugorji/go/codec v1.2.12
+	go.opentelemetry.io/otel v1.28.0
+	go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp v1.28.0
+	go.opentelemetry.io/otel/exporters/stdout/stdouttrace v1.28.0
+	go.opentelemetry.io/otel/sdk v1.28.0
+	go.opentelemetry.io/otel/trace v1.28.0
+	gopkg.in/inconshreveable/log15.v2 v2.0.0-20180818164646-67afb5ed74ec
+	gopkg.in/mgo.v2 v2.0.0-20190816093944-a6b53ec6cb22
+)
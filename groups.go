@@ -0,0 +1,702 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/geotrace/model"
+	"github.com/mdigger/rest"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Роли пользователей в группе.
+const (
+	RoleOwner  = "owner"  // владелец группы
+	RoleAdmin  = "admin"  // администратор группы
+	RoleMember = "member" // участник группы
+)
+
+// роль пользователя в основной группе, если она не задана явно
+var defaultRole = RoleMember
+
+// ErrNotMember возвращается, если пользователь больше не входит в группу
+// токена.
+var ErrNotMember = errors.New("user is not a group member")
+
+// Membership описывает участие пользователя в группе. Основная группа
+// пользователя задается в его описании, а участие в дополнительных группах и
+// роли хранятся отдельно. Пользователь, удаленный из основной группы,
+// отмечается в описании участия, так как основную группу изменить нельзя.
+type Membership struct {
+	ID       string    `bson:"_id" json:"-"`
+	Group    string    `bson:"group" json:"group"`
+	Login    string    `bson:"login" json:"login"`
+	Role     string    `bson:"role" json:"role"`
+	Joined   time.Time `bson:"joined" json:"joined"`
+	Disabled bool      `bson:"disabled,omitempty" json:"disabled,omitempty"`
+	Removed  bool      `bson:"removed,omitempty" json:"-"`
+	Active   bool      `bson:"-" json:"active,omitempty"`
+}
+
+// membershipID возвращает идентификатор участия пользователя в группе.
+func membershipID(group, login string) string {
+	return group + "/" + login
+}
+
+// validRole возвращает true, если роль пользователя поддерживается.
+func validRole(role string) bool {
+	return role == RoleOwner || role == RoleAdmin || role == RoleMember
+}
+
+// Roles проверяет, что роль пользователя входит в список разрешенных ролей.
+// Используется вместе с TokenTemplate.Get: роль в токене к этому моменту
+// уже заменена текущей ролью пользователя в группе (см. CheckToken).
+func Roles(h rest.Handler, roles ...string) rest.Handler {
+	return func(c *rest.Context) error {
+		token := GetToken(c)
+		if token == nil {
+			return ErrBadToken
+		}
+		for _, role := range roles {
+			if token.Role == role {
+				return h(c)
+			}
+		}
+		return sendProblem(c, http.StatusForbidden, "insufficient role")
+	}
+}
+
+// memberships возвращает список групп, в которые входит пользователь.
+// Основная группа пользователя всегда идет первой, если пользователь не был
+// из нее удален.
+func (s *Store) memberships(user *model.User) ([]*Membership, error) {
+	session, coll := s.coll("members")
+	defer session.Close()
+	var list []*Membership
+	if err := coll.Find(bson.M{"login": user.Login}).Sort("joined").All(&list); err != nil {
+		return nil, err
+	}
+	var result = []*Membership{{
+		ID:    membershipID(user.GroupID, user.Login),
+		Group: user.GroupID,
+		Login: user.Login,
+		Role:  defaultRole,
+	}}
+	for _, member := range list {
+		if member.Group == user.GroupID {
+			result[0] = member
+		} else {
+			result = append(result, member)
+		}
+	}
+	if result[0].Removed {
+		result = result[1:]
+	}
+	return result, nil
+}
+
+// membership возвращает описание участия пользователя в группе или
+// model.ErrNotFound, если пользователь в группу не входит.
+func (s *Store) membership(user *model.User, group string) (*Membership, error) {
+	list, err := s.memberships(user)
+	if err != nil {
+		return nil, err
+	}
+	for _, member := range list {
+		if member.Group == group {
+			return member, nil
+		}
+	}
+	return nil, model.ErrNotFound
+}
+
+// CheckToken проверяет, что пользователь из токена по-прежнему входит в
+// группу токена и работа с ней ему не запрещена, и заменяет роль из токена
+// текущей ролью пользователя в группе: роль могла измениться после выдачи
+// токена. Участие пользователя кешируется (см. memberCache). Используется
+// как TokenTemplate.Check.
+func (s *Store) CheckToken(c *rest.Context, token *Token) error {
+	if token.Type != "user" {
+		return nil
+	}
+	id := membershipID(token.Group, token.Id)
+	member := s.roles.get(id, time.Now())
+	if member == nil {
+		var err error
+		if member, err = s.loadMember(c.Request.Context(), token.Group, token.Id); err != nil {
+			return err
+		}
+		s.roles.set(id, member, time.Now())
+	}
+	if member.Disabled {
+		return ErrUserDisabled
+	}
+	token.Role = member.Role
+	return nil
+}
+
+// loadMember возвращает описание участия пользователя в группе. Группе без
+// описаний участия сначала назначается владелец (см. bootstrapGroup).
+func (s *Store) loadMember(ctx context.Context, group, login string) (*Membership, error) {
+	if err := s.bootstrapGroup(ctx, group); err != nil {
+		return nil, err
+	}
+	user, err := s.model(ctx).Users.Login(login)
+	if isNotFound(err) {
+		return nil, ErrNotMember
+	}
+	if err != nil {
+		return nil, err
+	}
+	member, err := s.membership(user, group)
+	if isNotFound(err) {
+		return nil, ErrNotMember
+	}
+	return member, err
+}
+
+// bootstrapGroup назначает владельца группе, созданной до появления ролей.
+// У такой группы нет ни одного описания участия, поэтому ни один ее
+// пользователь не может управлять ею. Владельцем становится пользователь с
+// наименьшим логином среди тех, для кого группа основная: при одновременных
+// проверках выбирается один и тот же пользователь.
+func (s *Store) bootstrapGroup(ctx context.Context, group string) error {
+	session, coll := s.coll("members")
+	defer session.Close()
+	count, err := coll.Find(bson.M{"group": group}).Limit(1).Count()
+	if err != nil || count > 0 {
+		return err
+	}
+	users, err := s.model(ctx).Users.List(group)
+	if err != nil && err != model.ErrNotFound {
+		return err
+	}
+	if len(users) == 0 {
+		return nil
+	}
+	owner := users[0].Login
+	for _, user := range users[1:] {
+		if user.Login < owner {
+			owner = user.Login
+		}
+	}
+	_, err = coll.UpsertId(membershipID(group, owner), bson.M{"$setOnInsert": bson.M{
+		"group":  group,
+		"login":  owner,
+		"role":   RoleOwner,
+		"joined": time.Now().UTC(),
+	}})
+	if err != nil && !mgo.IsDup(err) {
+		return err
+	}
+	s.roles.reset()
+	llog.Info("Group owner assigned", "group", group, "owner", owner)
+	return nil
+}
+
+// время, в течение которого участие пользователя в группе берется из кеша
+var memberCacheTTL = time.Second * 30
+
+// memberCache хранит описания участия пользователей в группах, чтобы не
+// читать их из MongoDB при каждом запросе. Изменения участия, сделанные этим
+// экземпляром сервиса, сбрасывают кеш сразу, а сделанные другими
+// экземплярами становятся видны не позже чем через memberCacheTTL.
+type memberCache struct {
+	mu    sync.Mutex
+	items map[string]cachedMember
+}
+
+type cachedMember struct {
+	member  *Membership
+	expires time.Time
+}
+
+// get возвращает описание участия с идентификатором id или nil, если его
+// нет в кеше или срок его хранения истек.
+func (m *memberCache) get(id string, now time.Time) *Membership {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	item, ok := m.items[id]
+	if !ok || now.After(item.expires) {
+		return nil
+	}
+	return item.member
+}
+
+// set сохраняет описание участия в кеше. Записи с истекшим сроком хранения
+// при этом удаляются.
+func (m *memberCache) set(id string, member *Membership, now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.items == nil {
+		m.items = make(map[string]cachedMember)
+	}
+	for key, item := range m.items {
+		if now.After(item.expires) {
+			delete(m.items, key)
+		}
+	}
+	m.items[id] = cachedMember{member: member, expires: now.Add(memberCacheTTL)}
+}
+
+// reset очищает кеш после изменения участия пользователей в группах.
+func (m *memberCache) reset() {
+	m.mu.Lock()
+	m.items = nil
+	m.mu.Unlock()
+}
+
+// members возвращает список участников группы, у которых она не является
+// основной, а также описания участия пользователей основной группы с
+// измененной ролью или состоянием.
+func (s *Store) members(group string) ([]*Membership, error) {
+	session, coll := s.coll("members")
+	defer session.Close()
+	var list []*Membership
+	if err := coll.Find(bson.M{"group": group}).All(&list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// addMember добавляет пользователя в группу с указанной ролью или изменяет
+// его роль, если он уже входит в группу. Пользователь, удаленный из основной
+// группы, снова в нее возвращается.
+func (s *Store) addMember(group, login, role string) error {
+	session, coll := s.coll("members")
+	defer session.Close()
+	_, err := coll.UpsertId(membershipID(group, login), bson.M{
+		"$set":         bson.M{"group": group, "login": login, "role": role},
+		"$unset":       bson.M{"removed": ""},
+		"$setOnInsert": bson.M{"joined": time.Now().UTC()},
+	})
+	s.roles.reset()
+	return err
+}
+
+// updateMember изменяет параметры участия пользователя в группе. Для
+// основной группы пользователя описание участия создается при первом
+// изменении.
+func (s *Store) updateMember(member *Membership, set bson.M) error {
+	set["group"], set["login"] = member.Group, member.Login
+	var insert = bson.M{"joined": time.Now().UTC()}
+	if _, ok := set["role"]; !ok {
+		insert["role"] = member.Role
+	}
+	session, coll := s.coll("members")
+	defer session.Close()
+	_, err := coll.UpsertId(member.ID, bson.M{"$set": set, "$setOnInsert": insert})
+	s.roles.reset()
+	return err
+}
+
+// GroupsList возвращает список групп, в которые входит пользователь, с его
+// ролью в каждой из них. Текущая группа токена отмечена как активная.
+func (s *Store) GroupsList(c *rest.Context) error {
+	token := GetToken(c)
+	if token == nil {
+		return ErrBadToken
+	}
+	user, err := s.model(c.Request.Context()).Users.Login(token.Id)
+	if err == model.ErrNotFound {
+		return notFound(c)
+	}
+	if err != nil {
+		return err
+	}
+	list, err := s.memberships(user)
+	if err != nil {
+		return err
+	}
+	for _, member := range list {
+		member.Active = member.Group == token.Group
+	}
+	return sendTotal(c, list)
+}
+
+// GroupSwitch возвращает описание нового токена пользователя для указанной
+// группы, если пользователь в нее входит. Используется вместе с
+// TokenTemplate.Issue.
+func (s *Store) GroupSwitch(c *rest.Context) (*Token, error) {
+	token := GetToken(c)
+	if token == nil {
+		return nil, ErrBadToken
+	}
+	user, err := s.model(c.Request.Context()).Users.Login(token.Id)
+	if err != nil {
+		return nil, err
+	}
+	member, err := s.membership(user, c.Param("group-id"))
+	if err != nil {
+		return nil, err
+	}
+	if member.Disabled {
+		return nil, ErrUserDisabled
+	}
+	s.audit(c, "user.switch", member.Group, nil, nil)
+	return &Token{
+		Type:  "user",
+		Id:    user.Login,
+		Group: member.Group,
+		Name:  user.Name,
+		Role:  member.Role,
+	}, nil
+}
+
+// Единицы измерения расстояний группы.
+var groupUnits = map[string]bool{"metric": true, "imperial": true}
+
+// коллекции с данными групп, которые удаляются вместе с группой
+var groupCollections = []string{
+	"events", "positions", "placegeo", "placeindex", "placemeta", "devicemeta",
+	"webhooks", "deliveries", "trash", "members", "invitations",
+}
+
+var ErrBadGroupData = errors.New("bad group data")
+
+// Group описывает группу пользователей и устройств. Группы, созданные до
+// появления управления группами, не имеют сохраненного описания и
+// используют параметры по умолчанию.
+type Group struct {
+	ID       string                 `bson:"_id" json:"id"`
+	Name     string                 `bson:"name" json:"name"`
+	TimeZone string                 `bson:"timeZone,omitempty" json:"timeZone,omitempty"`
+	Units    string                 `bson:"units" json:"units"`
+	Settings map[string]interface{} `bson:"settings,omitempty" json:"settings,omitempty"`
+	Owner    string                 `bson:"owner,omitempty" json:"owner,omitempty"`
+	Created  time.Time              `bson:"created,omitempty" json:"created,omitempty"`
+	Deleting bool                   `bson:"deleting,omitempty" json:"-"` // группа удаляется
+}
+
+// Validate проверяет описание группы и устанавливает значения по умолчанию.
+func (g *Group) Validate() error {
+	if g.Name == "" {
+		return ErrBadGroupData
+	}
+	if g.Units == "" {
+		g.Units = "metric"
+	}
+	if !groupUnits[g.Units] {
+		return fmt.Errorf("unsupported units %q", g.Units)
+	}
+	if g.TimeZone != "" {
+		if _, err := time.LoadLocation(g.TimeZone); err != nil {
+			return fmt.Errorf("bad time zone %q", g.TimeZone)
+		}
+	}
+	return nil
+}
+
+// group возвращает описание группы. Для группы без сохраненного описания
+// возвращаются параметры по умолчанию.
+func (s *Store) group(id string) (*Group, error) {
+	session, coll := s.coll("groups")
+	defer session.Close()
+	group := new(Group)
+	err := coll.FindId(id).One(group)
+	if err == mgo.ErrNotFound {
+		return &Group{ID: id, Name: id, Units: "metric"}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return group, nil
+}
+
+// GroupAdd создает новую группу, владельцем которой становится пользователь.
+// Для работы с новой группой необходимо получить для нее токен.
+func (s *Store) GroupAdd(c *rest.Context) error {
+	token := GetToken(c)
+	if token == nil {
+		return ErrBadToken
+	}
+	group := new(Group)
+	if err := bind(c, group); err != nil {
+		return err
+	}
+	if err := group.Validate(); err != nil {
+		return badRequest(c, err)
+	}
+	group.ID = bson.NewObjectId().Hex()
+	group.Owner = token.Id
+	group.Created = time.Now().UTC()
+	session, coll := s.coll("groups")
+	defer session.Close()
+	if err := coll.Insert(group); err != nil {
+		return err
+	}
+	if err := s.addMember(group.ID, token.Id, RoleOwner); err != nil {
+		return err
+	}
+	s.audit(c, "group.create", group.ID, nil, group)
+	return c.Status(http.StatusCreated).Send(rest.JSON{"id": group.ID})
+}
+
+// GroupGet возвращает описание текущей группы пользователя.
+func (s *Store) GroupGet(c *rest.Context) error {
+	token := GetToken(c)
+	if token == nil {
+		return ErrBadToken
+	}
+	group, err := s.group(token.Group)
+	if err != nil {
+		return err
+	}
+	return c.Send(group)
+}
+
+// GroupChange изменяет название, часовой пояс, единицы измерения и настройки
+// текущей группы пользователя. Владелец группы таким образом не изменяется.
+func (s *Store) GroupChange(c *rest.Context) error {
+	token := GetToken(c)
+	if token == nil {
+		return ErrBadToken
+	}
+	before, err := s.group(token.Group)
+	if err != nil {
+		return err
+	}
+	group := new(Group)
+	if err := bind(c, group); err != nil {
+		return err
+	}
+	if err := group.Validate(); err != nil {
+		return badRequest(c, err)
+	}
+	group.ID, group.Owner, group.Created = before.ID, before.Owner, before.Created
+	session, coll := s.coll("groups")
+	defer session.Close()
+	if _, err := coll.UpsertId(group.ID, group); err != nil {
+		return err
+	}
+	s.audit(c, "group.change", group.ID, before, group)
+	return c.Send(nil)
+}
+
+// GroupDelete удаляет текущую группу пользователя вместе со всеми ее
+// устройствами, местами, событиями и остальными данными.
+func (s *Store) GroupDelete(c *rest.Context) error {
+	token := GetToken(c)
+	if token == nil {
+		return ErrBadToken
+	}
+	if err := s.deleteGroup(c.Request.Context(), token.Group); err != nil {
+		return err
+	}
+	s.audit(c, "group.delete", token.Group, nil, nil)
+	return c.Send(nil)
+}
+
+// deleteGroup удаляет устройства, места и все остальные данные группы.
+// Пользователи, для которых группа является основной, не удаляются, а
+// переводятся в другую группу (см. movePrimaryGroup). Перед удалением группа
+// отмечается как удаляемая, а каждый шаг можно безопасно повторить, поэтому
+// прерванное удаление продолжается повторным запросом или при следующем
+// запуске сервиса (см. ResumeGroupDeletes). Описание группы удаляется
+// последним.
+func (s *Store) deleteGroup(ctx context.Context, group string) error {
+	session := s.session.Copy()
+	defer session.Close()
+	db := session.DB(s.name)
+	if _, err := db.C("groups").UpsertId(group, bson.M{
+		"$set": bson.M{"deleting": true},
+	}); err != nil {
+		return err
+	}
+	// пользователи переводятся в другие группы до удаления данных, пока
+	// описания их участия в группе еще сохранены
+	users, err := s.model(ctx).Users.List(group)
+	if err != nil && err != model.ErrNotFound {
+		return err
+	}
+	for i := range users {
+		if err := s.movePrimaryGroup(&users[i]); err != nil {
+			return err
+		}
+	}
+	devices, err := s.model(ctx).Devices.List(group)
+	if err != nil && err != model.ErrNotFound {
+		return err
+	}
+	for _, device := range devices {
+		err := s.model(ctx).Devices.Delete(group, device.ID)
+		if err != nil && err != model.ErrNotFound {
+			return err
+		}
+	}
+	places, err := s.model(ctx).Places.List(group)
+	if err != nil && err != model.ErrNotFound {
+		return err
+	}
+	for _, place := range places {
+		err := s.model(ctx).Places.Delete(group, place.ID)
+		if err != nil && err != model.ErrNotFound {
+			return err
+		}
+	}
+	for _, name := range groupCollections {
+		var query = bson.M{"group": group}
+		if name == "members" {
+			// отметки об удалении не дают пользователям без других групп
+			// снова авторизоваться в удаленной группе
+			query["removed"] = bson.M{"$ne": true}
+		}
+		if _, err := db.C(name).RemoveAll(query); err != nil {
+			return err
+		}
+	}
+	if err := db.C("groups").RemoveId(group); err != nil && err != mgo.ErrNotFound {
+		return err
+	}
+	s.roles.reset()
+	return nil
+}
+
+// ResumeGroupDeletes продолжает удаление групп, которое было прервано, например,
+// остановкой сервиса. Ошибки записываются в лог: удаление таких групп
+// продолжится при следующем запуске.
+func (s *Store) ResumeGroupDeletes() {
+	session, coll := s.coll("groups")
+	var groups []struct {
+		ID string `bson:"_id"`
+	}
+	err := coll.Find(bson.M{"deleting": true}).Select(bson.M{"_id": 1}).All(&groups)
+	session.Close()
+	if err != nil {
+		llog.Error("Error find deleting groups", "err", err)
+		return
+	}
+	for _, group := range groups {
+		if err := s.deleteGroup(context.Background(), group.ID); err != nil {
+			llog.Error("Error resume group delete", "group", group.ID, "err", err)
+			continue
+		}
+		llog.Info("Group delete resumed", "group", group.ID)
+	}
+}
+
+// movePrimaryGroup делает основной группой пользователя первую из
+// оставшихся групп, в которые он входит, после удаления его основной группы.
+// Роль пользователя в новой основной группе сохраняется. Если других групп
+// нет, то пользователь отмечается как удаленный из прежней группы и больше
+// не может в ней авторизоваться.
+func (s *Store) movePrimaryGroup(user *model.User) error {
+	list, err := s.memberships(user)
+	if err != nil {
+		return err
+	}
+	var target string
+	for _, member := range list {
+		if member.Group != user.GroupID {
+			target = member.Group
+			break
+		}
+	}
+	if target == "" {
+		return s.updateMember(&Membership{
+			ID:    membershipID(user.GroupID, user.Login),
+			Group: user.GroupID,
+			Login: user.Login,
+			Role:  defaultRole,
+		}, bson.M{"removed": true})
+	}
+	session, coll := s.coll(usersSource.coll)
+	defer session.Close()
+	_, login := usersSource.names(usersSource.key)
+	_, group := usersSource.names(usersSource.group)
+	err = coll.Update(bson.M{login: user.Login}, bson.M{"$set": bson.M{group: target}})
+	s.roles.reset()
+	return err
+}
+
+// MemberDelete удаляет пользователя из текущей группы. Владельца группы
+// удалить нельзя. Пользователь, у которого группа является основной,
+// отмечается как удаленный: после этого он авторизуется в первой из
+// оставшихся групп.
+func (s *Store) MemberDelete(c *rest.Context) error {
+	token := GetToken(c)
+	if token == nil {
+		return ErrBadToken
+	}
+	login := c.Param("login")
+	user, err := s.user(c.Request.Context(), token.Group, login)
+	if err == model.ErrNotFound {
+		return notFound(c)
+	}
+	if err != nil {
+		return err
+	}
+	member, err := s.membership(user, token.Group)
+	if err != nil {
+		return err
+	}
+	if member.Role == RoleOwner {
+		return sendProblem(c, http.StatusConflict, "group owner can't be removed")
+	}
+	if user.GroupID == token.Group {
+		err = s.updateMember(member, bson.M{"removed": true})
+	} else {
+		session, coll := s.coll("members")
+		err = coll.RemoveId(member.ID)
+		session.Close()
+		s.roles.reset()
+	}
+	if err != nil && err != mgo.ErrNotFound {
+		return err
+	}
+	s.audit(c, "member.delete", login, member, nil)
+	return c.Send(nil)
+}
+
+// GroupOwner передает владение текущей группой другому пользователю группы.
+// Бывший владелец становится администратором группы.
+func (s *Store) GroupOwner(c *rest.Context) error {
+	token := GetToken(c)
+	if token == nil {
+		return ErrBadToken
+	}
+	var data struct {
+		Login string `json:"login"`
+	}
+	if err := bind(c, &data); err != nil {
+		return err
+	}
+	if data.Login == token.Id {
+		return sendProblem(c, http.StatusBadRequest, "user is already owner")
+	}
+	if _, err := s.user(c.Request.Context(), token.Group, data.Login); err == model.ErrNotFound {
+		return notFound(c)
+	} else if err != nil {
+		return err
+	}
+	group, err := s.group(token.Group)
+	if err != nil {
+		return err
+	}
+	if err := s.addMember(token.Group, data.Login, RoleOwner); err != nil {
+		return err
+	}
+	if err := s.addMember(token.Group, token.Id, RoleAdmin); err != nil {
+		return err
+	}
+	session, coll := s.coll("groups")
+	defer session.Close()
+	if _, err := coll.UpsertId(group.ID, bson.M{"$set": bson.M{
+		"name": group.Name, "units": group.Units, "owner": data.Login,
+	}}); err != nil {
+		return err
+	}
+	s.audit(c, "group.owner", group.ID,
+		rest.JSON{"owner": group.Owner}, rest.JSON{"owner": data.Login})
+	return c.Send(nil)
+}
+
+// isNotFound возвращает true, если ошибка означает отсутствие документа.
+func isNotFound(err error) bool {
+	return err == model.ErrNotFound || err == mgo.ErrNotFound
+}
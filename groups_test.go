@@ -0,0 +1,301 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/geotrace/geo"
+	"github.com/geotrace/model"
+	"github.com/mdigger/rest"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestGroupSwitch(t *testing.T) {
+	if err := store.addMember("test_group_2", "test2", RoleMember); err != nil {
+		t.Fatal(err)
+	}
+	token, err := getToken("user", "test2", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := request(TestRequest{
+		"Список групп пользователя",
+		"GET",
+		"groups",
+		nil,
+		200,
+	}, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var groups []Membership
+	if err := json.NewDecoder(resp.Body).Decode(&groups); err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != 2 {
+		t.Fatalf("bad groups count: %d", len(groups))
+	}
+	if groups[0].Group != "test_group" || !groups[0].Active ||
+		groups[0].Role != defaultRole {
+		t.Error("bad main group membership")
+	}
+	if groups[1].Group != "test_group_2" || groups[1].Active ||
+		groups[1].Role != RoleMember {
+		t.Error("bad additional group membership")
+	}
+
+	resp, err = request(TestRequest{
+		"Переход в другую группу",
+		"GET",
+		"groups/test_group_2/token",
+		nil,
+		200,
+	}, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	switched, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		TestRequest
+		token []byte
+	}{
+		{TestRequest{"Ошибка перехода в чужую группу", "GET",
+			"groups/bad_group/token", nil, 404}, token},
+		{TestRequest{"Пользователи другой группы", "GET",
+			"users", nil, 200}, switched},
+		{TestRequest{"Ошибка доступа участника к журналу изменений", "GET",
+			"audit", nil, 403}, switched},
+		{TestRequest{"Ошибка удаления места участником", "DELETE",
+			"places/unknown", nil, 403}, switched},
+	} {
+		if _, err := request(test.TestRequest, test.token); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestGroupManagement(t *testing.T) {
+	token, err := getUserToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []TestRequest{
+		{"Описание текущей группы", "GET", "group", nil, 200},
+		{"Ошибка в часовом поясе группы", "PUT", "group",
+			rest.JSON{"name": "Test Group", "timeZone": "Mars/Base"}, 400},
+		{"Ошибка в единицах измерения группы", "PUT", "group",
+			rest.JSON{"name": "Test Group", "units": "parsecs"}, 400},
+	} {
+		if _, err := request(test, token); err != nil {
+			t.Error(err)
+		}
+	}
+
+	resp, err := request(TestRequest{
+		"Создание новой группы",
+		"POST",
+		"groups",
+		rest.JSON{"name": "Test Fleet", "timeZone": "Europe/Moscow", "units": "metric"},
+		201,
+	}, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var created struct {
+		ID string `json:"id"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+	owner, err := groupToken(token, created.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	invite := func() string {
+		resp, err := request(TestRequest{"Приглашение в группу", "POST",
+			"group/invitations", rest.JSON{"role": RoleAdmin}, 201}, owner)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var invitation Invitation
+		if err := json.NewDecoder(resp.Body).Decode(&invitation); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasSuffix(invitation.Link, "/invitations/"+invitation.Code) {
+			t.Errorf("bad invitation link: %s", invitation.Link)
+		}
+		return invitation.Code
+	}
+	member, err := getToken("user", "test3", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, next := invite(), invite()
+	for _, test := range []struct {
+		TestRequest
+		token []byte
+	}{
+		{TestRequest{"Принятие приглашения", "POST",
+			"invitations/" + code, nil, 200}, member},
+		{TestRequest{"Ошибка повторного принятия приглашения", "POST",
+			"invitations/" + code, nil, 404}, member},
+		{TestRequest{"Ошибка принятия приглашения участником группы", "POST",
+			"invitations/" + next, nil, 409}, member},
+		{TestRequest{"Ошибка удаления владельца группы", "DELETE",
+			"group/members/test", nil, 409}, owner},
+		{TestRequest{"Удаление пользователя из группы", "DELETE",
+			"group/members/test3", nil, 204}, owner},
+		{TestRequest{"Ошибка передачи владения не участнику группы", "PUT",
+			"group/owner", rest.JSON{"login": "test3"}, 404}, owner},
+		{TestRequest{"Принятие нового приглашения", "POST",
+			"invitations/" + next, nil, 200}, member},
+		{TestRequest{"Ошибка удаления группы администратором", "DELETE",
+			"group", nil, 403}, token},
+		{TestRequest{"Передача владения группой", "PUT",
+			"group/owner", rest.JSON{"login": "test3"}, 204}, owner},
+		{TestRequest{"Ошибка удаления группы бывшим владельцем", "DELETE",
+			"group", nil, 403}, owner},
+	} {
+		if _, err := request(test.TestRequest, test.token); err != nil {
+			t.Error(err)
+		}
+	}
+
+	newOwner, err := groupToken(member, created.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := request(TestRequest{"Удаление группы", "DELETE", "group",
+		nil, 204}, newOwner); err != nil {
+		t.Error(err)
+	}
+	if _, err := groupToken(member, created.ID); err == nil {
+		t.Error("deleted group must not be available")
+	}
+}
+
+func TestResumeGroupDeletes(t *testing.T) {
+	// удаление группы прервано после отметки и перевода пользователей
+	group := "test_deleting_group"
+	session, coll := store.coll("groups")
+	defer session.Close()
+	if _, err := coll.UpsertId(group, bson.M{
+		"$set": bson.M{"name": group, "deleting": true},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.addMember(group, "test", RoleAdmin); err != nil {
+		t.Fatal(err)
+	}
+	store.ResumeGroupDeletes()
+	if n, err := coll.FindId(group).Count(); err != nil || n != 0 {
+		t.Errorf("group not deleted: %d, %v", n, err)
+	}
+	if _, err := store.membership(&model.User{Login: "test", GroupID: "test_group"},
+		group); err != model.ErrNotFound {
+		t.Errorf("membership not deleted: %v", err)
+	}
+}
+
+// groupToken возвращает токен пользователя для указанной группы.
+func groupToken(token []byte, group string) ([]byte, error) {
+	resp, err := request(TestRequest{"Переход в группу", "GET",
+		"groups/" + group + "/token", nil, 200}, token)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+func TestLegacyGroup(t *testing.T) {
+	// группа, созданная до появления ролей: описаний участия в ней нет
+	group := "test_legacy_group"
+	for _, login := range []string{"test_legacy2", "test_legacy1"} {
+		err := (*model.Users)(store.db).Create(&model.User{
+			Login:    login,
+			GroupID:  group,
+			Name:     "Legacy User",
+			Password: model.NewPassword("test"),
+		})
+		if err != nil && !mgo.IsDup(err) {
+			t.Fatal(err)
+		}
+	}
+	token, err := getToken("user", "test_legacy1", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := request(TestRequest{"Список групп пользователя старой группы",
+		"GET", "groups", nil, 200}, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var groups []Membership
+	if err := json.NewDecoder(resp.Body).Decode(&groups); err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != 1 || groups[0].Role != RoleOwner {
+		t.Fatalf("first user must become the owner: %+v", groups)
+	}
+	resp, err = request(TestRequest{"Создание места в старой группе", "POST", "places",
+		rest.JSON{
+			"name":   "test_legacy_place",
+			"circle": rest.JSON{"center": geo.Point{37.6, 55.7}, "radius": 100},
+		}, 201}, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var created struct {
+		ID string `json:"id"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+	other, err := getToken("user", "test_legacy2", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		TestRequest
+		token []byte
+	}{
+		{TestRequest{"Ошибка удаления места участником старой группы", "DELETE",
+			fmt.Sprintf("places/%s", created.ID), nil, 403}, other},
+		{TestRequest{"Удаление места владельцем старой группы", "DELETE",
+			fmt.Sprintf("places/%s", created.ID), nil, 204}, token},
+		{TestRequest{"Назначение администратора старой группы", "PUT",
+			"users/test_legacy2/role", rest.JSON{"role": RoleAdmin}, 204}, token},
+	} {
+		if _, err := request(test.TestRequest, test.token); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestMemberCache(t *testing.T) {
+	var cache memberCache
+	now := time.Now()
+	member := &Membership{Group: "group", Login: "login", Role: RoleAdmin}
+	if cache.get("group/login", now) != nil {
+		t.Error("empty cache must miss")
+	}
+	cache.set("group/login", member, now)
+	if cache.get("group/login", now) != member {
+		t.Error("cached member not found")
+	}
+	if cache.get("group/login", now.Add(memberCacheTTL+time.Second)) != nil {
+		t.Error("expired member must miss")
+	}
+	cache.reset()
+	if cache.get("group/login", now) != nil {
+		t.Error("reset cache must miss")
+	}
+}
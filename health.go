@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// Ошибки готовности сервиса.
+var (
+	ErrNotReady     = errors.New("not ready")
+	ErrShuttingDown = errors.New("shutting down")
+)
+
+// Health описывает готовность сервиса к обработке запросов. Готовность
+// складывается из результатов именованных проверок: сервис готов, только
+// если все проверки прошли успешно.
+type Health struct {
+	mu     sync.RWMutex
+	checks map[string]func() error
+}
+
+// Check устанавливает функцию проверки с указанным именем. Функция
+// вызывается при каждом запросе готовности сервиса.
+func (h *Health) Check(name string, check func() error) {
+	h.mu.Lock()
+	if h.checks == nil {
+		h.checks = make(map[string]func() error)
+	}
+	h.checks[name] = check
+	h.mu.Unlock()
+}
+
+// Set устанавливает постоянный результат проверки с указанным именем.
+// Значение nil означает успешную проверку.
+func (h *Health) Set(name string, err error) {
+	h.Check(name, func() error { return err })
+}
+
+// Status выполняет все проверки и возвращает их результаты, а также true,
+// если все они прошли успешно. Проверки выполняются без блокировки, чтобы
+// медленная проверка не задерживала изменение других.
+func (h *Health) Status() (map[string]string, bool) {
+	h.mu.RLock()
+	var checks = make(map[string]func() error, len(h.checks))
+	var names = make([]string, 0, len(h.checks))
+	for name, check := range h.checks {
+		checks[name] = check
+		names = append(names, name)
+	}
+	h.mu.RUnlock()
+	sort.Strings(names)
+	var result = make(map[string]string, len(names))
+	var ready = true
+	for _, name := range names {
+		if err := checks[name](); err != nil {
+			result[name] = err.Error()
+			ready = false
+		} else {
+			result[name] = "ok"
+		}
+	}
+	return result, ready
+}
+
+// Live отвечает на запрос о работоспособности процесса. Ответ не зависит от
+// состояния хранилища и других проверок.
+func (h *Health) Live(w http.ResponseWriter, r *http.Request) {
+	sendHealth(w, http.StatusOK, map[string]interface{}{"status": "ok"})
+}
+
+// Ready отвечает на запрос о готовности сервиса к обработке запросов. Если
+// хотя бы одна проверка не прошла, то возвращается статус 503.
+func (h *Health) Ready(w http.ResponseWriter, r *http.Request) {
+	checks, ready := h.Status()
+	status, code := "ready", http.StatusOK
+	if !ready {
+		status, code = "unavailable", http.StatusServiceUnavailable
+	}
+	sendHealth(w, code, map[string]interface{}{"status": status, "checks": checks})
+}
+
+// sendHealth отдает ответ о состоянии сервиса. Ответы не кешируются.
+func sendHealth(w http.ResponseWriter, code int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(data)
+}
+
+// Gate передает запросы обработчику, установленному через Open. Пока
+// обработчик не установлен, на все запросы возвращается ошибка 503. Это
+// позволяет запустить HTTP-сервер до подключения к хранилищу.
+type Gate struct {
+	Health  *Health // если указан, то в нем отмечается проверка api
+	handler atomic.Value
+}
+
+// Open устанавливает обработчик запросов и отмечает готовность API.
+func (g *Gate) Open(h http.Handler) {
+	g.handler.Store(h)
+	if g.Health != nil {
+		g.Health.Set("api", nil)
+	}
+}
+
+// ServeHTTP передает запрос обработчику или возвращает ошибку 503.
+func (g *Gate) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h, ok := g.handler.Load().(http.Handler); ok {
+		h.ServeHTTP(w, r)
+		return
+	}
+	w.Header().Set("Retry-After", "5")
+	serveProblem(w, r, NewProblem(http.StatusServiceUnavailable, "", "service is starting"))
+}
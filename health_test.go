@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHealth(t *testing.T) {
+	health := new(Health)
+	health.Set("storage", ErrNotReady)
+	health.Set("keys", nil)
+	ready := func() (int, map[string]interface{}) {
+		w := httptest.NewRecorder()
+		health.Ready(w, httptest.NewRequest("GET", "/readyz", nil))
+		var data map[string]interface{}
+		if err := json.Unmarshal(w.Body.Bytes(), &data); err != nil {
+			t.Fatal(err)
+		}
+		return w.Code, data
+	}
+	if code, data := ready(); code != http.StatusServiceUnavailable ||
+		data["status"] != "unavailable" {
+		t.Errorf("must be unavailable: %d %v", code, data)
+	}
+
+	var pingErr error
+	health.Check("storage", func() error { return pingErr })
+	if code, data := ready(); code != http.StatusOK || data["status"] != "ready" {
+		t.Errorf("must be ready: %d %v", code, data)
+	}
+	pingErr = errors.New("no reachable servers")
+	code, data := ready()
+	if code != http.StatusServiceUnavailable {
+		t.Errorf("must be unavailable: %d", code)
+	}
+	if checks, _ := data["checks"].(map[string]interface{}); checks["storage"] != pingErr.Error() ||
+		checks["keys"] != "ok" {
+		t.Errorf("bad checks: %v", data["checks"])
+	}
+	pingErr = nil
+	// долгая проверка не блокирует изменение других проверок
+	started, block, done := make(chan struct{}), make(chan struct{}), make(chan struct{})
+	health.Check("slow", func() error { close(started); <-block; return nil })
+	go func() { health.Status(); close(done) }()
+	<-started
+	health.Set("shutdown", ErrShuttingDown)
+	close(block)
+	<-done
+	health.Set("slow", nil)
+	if code, _ := ready(); code != http.StatusServiceUnavailable {
+		t.Errorf("must be unavailable during shutdown: %d", code)
+	}
+
+	w := httptest.NewRecorder()
+	health.Live(w, httptest.NewRequest("GET", "/healthz", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("bad liveness status: %d", w.Code)
+	}
+}
+
+func TestGate(t *testing.T) {
+	health := new(Health)
+	health.Set("api", ErrNotReady)
+	gate := Gate{Health: health}
+	w := httptest.NewRecorder()
+	gate.ServeHTTP(w, httptest.NewRequest("GET", "/api/v0/places", nil))
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Content-Type") != ProblemType {
+		t.Errorf("bad response before open: %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	if _, ready := health.Status(); ready {
+		t.Error("api must not be ready before open")
+	}
+	gate.Open(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	if checks, ready := health.Status(); !ready {
+		t.Errorf("api must be ready after open: %v", checks)
+	}
+	w = httptest.NewRecorder()
+	gate.ServeHTTP(w, httptest.NewRequest("GET", "/api/v0/places", nil))
+	if w.Code != http.StatusNoContent {
+		t.Errorf("bad response after open: %d", w.Code)
+	}
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/geotrace/geo"
+	"github.com/geotrace/model"
+	"github.com/mdigger/rest"
+)
+
+var (
+	// максимальный размер импортируемых данных
+	importMaxSize int64 = 10 << 20
+
+	ErrBadImportFormat = errors.New("unsupported import format")
+)
+
+// ImportRow описывает результат импорта одного места.
+type ImportRow struct {
+	Row   int    `json:"row"`
+	Name  string `json:"name,omitempty"`
+	ID    string `json:"id,omitempty"`
+	Error string `json:"error,omitempty"`
+
+	place *model.Place
+}
+
+// ImportResult описывает результат импорта списка мест.
+type ImportResult struct {
+	DryRun  bool         `json:"dryRun,omitempty"`
+	Total   int          `json:"total"`
+	Created int          `json:"created"`
+	Failed  int          `json:"failed"`
+	Rows    []*ImportRow `json:"rows"`
+}
+
+// PlacesImport импортирует список мест в формате GeoJSON, KML или CSV. Формат
+// определяется по параметру format или по типу содержимого запроса.
+//
+// По умолчанию импорт выполняется атомарно: если хотя бы одно место содержит
+// ошибку, то ни одно место не добавляется. С параметром partial=true
+// добавляются только корректные места. С параметром dry-run=true места только
+// проверяются без сохранения.
+func (s *Store) PlacesImport(c *rest.Context) error {
+	token := GetToken(c)
+	if token == nil {
+		return ErrBadToken
+	}
+	query := c.Request.URL.Query()
+	format := strings.ToLower(query.Get("format"))
+	if format == "" {
+		format = importFormat(c.Request.Header.Get("Content-Type"))
+	}
+	data, err := readBody(c, importMaxSize)
+	if err != nil {
+		return err
+	}
+	var rows []*ImportRow
+	switch format {
+	case "geojson":
+		rows, err = importGeoJSON(data)
+	case "kml":
+		rows, err = importKML(data)
+	case "csv":
+		rows, err = importCSV(data)
+	default:
+		return sendProblem(c, http.StatusUnsupportedMediaType, ErrBadImportFormat.Error())
+	}
+	if err != nil {
+		return badRequest(c, err)
+	}
+	var result = &ImportResult{
+		DryRun: query.Get("dry-run") == "true",
+		Total:  len(rows),
+		Rows:   rows,
+	}
+	for _, row := range rows {
+		if row.Error == "" {
+			// геометрию проверяет и MongoDB при сохранении места, поэтому
+			// ошибки сохранения видны и при проверке без сохранения
+			if err := s.checkPlaceGeometry(c.Request.Context(), row.place); err != nil {
+				row.Error, row.place = err.Error(), nil
+			}
+		}
+		if row.Error != "" {
+			result.Failed++
+		}
+	}
+	partial := query.Get("partial") == "true"
+	if result.DryRun || (result.Failed > 0 && !partial) {
+		status := http.StatusOK
+		if result.Failed > 0 && !result.DryRun {
+			status = http.StatusBadRequest
+		}
+		return c.Status(status).Send(result)
+	}
+	places := s.model(c.Request.Context()).Places
+	for _, row := range rows {
+		if row.Error != "" {
+			continue
+		}
+		if err := places.Create(token.Group, row.place); err != nil {
+			row.Error = err.Error()
+			result.Failed++
+			if !partial {
+				return s.rollbackImport(c, token.Group, result, err)
+			}
+			continue
+		}
+		row.ID = row.place.ID
+		s.indexPlace(c.Request.Context(), token.Group, row.place)
+		result.Created++
+	}
+	for _, row := range rows {
+		if row.ID != "" {
+			s.audit(c, "place.create", row.ID, nil, row.place)
+		}
+	}
+	status := http.StatusCreated
+	if result.Failed > 0 {
+		status = http.StatusOK
+	}
+	return c.Status(status).Send(result)
+}
+
+// rollbackImport удаляет места, уже добавленные при атомарном импорте, после
+// ошибки err. Если место ошибочно, то в ответ отдается результат импорта со
+// статусом 400, как и при ошибках в данных. Места, которые не удалось
+// удалить, остаются в результате со своим идентификатором и ошибкой удаления,
+// записываются в журнал изменений и возвращаются вместе с исходной ошибкой.
+func (s *Store) rollbackImport(c *rest.Context, group string, result *ImportResult, err error) error {
+	places := s.model(c.Request.Context()).Places
+	var failed []string
+	for _, row := range result.Rows {
+		if row.ID == "" {
+			continue
+		}
+		if err := places.Delete(group, row.ID); err != nil && err != model.ErrNotFound {
+			llog.Error("Import rollback error", "group", group, "id", row.ID, "err", err)
+			row.Error = "rollback failed: " + err.Error()
+			failed = append(failed, row.ID)
+			s.audit(c, "place.create", row.ID, nil, row.place)
+			continue
+		}
+		s.unindexPlace(c.Request.Context(), group, row.ID)
+		row.ID = ""
+		result.Created--
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("import error: %v; rollback failed for places %s",
+			err, strings.Join(failed, ", "))
+	}
+	if err == model.ErrBadPlaceData {
+		return c.Status(http.StatusBadRequest).Send(result)
+	}
+	return err
+}
+
+// importFormat возвращает название формата импорта по типу содержимого.
+func importFormat(contentType string) string {
+	if i := strings.IndexByte(contentType, ';'); i >= 0 {
+		contentType = contentType[:i]
+	}
+	switch strings.TrimSpace(strings.ToLower(contentType)) {
+	case "application/geo+json", "application/json":
+		return "geojson"
+	case "application/vnd.google-earth.kml+xml", "application/xml", "text/xml":
+		return "kml"
+	case "text/csv":
+		return "csv"
+	}
+	return ""
+}
+
+// newImportRow возвращает описание импортируемого места и проверяет его
+// корректность.
+func newImportRow(row int, name string, center *geo.Point, radius float64,
+	polygon geo.Polygon) *ImportRow {
+	var result = &ImportRow{Row: row, Name: name}
+	place := &model.Place{Name: name}
+	switch {
+	case name == "":
+		result.Error = "name required"
+	case center != nil:
+		if !validPoint(*center) {
+			result.Error = "bad coordinates"
+		} else if radius <= 0 {
+			result.Error = "bad radius"
+		}
+		place.Circle = &geo.Circle{Center: *center, Radius: radius}
+	case len(polygon) > 0:
+		for _, ring := range polygon {
+			if len(ring) < 4 || ring[0] != ring[len(ring)-1] {
+				result.Error = "bad polygon"
+				break
+			}
+			for _, point := range ring {
+				if !validPoint(point) {
+					result.Error = "bad coordinates"
+					break
+				}
+			}
+		}
+		place.Polygon = &polygon
+	default:
+		result.Error = "geometry required"
+	}
+	if result.Error == "" {
+		// общие для всех мест ограничения на название и размеры
+		if problem, ok := validatePlace(&PlaceInfo{Place: *place}).(*Problem); ok {
+			field := problem.Errors[0]
+			result.Error = field.Field + ": " + field.Message
+		}
+	}
+	if result.Error == "" {
+		result.place = place
+	}
+	return result
+}
+
+// importGeoJSON разбирает GeoJSON FeatureCollection. Точки с радиусом в
+// свойстве radius импортируются как круги, а многоугольники — как есть.
+func importGeoJSON(data []byte) ([]*ImportRow, error) {
+	var fc struct {
+		Type     string `json:"type"`
+		Features []struct {
+			Geometry *struct {
+				Type        string          `json:"type"`
+				Coordinates json.RawMessage `json:"coordinates"`
+			} `json:"geometry"`
+			Properties struct {
+				Name   string  `json:"name"`
+				Radius float64 `json:"radius"`
+			} `json:"properties"`
+		} `json:"features"`
+	}
+	if err := json.Unmarshal(data, &fc); err != nil {
+		return nil, err
+	}
+	if fc.Type != "FeatureCollection" {
+		return nil, errors.New("FeatureCollection required")
+	}
+	var rows = make([]*ImportRow, len(fc.Features))
+	for i, feature := range fc.Features {
+		var (
+			center  *geo.Point
+			polygon geo.Polygon
+			err     error
+		)
+		if feature.Geometry != nil {
+			switch feature.Geometry.Type {
+			case "Point":
+				center = new(geo.Point)
+				err = json.Unmarshal(feature.Geometry.Coordinates, center)
+			case "Polygon":
+				err = json.Unmarshal(feature.Geometry.Coordinates, &polygon)
+			default:
+				err = fmt.Errorf("unsupported geometry %q", feature.Geometry.Type)
+			}
+		}
+		rows[i] = newImportRow(i+1, feature.Properties.Name, center,
+			feature.Properties.Radius, polygon)
+		if err != nil {
+			rows[i].Error, rows[i].place = err.Error(), nil
+		}
+	}
+	return rows, nil
+}
+
+// kmlImportPlacemark описывает место в импортируемом документе KML.
+type kmlImportPlacemark struct {
+	Name    string `xml:"name"`
+	Point   string `xml:"Point>coordinates"`
+	Polygon string `xml:"Polygon>outerBoundaryIs>LinearRing>coordinates"`
+	Data    []struct {
+		Name  string `xml:"name,attr"`
+		Value string `xml:"value"`
+	} `xml:"ExtendedData>Data"`
+}
+
+// importKML разбирает документ KML. Точки с радиусом, указанным в
+// ExtendedData с именем radius, импортируются как круги, а многоугольники —
+// по внешнему контуру.
+func importKML(data []byte) ([]*ImportRow, error) {
+	var doc struct {
+		Placemarks []kmlImportPlacemark `xml:"Placemark"`
+		Document   []kmlImportPlacemark `xml:"Document>Placemark"`
+		Folders    []kmlImportPlacemark `xml:"Document>Folder>Placemark"`
+	}
+	if err := xml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	placemarks := append(append(doc.Placemarks, doc.Document...), doc.Folders...)
+	var rows = make([]*ImportRow, len(placemarks))
+	for i, placemark := range placemarks {
+		var (
+			center  *geo.Point
+			polygon geo.Polygon
+			radius  float64
+			err     error
+		)
+		for _, item := range placemark.Data {
+			if item.Name == "radius" {
+				radius, err = strconv.ParseFloat(strings.TrimSpace(item.Value), 64)
+			}
+		}
+		if err == nil && strings.TrimSpace(placemark.Point) != "" {
+			var points []geo.Point
+			if points, err = parseKMLCoordinates(placemark.Point); err == nil {
+				center = &points[0]
+			}
+		} else if err == nil && strings.TrimSpace(placemark.Polygon) != "" {
+			var ring []geo.Point
+			if ring, err = parseKMLCoordinates(placemark.Polygon); err == nil {
+				polygon = geo.Polygon{ring}
+			}
+		}
+		rows[i] = newImportRow(i+1, strings.TrimSpace(placemark.Name),
+			center, radius, polygon)
+		if err != nil {
+			rows[i].Error, rows[i].place = err.Error(), nil
+		}
+	}
+	return rows, nil
+}
+
+// parseKMLCoordinates разбирает список координат в формате KML.
+func parseKMLCoordinates(s string) ([]geo.Point, error) {
+	var points []geo.Point
+	for _, tuple := range strings.Fields(s) {
+		values := strings.Split(tuple, ",")
+		if len(values) < 2 {
+			return nil, fmt.Errorf("bad coordinates %q", tuple)
+		}
+		lon, err := strconv.ParseFloat(values[0], 64)
+		if err != nil {
+			return nil, err
+		}
+		lat, err := strconv.ParseFloat(values[1], 64)
+		if err != nil {
+			return nil, err
+		}
+		points = append(points, geo.Point{lon, lat})
+	}
+	if len(points) == 0 {
+		return nil, errors.New("coordinates required")
+	}
+	return points, nil
+}
+
+// importCSV разбирает список мест в формате CSV с колонками
+// lat,lon,radius,name. Первая строка пропускается, если является заголовком.
+func importCSV(data []byte) ([]*ImportRow, error) {
+	r := csv.NewReader(bytes.NewReader(data))
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+	records, err := r.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	var rows = make([]*ImportRow, 0, len(records))
+	for i, record := range records {
+		if i == 0 && len(record) > 0 {
+			if _, err := strconv.ParseFloat(record[0], 64); err != nil {
+				continue // строка заголовка
+			}
+		}
+		if len(record) != 4 {
+			rows = append(rows, &ImportRow{Row: i + 1, Error: "4 columns required"})
+			continue
+		}
+		var values [3]float64
+		for j := range values {
+			if values[j], err = strconv.ParseFloat(record[j], 64); err != nil {
+				break
+			}
+		}
+		if err != nil {
+			rows = append(rows, &ImportRow{Row: i + 1, Name: record[3],
+				Error: "bad number"})
+			continue
+		}
+		center := geo.Point{values[1], values[0]}
+		rows = append(rows, newImportRow(i+1, record[3], &center, values[2], nil))
+	}
+	return rows, nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/geotrace/geo"
+	"github.com/mdigger/rest"
+)
+
+func TestImportParsers(t *testing.T) {
+	rows, err := importCSV([]byte("lat,lon,radius,name\n" +
+		"55.7,37.6,100,Office\n" +
+		"95,37.6,100,Bad latitude\n" +
+		"55.7,37.6,0,Bad radius\n" +
+		"55.7,37.6,100\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 4 {
+		t.Fatalf("bad rows count: %d", len(rows))
+	}
+	if rows[0].Error != "" || rows[0].place.Circle.Center != (geo.Point{37.6, 55.7}) {
+		t.Errorf("bad first row: %+v", rows[0])
+	}
+	for _, row := range rows[1:] {
+		if row.Error == "" {
+			t.Errorf("row %d must have error", row.Row)
+		}
+	}
+
+	rows, err = importKML([]byte(`<?xml version="1.0" encoding="UTF-8"?>
+<kml xmlns="http://www.opengis.net/kml/2.2"><Document>
+<Placemark><name>Point</name>
+<ExtendedData><Data name="radius"><value>250</value></Data></ExtendedData>
+<Point><coordinates>37.6,55.7,0</coordinates></Point></Placemark>
+<Folder><Placemark><name>Area</name><Polygon><outerBoundaryIs><LinearRing>
+<coordinates>0,0 1,0 1,1 0,0</coordinates>
+</LinearRing></outerBoundaryIs></Polygon></Placemark></Folder>
+</Document></kml>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 {
+		t.Fatalf("bad KML rows count: %d", len(rows))
+	}
+	for _, row := range rows {
+		if row.Error != "" {
+			t.Errorf("bad KML row: %+v", row)
+		}
+	}
+	if rows[0].place.Circle == nil || rows[0].place.Circle.Radius != 250 {
+		t.Errorf("bad KML circle: %+v", rows[0].place)
+	}
+
+	if _, err := importGeoJSON([]byte(`{"type":"Feature"}`)); err == nil {
+		t.Error("feature collection required")
+	}
+}
+
+func TestPlacesImport(t *testing.T) {
+	token, err := getUserToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	features := []rest.JSON{
+		{
+			"type": "Feature",
+			"geometry": rest.JSON{
+				"type":        "Point",
+				"coordinates": geo.Point{37.6, 55.7},
+			},
+			"properties": rest.JSON{"name": "imported", "radius": 100},
+		},
+		{
+			"type": "Feature",
+			"geometry": rest.JSON{
+				"type":        "Point",
+				"coordinates": geo.Point{37.6, 55.7},
+			},
+			"properties": rest.JSON{"name": "without radius"},
+		},
+		{
+			"type": "Feature",
+			"geometry": rest.JSON{
+				"type": "Polygon",
+				"coordinates": geo.Polygon{{
+					{37.6, 55.7}, {37.7, 55.8}, {37.7, 55.7}, {37.6, 55.8}, {37.6, 55.7},
+				}},
+			},
+			"properties": rest.JSON{"name": "self-intersecting"},
+		},
+	}
+	collection := rest.JSON{"type": "FeatureCollection", "features": features}
+
+	resp, err := request(TestRequest{
+		"Проверка импорта мест без сохранения",
+		"POST",
+		"import/places?dry-run=true",
+		collection,
+		200,
+	}, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var result ImportResult
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	if !result.DryRun || result.Total != 3 || result.Failed != 2 || result.Created != 0 {
+		t.Errorf("bad dry-run result: %+v", result)
+	}
+
+	for _, test := range []TestRequest{
+		{
+			"Ошибка атомарного импорта мест с ошибками",
+			"POST",
+			"import/places",
+			collection,
+			400,
+		},
+		{
+			"Частичный импорт мест",
+			"POST",
+			"import/places?partial=true",
+			collection,
+			200,
+		},
+		{
+			"Импорт мест",
+			"POST",
+			"import/places",
+			rest.JSON{"type": "FeatureCollection", "features": features[:1]},
+			201,
+		},
+	} {
+		if _, err := request(test, token); err != nil {
+			t.Error(err)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/geotrace/model"
+	"github.com/mdigger/rest"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// время действия приглашения в группу
+var invitationExpire = time.Hour * 24 * 7
+
+// внешний адрес API для ссылок приглашений
+var publicURL string
+
+// Invitation описывает приглашение пользователя в группу. Приглашение
+// принимается по коду или ссылке и может быть использовано только один раз.
+type Invitation struct {
+	Code    string    `bson:"_id" json:"code"`
+	Group   string    `bson:"group" json:"group"`
+	Role    string    `bson:"role" json:"role"`
+	By      string    `bson:"by" json:"by"`
+	Created time.Time `bson:"created" json:"created"`
+	Expires time.Time `bson:"expires" json:"expires"`
+	Link    string    `bson:"-" json:"link,omitempty"`
+}
+
+// invitationLink возвращает ссылку для принятия приглашения. Ссылка
+// строится от настроенного внешнего адреса API, а не от заголовка Host
+// запроса, который задает клиент. Если адрес не настроен, то ссылка не
+// возвращается.
+func invitationLink(code string) string {
+	if publicURL == "" {
+		return ""
+	}
+	return strings.TrimSuffix(publicURL, "/") + "/invitations/" + code
+}
+
+// InvitationsList возвращает список действующих приглашений в текущую
+// группу пользователя.
+func (s *Store) InvitationsList(c *rest.Context) error {
+	token := GetToken(c)
+	if token == nil {
+		return ErrBadToken
+	}
+	session, coll := s.coll("invitations")
+	defer session.Close()
+	var list = make([]*Invitation, 0)
+	if err := coll.Find(bson.M{
+		"group":   token.Group,
+		"expires": bson.M{"$gt": time.Now()},
+	}).Sort("-created").All(&list); err != nil {
+		return err
+	}
+	for _, invitation := range list {
+		invitation.Link = invitationLink(invitation.Code)
+	}
+	return sendTotal(c, list)
+}
+
+// InvitationAdd создает приглашение в текущую группу пользователя. Роль
+// приглашенного пользователя указывается в запросе и по умолчанию равна
+// member. Владельцем группы по приглашению стать нельзя.
+func (s *Store) InvitationAdd(c *rest.Context) error {
+	token := GetToken(c)
+	if token == nil {
+		return ErrBadToken
+	}
+	var data struct {
+		Role string `json:"role"`
+	}
+	if c.Request.ContentLength != 0 {
+		if err := bind(c, &data); err != nil {
+			return err
+		}
+	}
+	if data.Role == "" {
+		data.Role = RoleMember
+	}
+	if !validRole(data.Role) || data.Role == RoleOwner {
+		return sendProblem(c, http.StatusBadRequest, "bad role")
+	}
+	key := make([]byte, 12)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+	invitation := &Invitation{
+		Code:    hex.EncodeToString(key),
+		Group:   token.Group,
+		Role:    data.Role,
+		By:      token.Id,
+		Created: time.Now().UTC(),
+	}
+	invitation.Expires = invitation.Created.Add(invitationExpire)
+	session, coll := s.coll("invitations")
+	defer session.Close()
+	if err := coll.Insert(invitation); err != nil {
+		return err
+	}
+	s.audit(c, "invitation.create", invitation.Code, nil,
+		rest.JSON{"role": invitation.Role})
+	invitation.Link = invitationLink(invitation.Code)
+	return c.Status(http.StatusCreated).Send(invitation)
+}
+
+// InvitationDelete отменяет приглашение в текущую группу пользователя.
+func (s *Store) InvitationDelete(c *rest.Context) error {
+	token := GetToken(c)
+	if token == nil {
+		return ErrBadToken
+	}
+	session, coll := s.coll("invitations")
+	defer session.Close()
+	err := coll.Remove(bson.M{"_id": c.Param("code"), "group": token.Group})
+	if err == mgo.ErrNotFound {
+		return notFound(c)
+	}
+	if err != nil {
+		return err
+	}
+	s.audit(c, "invitation.delete", c.Param("code"), nil, nil)
+	return c.Send(nil)
+}
+
+// InvitationAccept принимает приглашение и добавляет пользователя в группу.
+// Для работы с группой необходимо получить для нее новый токен.
+func (s *Store) InvitationAccept(c *rest.Context) error {
+	token := GetToken(c)
+	if token == nil {
+		return ErrBadToken
+	}
+	session, coll := s.coll("invitations")
+	defer session.Close()
+	query := coll.Find(bson.M{
+		"_id":     c.Param("code"),
+		"expires": bson.M{"$gt": time.Now()},
+	})
+	invitation := new(Invitation)
+	err := query.One(invitation)
+	if err == mgo.ErrNotFound {
+		return notFound(c)
+	}
+	if err != nil {
+		return err
+	}
+	user, err := s.model(c.Request.Context()).Users.Login(token.Id)
+	if err != nil {
+		return err
+	}
+	// приглашение используется только после проверки членства, чтобы
+	// повторная попытка участника группы его не израсходовала
+	if _, err := s.membership(user, invitation.Group); err == nil {
+		return sendProblem(c, http.StatusConflict, "user is already a group member")
+	} else if err != model.ErrNotFound {
+		return err
+	}
+	_, err = query.Apply(mgo.Change{Remove: true}, invitation)
+	if err == mgo.ErrNotFound {
+		return notFound(c) // приглашение уже принято или отменено
+	}
+	if err != nil {
+		return err
+	}
+	if err := s.addMember(invitation.Group, user.Login, invitation.Role); err != nil {
+		return err
+	}
+	s.logAudit(c, &Token{Type: token.Type, Id: token.Id, Group: invitation.Group},
+		"invitation.accept", invitation.Code, auditDiff(nil, rest.JSON{"role": invitation.Role}))
+	return c.Send(rest.JSON{"group": invitation.Group, "role": invitation.Role})
+}
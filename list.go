@@ -0,0 +1,650 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/geotrace/model"
+	"github.com/mdigger/rest"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Ограничения на количество элементов списка в ответе. Для устройств
+// количество по умолчанию не ограничивается: прошивки устройств не
+// поддерживают постраничный вывод.
+var (
+	listLimit    = 100  // по умолчанию
+	listMaxLimit = 1000 // максимальное
+)
+
+var (
+	ErrBadLimit  = errors.New("bad limit")
+	ErrBadCursor = errors.New("bad cursor")
+	ErrBadFilter = errors.New("bad filter value")
+)
+
+// ListQuery описывает параметры выборки элементов списка: количество,
+// позицию продолжения, сортировку, фильтры по значениям полей и поиск по
+// названию. Элементы всегда дополнительно упорядочиваются по
+// идентификатору, поэтому позиция продолжения однозначна и не смещается при
+// добавлении или удалении элементов.
+type ListQuery struct {
+	Limit   int               // количество элементов; 0 — без ограничения
+	After   listCursor        // позиция, после которой продолжается выборка
+	Sort    []string          // поля сортировки; "-" в начале — по убыванию
+	Filters map[string]string // значения полей, в т.ч. вложенных через точку
+	Search  string            // строка для поиска в названии
+}
+
+// listCursor содержит значения полей сортировки и идентификатор последнего
+// отданного элемента списка в формате JSON.
+type listCursor []json.RawMessage
+
+// listPage описывает выбранную часть списка.
+type listPage struct {
+	Total int        // количество элементов с учетом фильтров
+	Next  listCursor // позиция продолжения или nil, если элементов больше нет
+}
+
+// parseListQuery разбирает параметры выборки из запроса: limit, cursor,
+// sort (список полей через запятую), filter[поле] и q.
+func parseListQuery(c *rest.Context) (*ListQuery, error) {
+	params := c.Request.URL.Query()
+	var query = &ListQuery{
+		Limit:   listLimit,
+		Filters: make(map[string]string),
+		Search:  strings.ToLower(strings.TrimSpace(params.Get("q"))),
+	}
+	if token := GetToken(c); token != nil && token.Type == "device" {
+		query.Limit = 0
+	}
+	if value := params.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > listMaxLimit {
+			return nil, ErrBadLimit
+		}
+		query.Limit = limit
+	}
+	if value := params.Get("sort"); value != "" {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" && name != "-" {
+				query.Sort = append(query.Sort, name)
+			}
+		}
+	}
+	if value := params.Get("cursor"); value != "" {
+		cursor, err := decodeCursor(value)
+		// позиция содержит значение каждого поля сортировки и идентификатор
+		if err != nil || len(cursor) != len(query.Sort)+1 {
+			return nil, ErrBadCursor
+		}
+		query.After = cursor
+	}
+	for name, values := range params {
+		if strings.HasPrefix(name, "filter[") && strings.HasSuffix(name, "]") {
+			query.Filters[name[7:len(name)-1]] = values[0]
+		}
+	}
+	return query, nil
+}
+
+// encodeCursor возвращает непрозрачное значение позиции продолжения выборки.
+func encodeCursor(cursor listCursor) string {
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeCursor возвращает позицию продолжения выборки.
+func decodeCursor(value string) (listCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, ErrBadCursor
+	}
+	var cursor listCursor
+	if err := json.Unmarshal(data, &cursor); err != nil || len(cursor) == 0 {
+		return nil, ErrBadCursor
+	}
+	return cursor, nil
+}
+
+// fields возвращает поля упорядочивания элементов: поля сортировки и
+// идентификатор key.
+func (q *ListQuery) fields(key string) []string {
+	return append(append(make([]string, 0, len(q.Sort)+1), q.Sort...), key)
+}
+
+// cursor возвращает позицию продолжения выборки после элемента item.
+func (q *ListQuery) cursor(item interface{}, key string) (listCursor, error) {
+	data, err := json.Marshal(item)
+	if err != nil {
+		return nil, err
+	}
+	var doc map[string]interface{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	var cursor listCursor
+	for _, field := range q.fields(key) {
+		value, err := json.Marshal(listValue(doc, strings.TrimPrefix(field, "-")))
+		if err != nil {
+			return nil, err
+		}
+		cursor = append(cursor, value)
+	}
+	return cursor, nil
+}
+
+// listValue возвращает значение поля документа. Вложенные поля указываются
+// через точку.
+func listValue(doc map[string]interface{}, name string) interface{} {
+	var value interface{} = doc
+	for _, key := range strings.Split(name, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = object[key]
+	}
+	return value
+}
+
+// compareValues сравнивает значения полей документов. Отсутствующие значения
+// считаются меньше любых других, строки сравниваются без учета регистра.
+func compareValues(a, b interface{}) int {
+	switch {
+	case a == nil && b == nil:
+		return 0
+	case a == nil:
+		return -1
+	case b == nil:
+		return 1
+	}
+	switch a := a.(type) {
+	case float64:
+		if b, ok := b.(float64); ok {
+			switch {
+			case a < b:
+				return -1
+			case a > b:
+				return 1
+			}
+			return 0
+		}
+	case string:
+		if b, ok := b.(string); ok {
+			return strings.Compare(strings.ToLower(a), strings.ToLower(b))
+		}
+	case bool:
+		if b, ok := b.(bool); ok && a != b {
+			if b {
+				return -1
+			}
+			return 1
+		}
+	}
+	return strings.Compare(fmt.Sprint(a), fmt.Sprint(b))
+}
+
+// listSorter сортирует индексы элементов списка по значениям полей.
+type listSorter struct {
+	index  []int
+	docs   []map[string]interface{}
+	fields []string
+}
+
+func (s *listSorter) Len() int      { return len(s.index) }
+func (s *listSorter) Swap(i, j int) { s.index[i], s.index[j] = s.index[j], s.index[i] }
+func (s *listSorter) Less(i, j int) bool {
+	return s.compare(s.docs[s.index[i]], s.docs[s.index[j]]) < 0
+}
+
+// compare сравнивает документ a с документом или значениями полей
+// упорядочивания b.
+func (s *listSorter) compare(a map[string]interface{}, b interface{}) int {
+	for i, field := range s.fields {
+		desc := strings.HasPrefix(field, "-")
+		field = strings.TrimPrefix(field, "-")
+		var value interface{}
+		switch b := b.(type) {
+		case map[string]interface{}:
+			value = listValue(b, field)
+		case []interface{}:
+			value = b[i]
+		}
+		result := compareValues(listValue(a, field), value)
+		if desc {
+			result = -result
+		}
+		if result != 0 {
+			return result
+		}
+	}
+	return 0
+}
+
+// Apply фильтрует, сортирует и ограничивает в памяти список элементов items,
+// который должен быть срезом. Значения полей берутся из представления
+// элементов в формате JSON, key — название поля с идентификатором элемента.
+// Используется, если параметры выборки относятся к полям, которых нет в
+// документах коллекции (см. Find). Возвращает срез того же типа и описание
+// выбранной части списка.
+func (q *ListQuery) Apply(items interface{}, key string) (interface{}, *listPage, error) {
+	list := reflect.ValueOf(items)
+	var sorter = &listSorter{
+		docs:   make([]map[string]interface{}, list.Len()),
+		fields: q.fields(key),
+	}
+	for i := 0; i < list.Len(); i++ {
+		data, err := json.Marshal(list.Index(i).Interface())
+		if err != nil {
+			return nil, nil, err
+		}
+		var doc map[string]interface{}
+		if err := json.Unmarshal(data, &doc); err != nil {
+			return nil, nil, err
+		}
+		sorter.docs[i] = doc
+		if !q.match(doc) {
+			continue
+		}
+		sorter.index = append(sorter.index, i)
+	}
+	sort.Stable(sorter)
+	var page = &listPage{Total: len(sorter.index)}
+	from := 0
+	if q.After != nil {
+		var after = make([]interface{}, len(q.After))
+		for i, value := range q.After {
+			if err := json.Unmarshal(value, &after[i]); err != nil {
+				return nil, nil, ErrBadCursor
+			}
+		}
+		from = sort.Search(len(sorter.index), func(i int) bool {
+			return sorter.compare(sorter.docs[sorter.index[i]], after) > 0
+		})
+	}
+	to := len(sorter.index)
+	if q.Limit > 0 && from+q.Limit < to {
+		to = from + q.Limit
+		cursor, err := q.cursor(list.Index(sorter.index[to-1]).Interface(), key)
+		if err != nil {
+			return nil, nil, err
+		}
+		page.Next = cursor
+	}
+	result := reflect.MakeSlice(list.Type(), 0, to-from)
+	for _, i := range sorter.index[from:to] {
+		result = reflect.Append(result, list.Index(i))
+	}
+	return result.Interface(), page, nil
+}
+
+// match возвращает true, если документ соответствует фильтрам и строке
+// поиска.
+func (q *ListQuery) match(doc map[string]interface{}) bool {
+	if q.Search != "" {
+		name, _ := doc["name"].(string)
+		if !strings.Contains(strings.ToLower(name), q.Search) {
+			return false
+		}
+	}
+	for field, value := range q.Filters {
+		current := listValue(doc, field)
+		if current == nil || fmt.Sprint(current) != value {
+			return false
+		}
+	}
+	return true
+}
+
+// sendList применяет к списку в памяти параметры выборки query (см. Apply)
+// и отдает результат (см. sendPage).
+func sendList(c *rest.Context, query *ListQuery, items interface{}, key string) error {
+	result, page, err := query.Apply(items, key)
+	if err != nil {
+		return sendError(c, err)
+	}
+	return sendPage(c, result, page)
+}
+
+// sendPage отдает выбранную часть списка только с полями из параметра
+// fields. Пустой список отдается как пустой массив, а общее количество
+// элементов с учетом фильтров — в заголовке X-Total-Count. Если в списке
+// остались еще элементы, то в заголовках Link и X-Next-Cursor возвращается
+// ссылка и позиция для их получения.
+func sendPage(c *rest.Context, items interface{}, page *listPage) error {
+	result, err := selectFields(c, items)
+	if err != nil {
+		return err
+	}
+	c.Header().Set("X-Total-Count", strconv.Itoa(page.Total))
+	if page.Next != nil {
+		cursor := encodeCursor(page.Next)
+		link := *c.Request.URL
+		params := link.Query()
+		params.Set("cursor", cursor)
+		link.RawQuery = params.Encode()
+		c.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"next\"", link.RequestURI()))
+		c.Header().Set("X-Next-Cursor", cursor)
+	}
+	return sendTagged(c, result)
+}
+
+// sendTotal отдает список целиком вместе с количеством элементов в заголовке
+// X-Total-Count.
+func sendTotal(c *rest.Context, items interface{}) error {
+	c.Header().Set("X-Total-Count", strconv.Itoa(reflect.ValueOf(items).Len()))
+	return c.Send(items)
+}
+
+// listSource описывает коллекцию, в которой хранятся элементы списка.
+// Поля задаются названиями полей структуры элемента.
+type listSource struct {
+	coll   string       // название коллекции
+	item   reflect.Type // тип элемента
+	group  string       // поле с идентификатором группы
+	key    string       // поле с идентификатором элемента
+	hidden []string     // поля, которые не загружаются из коллекции
+}
+
+// Коллекции, в которых библиотека model хранит пользователей, устройства и
+// места. Хеши паролей из коллекций не загружаются.
+var (
+	usersSource = &listSource{"users", reflect.TypeOf(model.User{}), "GroupID", "Login",
+		[]string{"Password"}}
+	devicesSource = &listSource{"devices", reflect.TypeOf(model.Device{}), "GroupID", "ID",
+		[]string{"Password"}}
+	placesSource = &listSource{"places", reflect.TypeOf(model.Place{}), "GroupID", "ID", nil}
+)
+
+// names возвращает названия поля структуры элемента в формате JSON и в
+// документе MongoDB.
+func (s *listSource) names(name string) (string, string) {
+	field, _ := s.item.FieldByName(name)
+	return tagName(field.Tag.Get("json"), field.Name), tagName(field.Tag.Get("bson"),
+		strings.ToLower(field.Name))
+}
+
+// Key возвращает название поля с идентификатором элемента в формате JSON.
+func (s *listSource) Key() string {
+	key, _ := s.names(s.key)
+	return key
+}
+
+// Projection возвращает поля, исключаемые при выборке элементов из коллекции:
+// поля из hidden и поля, которые не отдаются в формате JSON.
+func (s *listSource) Projection() bson.M {
+	var fields = make(bson.M)
+	for _, name := range s.hidden {
+		_, field := s.names(name)
+		fields[field] = 0
+	}
+	for i := 0; i < s.item.NumField(); i++ {
+		field := s.item.Field(i)
+		if field.PkgPath != "" || field.Tag.Get("json") != "-" {
+			continue
+		}
+		if _, name := s.names(field.Name); name != "-" {
+			fields[name] = 0
+		}
+	}
+	return fields
+}
+
+// Group возвращает условие выборки элементов группы.
+func (s *listSource) Group(group string) bson.M {
+	_, name := s.names(s.group)
+	return bson.M{name: group}
+}
+
+// tagName возвращает название поля из тега структуры или name, если оно в
+// теге не задано.
+func tagName(tag, name string) string {
+	if i := strings.IndexByte(tag, ','); i >= 0 {
+		tag = tag[:i]
+	}
+	if tag == "" {
+		return name
+	}
+	return tag
+}
+
+// listField описывает поле документа коллекции.
+type listField struct {
+	name string       // путь к полю в документе MongoDB
+	typ  reflect.Type // тип значения поля
+}
+
+// lookupField возвращает описание поля документа по пути из названий полей
+// в формате JSON через точку. Названия в документе MongoDB определяются так
+// же, как это делает mgo: по тегу bson или по названию поля в нижнем
+// регистре.
+func lookupField(t reflect.Type, path string) (*listField, bool) {
+	var names []string
+	for _, name := range strings.Split(path, ".") {
+		for t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+		if t.Kind() != reflect.Struct {
+			return nil, false
+		}
+		var prefix []string
+		var ok bool
+		if prefix, t, ok = structField(t, name); !ok {
+			return nil, false
+		}
+		names = append(names, prefix...)
+	}
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return &listField{name: strings.Join(names, "."), typ: t}, true
+}
+
+// structField ищет в структуре t, в том числе во встроенных структурах,
+// поле с указанным названием в формате JSON. Возвращает путь к нему в
+// документе MongoDB и его тип.
+func structField(t reflect.Type, name string) ([]string, reflect.Type, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" && !field.Anonymous {
+			continue // неэкспортируемое поле
+		}
+		jsonTag, bsonTag := field.Tag.Get("json"), field.Tag.Get("bson")
+		if jsonTag == "-" || bsonTag == "-" {
+			continue
+		}
+		bsonName := tagName(bsonTag, strings.ToLower(field.Name))
+		if field.Anonymous && tagName(jsonTag, "") == "" {
+			embedded := field.Type
+			for embedded.Kind() == reflect.Ptr {
+				embedded = embedded.Elem()
+			}
+			if embedded.Kind() != reflect.Struct {
+				continue
+			}
+			names, typ, ok := structField(embedded, name)
+			if !ok {
+				continue
+			}
+			if !strings.Contains(bsonTag, "inline") {
+				names = append([]string{bsonName}, names...)
+			}
+			return names, typ, true
+		}
+		if tagName(jsonTag, field.Name) == name {
+			return []string{bsonName}, field.Type, true
+		}
+	}
+	return nil, nil, false
+}
+
+// типы значений, по которым возможны выборка и сортировка в MongoDB
+var listTimeType = reflect.TypeOf(time.Time{})
+
+// comparable возвращает true, если значения поля сравниваются в MongoDB так
+// же, как в формате JSON.
+func (f *listField) comparable() bool {
+	switch f.typ.Kind() {
+	case reflect.String, reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16,
+		reflect.Int32, reflect.Int64, reflect.Uint, reflect.Uint8, reflect.Uint16,
+		reflect.Uint32, reflect.Uint64, reflect.Float32, reflect.Float64:
+		return true
+	}
+	return f.typ == listTimeType
+}
+
+// value возвращает значение поля, заданное в формате JSON.
+func (f *listField) value(data []byte) (interface{}, error) {
+	if string(data) == "null" {
+		return nil, nil
+	}
+	value := reflect.New(f.typ)
+	if err := json.Unmarshal(data, value.Interface()); err != nil {
+		return nil, err
+	}
+	return value.Elem().Interface(), nil
+}
+
+// parse возвращает значение поля, заданное в параметре фильтра.
+func (f *listField) parse(value string) (interface{}, error) {
+	if f.typ.Kind() != reflect.String {
+		if f.typ == listTimeType {
+			value = strconv.Quote(value)
+		}
+		result, err := f.value([]byte(value))
+		if err != nil {
+			return nil, ErrBadFilter
+		}
+		return result, nil
+	}
+	return reflect.ValueOf(value).Convert(f.typ).Interface(), nil
+}
+
+// Supports возвращает true, если все поля фильтров, поиска и сортировки есть
+// в документах коллекции source и выборку можно выполнить в MongoDB.
+func (q *ListQuery) Supports(source *listSource) bool {
+	var names = make([]string, 0, len(q.Sort)+len(q.Filters)+1)
+	for _, name := range q.Sort {
+		names = append(names, strings.TrimPrefix(name, "-"))
+	}
+	for name := range q.Filters {
+		names = append(names, name)
+	}
+	if q.Search != "" {
+		names = append(names, "name")
+	}
+	for _, name := range names {
+		if field, ok := lookupField(source.item, name); !ok || !field.comparable() {
+			return false
+		}
+	}
+	return true
+}
+
+// Find выбирает из коллекции source элементы, соответствующие условию
+// filter и параметрам выборки, в items — указатель на срез элементов.
+// Фильтры, поиск, сортировка, позиция продолжения и количество передаются в
+// запрос к MongoDB, поэтому в память загружается только отдаваемая часть
+// списка без скрытых полей (см. Projection). В отличие от выборки в памяти, строки сортируются с учетом
+// регистра. Параметры выборки должны поддерживаться коллекцией (см.
+// Supports).
+func (q *ListQuery) Find(s *Store, source *listSource, filter bson.M, items interface{}) (*listPage, error) {
+	var conditions = []bson.M{filter}
+	if q.Search != "" {
+		field, _ := lookupField(source.item, "name")
+		conditions = append(conditions, bson.M{field.name: bson.RegEx{
+			Pattern: regexp.QuoteMeta(q.Search), Options: "i"}})
+	}
+	for name, value := range q.Filters {
+		field, _ := lookupField(source.item, name)
+		parsed, err := field.parse(value)
+		if err != nil {
+			return nil, err
+		}
+		conditions = append(conditions, bson.M{field.name: parsed})
+	}
+	names := q.fields(source.Key())
+	var fields = make([]*listField, len(names))
+	var order = make([]string, len(names))
+	for i, name := range names {
+		desc := strings.HasPrefix(name, "-")
+		fields[i], _ = lookupField(source.item, strings.TrimPrefix(name, "-"))
+		if order[i] = fields[i].name; desc {
+			order[i] = "-" + order[i]
+		}
+	}
+	session, coll := s.coll(source.coll)
+	defer session.Close()
+	total, err := coll.Find(bson.M{"$and": conditions}).Count()
+	if err != nil {
+		return nil, err
+	}
+	if q.After != nil {
+		after, err := afterCondition(fields, order, q.After)
+		if err != nil {
+			return nil, err
+		}
+		conditions = append(conditions, after)
+	}
+	query := coll.Find(bson.M{"$and": conditions}).Select(source.Projection()).Sort(order...)
+	if q.Limit > 0 {
+		query = query.Limit(q.Limit + 1) // лишний элемент — признак продолжения
+	}
+	if err := query.All(items); err != nil {
+		return nil, err
+	}
+	var page = &listPage{Total: total}
+	list := reflect.ValueOf(items).Elem()
+	if q.Limit > 0 && list.Len() > q.Limit {
+		list.Set(list.Slice(0, q.Limit))
+		if page.Next, err = q.cursor(list.Index(q.Limit-1).Interface(), source.Key()); err != nil {
+			return nil, err
+		}
+	}
+	return page, nil
+}
+
+// afterCondition возвращает условие выборки элементов, которые при
+// упорядочивании order идут после позиции cursor. Отсутствующие значения
+// полей MongoDB считает меньше любых других.
+func afterCondition(fields []*listField, order []string, cursor listCursor) (bson.M, error) {
+	var values = make([]interface{}, len(fields))
+	for i, field := range fields {
+		value, err := field.value(cursor[i])
+		if err != nil {
+			return nil, ErrBadCursor
+		}
+		values[i] = value
+	}
+	var or []bson.M
+	for i, field := range fields {
+		var condition = bson.M{}
+		for j := 0; j < i; j++ {
+			condition[fields[j].name] = values[j]
+		}
+		if strings.HasPrefix(order[i], "-") {
+			if values[i] == nil {
+				continue // меньше отсутствующего значения ничего нет
+			}
+			condition["$or"] = []bson.M{
+				{field.name: bson.M{"$lt": values[i]}},
+				{field.name: nil},
+			}
+		} else if values[i] == nil {
+			condition[field.name] = bson.M{"$ne": nil}
+		} else {
+			condition[field.name] = bson.M{"$gt": values[i]}
+		}
+		or = append(or, condition)
+	}
+	return bson.M{"$or": or}, nil
+}
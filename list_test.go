@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/geotrace/geo"
+	"github.com/mdigger/rest"
+)
+
+func TestListQuery(t *testing.T) {
+	type item struct {
+		ID       string `json:"id"`
+		Name     string `json:"name"`
+		Position *struct {
+			Online bool `json:"online"`
+		} `json:"position,omitempty"`
+	}
+	items := []item{{ID: "1", Name: "Bravo"}, {ID: "2", Name: "alpha"},
+		{ID: "3", Name: "Charlie"}, {ID: "4", Name: "delta"}}
+	items[2].Position = &struct {
+		Online bool `json:"online"`
+	}{true}
+	names := func(result interface{}) []string {
+		var names []string
+		for _, item := range result.([]item) {
+			names = append(names, item.Name)
+		}
+		return names
+	}
+	first := ListQuery{Limit: 2, Sort: []string{"name"}}
+	result, page, err := first.Apply(items, "id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(names(result)) != "[alpha Bravo]" || page.Total != 4 || page.Next == nil {
+		t.Fatalf("bad first page: %v %+v", names(result), page)
+	}
+	cursor, err := decodeCursor(encodeCursor(page.Next))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// новый элемент перед позицией продолжения не смещает следующую страницу
+	items = append(items, item{ID: "5", Name: "aardvark"})
+	for _, test := range []struct {
+		query ListQuery
+		names string
+		total int
+		next  bool
+	}{
+		{ListQuery{Limit: 10}, "[Bravo alpha Charlie delta aardvark]", 5, false},
+		{ListQuery{Limit: 2, Sort: []string{"name"}, After: cursor},
+			"[Charlie delta]", 5, false},
+		{ListQuery{Limit: 10, Sort: []string{"-name"}, Search: "a"},
+			"[delta Charlie Bravo alpha aardvark]", 5, false},
+		{ListQuery{Limit: 10, Search: "lph"}, "[alpha]", 1, false},
+		{ListQuery{Limit: 10, Filters: map[string]string{"position.online": "true"}},
+			"[Charlie]", 1, false},
+		{ListQuery{Limit: 4}, "[Bravo alpha Charlie delta]", 5, true},
+		{ListQuery{}, "[Bravo alpha Charlie delta aardvark]", 5, false},
+	} {
+		result, page, err := test.query.Apply(items, "id")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fmt.Sprint(names(result)); got != test.names ||
+			page.Total != test.total || (page.Next != nil) != test.next {
+			t.Errorf("%+v: got %s %+v", test.query, got, page)
+		}
+	}
+	if _, err := decodeCursor("bad"); err == nil {
+		t.Error("bad cursor must fail")
+	}
+}
+
+func TestListSource(t *testing.T) {
+	type meta struct {
+		Online bool      `bson:"online" json:"online"`
+		Time   time.Time `json:"time"`
+	}
+	type item struct {
+		ID       string            `bson:"_id" json:"id"`
+		GroupID  string            `json:"groupId"`
+		Position *meta             `bson:"pos" json:"position"`
+		Tags     map[string]string `json:"tags"`
+		Secret   string            `json:"-"`
+	}
+	type info struct {
+		item  `bson:",inline"`
+		Extra string `json:"extra"`
+	}
+	source := &listSource{"items", reflect.TypeOf(info{}), "GroupID", "ID", []string{"Extra"}}
+	if source.Key() != "id" || source.Group("g")["groupid"] != "g" {
+		t.Errorf("bad source names: %s %v", source.Key(), source.Group("g"))
+	}
+	if fields := source.Projection(); len(fields) != 1 || fields["extra"] != 0 {
+		t.Errorf("bad projection: %v", fields)
+	}
+	for _, source := range []*listSource{usersSource, devicesSource} {
+		if fields := source.Projection(); fields["password"] != 0 {
+			t.Errorf("%s: password must be excluded: %v", source.coll, fields)
+		}
+	}
+	for path, name := range map[string]string{
+		"id":              "_id",
+		"groupId":         "groupid",
+		"position.online": "pos.online",
+		"position.time":   "pos.time",
+		"extra":           "extra",
+	} {
+		if field, ok := lookupField(source.item, path); !ok || field.name != name ||
+			!field.comparable() {
+			t.Errorf("%s: bad field %+v", path, field)
+		}
+	}
+	for _, path := range []string{"Secret", "tags", "position.unknown"} {
+		if field, ok := lookupField(source.item, path); ok && field.comparable() {
+			t.Errorf("%s: must not be supported", path)
+		}
+	}
+	if !(&ListQuery{Sort: []string{"-position.time"}}).Supports(source) ||
+		(&ListQuery{Filters: map[string]string{"tags": "x"}}).Supports(source) {
+		t.Error("bad query support")
+	}
+	field, _ := lookupField(source.item, "position.online")
+	if value, err := field.parse("true"); err != nil || value != true {
+		t.Errorf("bad filter value: %v %v", value, err)
+	}
+	if _, err := field.parse("yes"); err != ErrBadFilter {
+		t.Errorf("bad filter must fail: %v", err)
+	}
+}
+
+func TestDeviceListLimit(t *testing.T) {
+	for _, test := range []struct {
+		kind, url string
+		limit     int
+	}{
+		{"user", "/api/v0/places", listLimit},
+		{"device", "/api/v0/device/places", 0},
+		{"device", "/api/v0/device/places?limit=5", 5},
+	} {
+		c := &rest.Context{Request: httptest.NewRequest("GET", test.url, nil)}
+		c.SetData(ctxType(99), &Token{Type: test.kind})
+		query, err := parseListQuery(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if query.Limit != test.limit {
+			t.Errorf("%s %s: bad limit %d", test.kind, test.url, query.Limit)
+		}
+	}
+}
+
+func TestPlacesListQuery(t *testing.T) {
+	token, err := getUserToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"test_list_a", "test_list_b", "test_list_c"} {
+		if _, err := request(TestRequest{"Создание места для списка", "POST", "places",
+			rest.JSON{
+				"name":   name,
+				"circle": rest.JSON{"center": geo.Point{88, 55}, "radius": 100},
+			}, 201}, token); err != nil {
+			t.Fatal(err)
+		}
+	}
+	resp, err := request(TestRequest{"Первая страница списка мест", "GET",
+		"places?q=test_list_&sort=-name&limit=2", nil, 200}, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var places []PlaceInfo
+	if err := json.NewDecoder(resp.Body).Decode(&places); err != nil {
+		t.Fatal(err)
+	}
+	if len(places) != 2 || places[0].Name != "test_list_c" || places[1].Name != "test_list_b" {
+		t.Fatalf("bad first page: %v", places)
+	}
+	cursor := resp.Header.Get("X-Next-Cursor")
+	if cursor == "" || resp.Header.Get("Link") == "" {
+		t.Fatal("next page link required")
+	}
+	resp, err = request(TestRequest{"Вторая страница списка мест", "GET",
+		"places?q=test_list_&sort=-name&limit=2&cursor=" + cursor, nil, 200}, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	places = nil
+	if err := json.NewDecoder(resp.Body).Decode(&places); err != nil {
+		t.Fatal(err)
+	}
+	if len(places) != 1 || places[0].Name != "test_list_a" ||
+		resp.Header.Get("X-Next-Cursor") != "" {
+		t.Errorf("bad last page: %v", places)
+	}
+	for _, test := range []TestRequest{
+		{"Фильтр по названию места", "GET", "places?filter[name]=test_list_b", nil, 200},
+		{"Ошибка в позиции списка", "GET", "places?cursor=bad", nil, 400},
+		{"Ошибка в количестве элементов", "GET", "places?limit=0", nil, 400},
+		{"Сортировка устройств", "GET", "devices?sort=-name&limit=1", nil, 200},
+		{"Поиск пользователей", "GET", "users?q=user", nil, 200},
+	} {
+		if _, err := request(test, token); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestEmptyLists(t *testing.T) {
+	user, err := getUserToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.addMember("test_group_empty", "test", RoleAdmin); err != nil {
+		t.Fatal(err)
+	}
+	token, err := groupToken(user, "test_group_empty")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		TestRequest
+		total string
+	}{
+		{TestRequest{"Пустой список мест", "GET", "places", nil, 200}, "0"},
+		{TestRequest{"Пустой список устройств", "GET", "devices?include=position", nil, 200}, "0"},
+		{TestRequest{"Пустой список подписок", "GET", "webhooks", nil, 200}, "0"},
+		{TestRequest{"Пустая корзина", "GET", "trash", nil, 200}, "0"},
+		{TestRequest{"Список из одного пользователя", "GET", "users", nil, 200}, "1"},
+	} {
+		resp, err := request(test.TestRequest, token)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		var list []interface{}
+		if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+			t.Error(err)
+			continue
+		}
+		if list == nil {
+			t.Errorf("%s: array required", test.Name)
+		}
+		if total := resp.Header.Get("X-Total-Count"); total != test.total {
+			t.Errorf("%s: bad total count %q", test.Name, total)
+		}
+	}
+	if _, err := request(TestRequest{"Ошибка получения несуществующего места",
+		"GET", "places/bad_place", nil, 404}, token); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// максимальная длина идентификатора запроса, переданного клиентом
+var requestIDMax = 64
+
+// LogHandler возвращает обработчик логов с заданным минимальным уровнем
+// (debug, info, warn, error, crit), форматом вывода (json, logfmt или
+// terminal) и назначением: stdout, stderr или путь к файлу.
+func LogHandler(level, format, output string) (log15.Handler, error) {
+	lvl, err := log15.LvlFromString(strings.ToLower(level))
+	if err != nil {
+		return nil, fmt.Errorf("bad log level %q", level)
+	}
+	var logFormat log15.Format
+	switch strings.ToLower(format) {
+	case "json":
+		logFormat = log15.JsonFormat()
+	case "logfmt":
+		logFormat = log15.LogfmtFormat()
+	case "terminal", "":
+		logFormat = log15.TerminalFormat()
+	default:
+		return nil, fmt.Errorf("bad log format %q", format)
+	}
+	var handler log15.Handler
+	switch output {
+	case "stderr", "":
+		handler = log15.StreamHandler(os.Stderr, logFormat)
+	case "stdout":
+		handler = log15.StreamHandler(os.Stdout, logFormat)
+	default:
+		if handler, err = log15.FileHandler(output, logFormat); err != nil {
+			return nil, err
+		}
+	}
+	return log15.LvlFilterHandler(lvl, handler), nil
+}
+
+type ctxKey byte // тип ключей для сохранения данных в контексте запроса
+
+const ctxRequestInfo ctxKey = 1
+
+// RequestInfo описывает данные запроса, которые заполняются обработчиками и
+// выводятся в лог после его выполнения.
+type RequestInfo struct {
+	ID    string // идентификатор запроса
+	Route string // шаблон пути обработчика
+	Token *Token // токен авторизации, если он был проверен
+}
+
+// requestInfo возвращает данные запроса для лога или nil, если запрос
+// обрабатывается не через AccessLog.
+func requestInfo(r *http.Request) *RequestInfo {
+	info, _ := r.Context().Value(ctxRequestInfo).(*RequestInfo)
+	return info
+}
+
+// requestID возвращает идентификатор запроса из заголовка X-Request-ID или
+// новый случайный идентификатор, если заголовок не указан или некорректен.
+func requestID(r *http.Request) string {
+	if id := r.Header.Get("X-Request-ID"); id != "" && len(id) <= requestIDMax &&
+		strings.IndexFunc(id, func(r rune) bool { return r <= ' ' || r > '~' }) < 0 {
+		return id
+	}
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// responseLog сохраняет статус и размер ответа.
+type responseLog struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (w *responseLog) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *responseLog) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(data)
+	w.bytes += n
+	return n, err
+}
+
+// AccessLog выводит в лог информацию о каждом запросе к обработчику Handler:
+// метод, путь, статус и размер ответа, время выполнения, идентификатор
+// запроса и данные токена авторизации. Идентификатор запроса возвращается в
+// заголовке X-Request-ID. Количество и время выполнения запросов сохраняются
+// в метриках.
+//
+// Запросы, путь которых заканчивается на один из Sampled, выводятся
+// выборочно: только каждый Sample-й успешный запрос. Ошибки выводятся
+// всегда.
+type AccessLog struct {
+	Handler http.Handler
+	Log     log15.Logger
+	Sampled []string // пути с большим количеством запросов
+	Sample  uint64   // выводить каждый n-й успешный запрос
+	counter uint64
+}
+
+// ServeHTTP обрабатывает запрос и выводит информацию о нем в лог.
+func (a *AccessLog) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	info := &RequestInfo{ID: requestID(r)}
+	w.Header().Set("X-Request-ID", info.ID)
+	r = r.WithContext(context.WithValue(r.Context(), ctxRequestInfo, info))
+	response := &responseLog{ResponseWriter: w}
+	a.Handler.ServeHTTP(response, r)
+	if response.status == 0 {
+		response.status = http.StatusOK
+	}
+	latency := time.Since(start)
+	observeRequest(info.Route, r.Method, response.status, latency)
+	if response.status < http.StatusBadRequest && !a.sample(r.URL.Path) {
+		return
+	}
+	var ctx = []interface{}{
+		"request", info.ID,
+		"method", r.Method,
+		"path", r.URL.Path,
+		"status", response.status,
+		"latency", latency,
+		"bytes", response.bytes,
+		"ip", remoteIP(r),
+	}
+	if token := info.Token; token != nil {
+		ctx = append(ctx, "type", token.Type, "id", token.Id, "group", token.Group)
+	}
+	if span := trace.SpanContextFromContext(r.Context()); span.IsValid() {
+		ctx = append(ctx, "trace", span.TraceID().String())
+	}
+	switch {
+	case response.status >= http.StatusInternalServerError:
+		a.Log.Error("Request", ctx...)
+	case response.status >= http.StatusBadRequest:
+		a.Log.Warn("Request", ctx...)
+	default:
+		a.Log.Info("Request", ctx...)
+	}
+}
+
+// sample возвращает true, если успешный запрос с указанным путем нужно
+// вывести в лог.
+func (a *AccessLog) sample(path string) bool {
+	if a.Sample <= 1 {
+		return true
+	}
+	for _, suffix := range a.Sampled {
+		if strings.HasSuffix(path, suffix) {
+			return atomic.AddUint64(&a.counter, 1)%a.Sample == 1
+		}
+	}
+	return true
+}
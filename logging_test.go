@@ -0,0 +1,111 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+func TestLogHandler(t *testing.T) {
+	for _, test := range []struct {
+		level, format, output string
+		ok                    bool
+	}{
+		{"info", "terminal", "stderr", true},
+		{"DEBUG", "json", "stdout", true},
+		{"warn", "logfmt", filepath.Join(os.TempDir(), "geotrace-test.log"), true},
+		{"verbose", "json", "stdout", false},
+		{"info", "xml", "stdout", false},
+		{"info", "json", filepath.Join(os.TempDir(), "no-such-dir", "test.log"), false},
+	} {
+		_, err := LogHandler(test.level, test.format, test.output)
+		if (err == nil) != test.ok {
+			t.Errorf("%s %s %s: %v", test.level, test.format, test.output, err)
+		}
+	}
+	os.Remove(filepath.Join(os.TempDir(), "geotrace-test.log"))
+}
+
+func TestAccessLog(t *testing.T) {
+	var records []*log15.Record
+	logger := log15.New()
+	logger.SetHandler(log15.FuncHandler(func(r *log15.Record) error {
+		records = append(records, r)
+		return nil
+	}))
+	handler := &AccessLog{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if info := requestInfo(r); info != nil {
+				info.Token = &Token{Type: "device", Id: "test", Group: "group"}
+			}
+			if r.URL.Query().Get("fail") != "" {
+				w.WriteHeader(http.StatusBadRequest)
+			}
+			w.Write([]byte("ok"))
+		}),
+		Log:     logger,
+		Sampled: []string{"device/events"},
+		Sample:  3,
+	}
+
+	req := httptest.NewRequest("GET", "/api/v0/places", nil)
+	req.Header.Set("X-Request-ID", "test-request")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if id := w.Header().Get("X-Request-ID"); id != "test-request" {
+		t.Errorf("bad request id: %q", id)
+	}
+	if len(records) != 1 {
+		t.Fatalf("bad records count: %d", len(records))
+	}
+	var fields = make(map[string]interface{})
+	for i := 0; i+1 < len(records[0].Ctx); i += 2 {
+		fields[records[0].Ctx[i].(string)] = records[0].Ctx[i+1]
+	}
+	for name, value := range map[string]interface{}{
+		"request": "test-request",
+		"method":  "GET",
+		"path":    "/api/v0/places",
+		"status":  200,
+		"bytes":   2,
+		"type":    "device",
+		"id":      "test",
+		"group":   "group",
+	} {
+		if fields[name] != value {
+			t.Errorf("bad %s: %v", name, fields[name])
+		}
+	}
+	if _, ok := fields["latency"]; !ok {
+		t.Error("latency not logged")
+	}
+
+	// выводится только каждый третий успешный запрос, но все ошибки
+	records = nil
+	for i := 0; i < 6; i++ {
+		handler.ServeHTTP(httptest.NewRecorder(),
+			httptest.NewRequest("POST", "/api/v0/device/events", nil))
+	}
+	handler.ServeHTTP(httptest.NewRecorder(),
+		httptest.NewRequest("POST", "/api/v0/device/events?fail=1", nil))
+	if len(records) != 3 {
+		t.Fatalf("bad sampled records count: %d", len(records))
+	}
+	if records[2].Lvl != log15.LvlWarn {
+		t.Errorf("bad error level: %v", records[2].Lvl)
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	for _, header := range []string{"", "bad id", string(make([]byte, requestIDMax+1))} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-Request-ID", header)
+		if id := requestID(req); id == header || len(id) != 16 {
+			t.Errorf("bad request id %q for %q", id, header)
+		}
+	}
+}
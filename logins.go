@@ -1,37 +1,53 @@
 package main
 
 import (
+	"context"
 	"errors"
-
-	"github.com/geotrace/model"
 )
 
-var ErrBadPassword = errors.New("bad password")
+var (
+	ErrBadPassword  = errors.New("bad password")
+	ErrUserDisabled = errors.New("user disabled")
+)
 
 // UserLogin читает заголовок запроса с HTTP Basic авторизацией, проверяет
 // пользователя по базе данных и отдает в ответ авторизационный ключ в формате
-// JWT.
-func (s *Store) UserLogin(login, password string) (*Token, error) {
-	user, err := (*model.Users)(s.db).Login(login)
+// JWT. Токен выдается для основной группы пользователя, а если он был из нее
+// удален, то для первой из дополнительных групп; для перехода в другую
+// группу используется GroupSwitch.
+func (s *Store) UserLogin(ctx context.Context, login, password string) (*Token, error) {
+	user, err := s.model(ctx).Users.Login(login)
 	if err != nil {
 		return nil, err
 	}
 	if !user.Password.Compare(password) {
 		return nil, ErrBadPassword
 	}
+	list, err := s.memberships(user)
+	if err != nil {
+		return nil, err
+	}
+	if len(list) == 0 {
+		return nil, ErrNotMember
+	}
+	member := list[0]
+	if member.Disabled {
+		return nil, ErrUserDisabled
+	}
 	return &Token{
 		Type:  "user",
 		Id:    user.Login,
-		Group: user.GroupID,
+		Group: member.Group,
 		Name:  user.Name,
+		Role:  member.Role,
 	}, nil
 }
 
 // DeviceLogin читает заголовок запроса с HTTP Basic авторизацией, проверяет
 // устройство по базе данных и отдает в ответ авторизационный ключ в формате
 // JWT.
-func (s *Store) DeviceLogin(login, password string) (*Token, error) {
-	device, err := (*model.Devices)(s.db).Login(login)
+func (s *Store) DeviceLogin(ctx context.Context, login, password string) (*Token, error) {
+	device, err := s.model(ctx).Devices.Login(login)
 	if err != nil {
 		return nil, err
 	}
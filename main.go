@@ -1,15 +1,20 @@
 package main
 
 import (
+	"context"
 	"crypto/rand"
 	"flag"
+	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/mdigger/jwt"
 	"github.com/mdigger/rest"
 	_ "github.com/mdigger/rest/codex" // включаем поддержку форматов данных
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 
 	"gopkg.in/inconshreveable/log15.v2"
 )
@@ -27,23 +32,93 @@ var (
 	TokenIssuer = "com.xyzrd.geotrace"
 	// время жизни токена
 	TokenExpire = time.Hour * 24 * 3
+	// максимальное время завершения начатых запросов при остановке сервера
+	shutdownTimeout = time.Second * 30
 )
 
-// InitAPI инициализирует пути и обработчики, связанные с ними.
-func InitAPI(store *Store, token *TokenTemplate) *rest.ServeMux {
+// InitAPI инициализирует пути и обработчики, связанные с ними. Если limiter
+// не задан, то количество запросов не ограничивается.
+func InitAPI(store *Store, token *TokenTemplate, limiter *RateLimiter) *rest.ServeMux {
+	// сохраняем попытки авторизации в журнале изменений
+	token.Audit = store.AuditLogin
+	// роль и участие пользователя в группе проверяются при каждом запросе
+	token.Check = store.CheckToken
 	// определяем обработчики URL
-	var mux rest.ServeMux
-	mux.Handles(rest.Paths{
+	var paths = rest.Paths{
 		"user": {
 			// авторизация пользователя
-			"GET": token.Basic(store.UserLogin),
+			"GET": token.Basic("user", store.UserLogin),
 			// регистрация нового пользователя
 			"POST": nil,
 		},
+		"user/profile": {
+			// профиль пользователя
+			"GET": token.Get(store.ProfileGet, "user"),
+			// изменяет профиль пользователя
+			"PUT": token.Get(store.ProfileChange, "user"),
+			// частично изменяет профиль пользователя
+			"PATCH": token.Get(store.ProfilePatch, "user"),
+		},
+		"groups": {
+			// список групп пользователя
+			"GET": token.Get(store.GroupsList, "user"),
+			// создает новую группу
+			"POST": token.Get(store.GroupAdd, "user"),
+		},
+		"groups/:group-id/token": {
+			// выдает токен для перехода в другую группу пользователя
+			"GET": token.Get(token.Issue(store.GroupSwitch), "user"),
+		},
+		"group": {
+			// описание текущей группы
+			"GET": token.Get(store.GroupGet, "user"),
+			// изменяет описание группы
+			"PUT": token.Get(Roles(store.GroupChange, RoleOwner, RoleAdmin), "user"),
+			// удаляет группу со всеми устройствами, местами и событиями
+			"DELETE": token.Get(Roles(store.GroupDelete, RoleOwner), "user"),
+		},
+		"group/owner": {
+			// передает владение группой другому пользователю
+			"PUT": token.Get(Roles(store.GroupOwner, RoleOwner), "user"),
+		},
+		"group/members/:login": {
+			// удаляет пользователя из группы
+			"DELETE": token.Get(Roles(store.MemberDelete, RoleOwner, RoleAdmin), "user"),
+		},
+		"group/invitations": {
+			// список приглашений в группу
+			"GET": token.Get(Roles(store.InvitationsList, RoleOwner, RoleAdmin), "user"),
+			// создает приглашение в группу
+			"POST": token.Get(Roles(store.InvitationAdd, RoleOwner, RoleAdmin), "user"),
+		},
+		"group/invitations/:code": {
+			// отменяет приглашение в группу
+			"DELETE": token.Get(Roles(store.InvitationDelete, RoleOwner, RoleAdmin), "user"),
+		},
+		"invitations/:code": {
+			// принимает приглашение в группу
+			"POST": token.Get(store.InvitationAccept, "user"),
+		},
 		"users": {
 			// отдает список пользователей в группе
 			"GET": token.Get(store.UsersList, "user"),
 		},
+		"users/:login": {
+			// описание пользователя группы
+			"GET": token.Get(Roles(store.UserGet, RoleOwner, RoleAdmin), "user"),
+			// удаляет пользователя из группы
+			"DELETE": token.Get(Roles(store.MemberDelete, RoleOwner, RoleAdmin), "user"),
+		},
+		"users/:login/role": {
+			// изменяет роль пользователя в группе
+			"PUT": token.Get(Roles(store.UserRole, RoleOwner, RoleAdmin), "user"),
+		},
+		"users/:login/disabled": {
+			// запрещает пользователю работу с группой
+			"PUT": token.Get(Roles(store.UserDisable, RoleOwner, RoleAdmin), "user"),
+			// разрешает пользователю работу с группой
+			"DELETE": token.Get(Roles(store.UserEnable, RoleOwner, RoleAdmin), "user"),
+		},
 		"devices": {
 			// список устройств в группе
 			"GET":  token.Get(store.DevicesList, "user"),
@@ -51,11 +126,17 @@ func InitAPI(store *Store, token *TokenTemplate) *rest.ServeMux {
 		},
 		"devices/:device-id": {
 			// информация об устройстве
-			"GET": nil,
+			"GET": token.Get(store.DeviceGet, "user"),
 			// изменяет устройство
-			"PUT": nil,
+			"PUT": token.Get(store.DeviceChange, "user"),
+			// частично изменяет устройство
+			"PATCH": token.Get(store.DevicePatch, "user"),
 			// удаляет устройство
-			"DELETE": nil,
+			"DELETE": token.Get(Roles(store.DeviceDelete, RoleOwner, RoleAdmin), "user"),
+		},
+		"devices/:device-id/track": {
+			// упрощенный маршрут устройства, разбитый на поездки
+			"GET": token.Get(store.TrackGet, "user"),
 		},
 		"devices/:device-id/events": {
 			"GET":  nil,
@@ -72,24 +153,80 @@ func InitAPI(store *Store, token *TokenTemplate) *rest.ServeMux {
 			// создает новое место
 			"POST": token.Get(store.PlaceAdd, "user"),
 		},
+		"places/:place-id/devices/:device-id": {
+			// назначает место устройству
+			"PUT": token.Get(store.PlaceDeviceAttach, "user"),
+			// отменяет назначение места устройству
+			"DELETE": token.Get(store.PlaceDeviceDetach, "user"),
+		},
+		"places/:place-id/users/:login": {
+			// добавляет пользователя в получатели уведомлений о месте
+			"PUT": token.Get(store.PlaceUserAttach, "user"),
+			// удаляет пользователя из получателей уведомлений о месте
+			"DELETE": token.Get(store.PlaceUserDetach, "user"),
+		},
+		"import/places": {
+			// импортирует список мест из GeoJSON, KML или CSV
+			"POST": token.Get(store.PlacesImport, "user"),
+		},
 		"places/:place-id": {
 			// возвращает описание места
 			"GET": token.Get(store.PlaceGet, "user"),
 			// изменение информации о месте
 			"PUT": token.Get(store.PlaceChange, "user"),
+			// частичное изменение информации о месте
+			"PATCH": token.Get(store.PlacePatch, "user"),
 			// удаляет место из списка группы
-			"DELETE": token.Get(store.PlaceDelete, "user"),
+			"DELETE": token.Get(Roles(store.PlaceDelete, RoleOwner, RoleAdmin), "user"),
+		},
+
+		"webhooks": {
+			// отдает список подписок на уведомления
+			"GET": token.Get(store.WebhooksList, "user"),
+			// регистрирует новую подписку
+			"POST": token.Get(store.WebhookAdd, "user"),
+		},
+		"webhooks/:webhook-id": {
+			// возвращает описание подписки
+			"GET": token.Get(store.WebhookGet, "user"),
+			// удаляет подписку
+			"DELETE": token.Get(store.WebhookDelete, "user"),
+		},
+		"webhooks/:webhook-id/test": {
+			// отправляет тестовое уведомление
+			"POST": token.Get(store.WebhookTest, "user"),
+		},
+		"webhooks/:webhook-id/deliveries": {
+			// журнал доставки уведомлений
+			"GET": token.Get(store.WebhookDeliveries, "user"),
+		},
+
+		"trash": {
+			// список удаленных мест и устройств группы
+			"GET": token.Get(store.TrashList, "user"),
+		},
+		"trash/:item-id": {
+			// восстанавливает место или устройство из корзины
+			"POST": token.Get(store.TrashRestore, "user"),
+			// окончательно удаляет место или устройство
+			"DELETE": token.Get(Roles(store.TrashDelete, RoleOwner, RoleAdmin), "user"),
+		},
+
+		"audit": {
+			// журнал изменений группы
+			"GET": token.Get(Roles(store.AuditList, RoleOwner, RoleAdmin), "user"),
 		},
 
 		"device": {
 			// авторизация устройства
-			"GET": token.Basic(store.DeviceLogin),
+			"GET": token.Basic("device", store.DeviceLogin),
 			// регистрация нового устройства
 			"POST": nil,
 		},
 		"device/events": {
-			"GET":  nil,
-			"POST": nil,
+			"GET": nil,
+			// сохраняет события устройства
+			"POST": token.Get(store.EventsAdd, "device"),
 		},
 		"device/places": {
 			// отдает список мест
@@ -102,7 +239,20 @@ func InitAPI(store *Store, token *TokenTemplate) *rest.ServeMux {
 		"device/token": {
 			"GET": nil,
 		},
-	})
+	}
+	// ошибки всех обработчиков отдаются в формате application/problem+json,
+	// шаблон пути сохраняется для метрик, а количество запросов ограничивается
+	// по классу запроса
+	for route, handlers := range paths {
+		for method, handler := range handlers {
+			if handler != nil {
+				handlers[method] = Route(route, Problems(
+					limiter.Limit(rateClass(method, route), handler)))
+			}
+		}
+	}
+	var mux rest.ServeMux
+	mux.Handles(paths)
 	mux.BasePath = "/api/v0/"
 	// mux.Headers = map[string]string{
 	// 	"Server": "GeoTrace Server",
@@ -117,8 +267,101 @@ func main() {
 		"MongoDB connection `URL`")
 	addr := flag.String("http",
 		Env("SERVER", ":8080"), "HTTP server `address:port`")
+	metricsAddr := flag.String("metrics",
+		Env("METRICS_ADDR", ""), "Prometheus metrics server `address:port`")
+	logLevel := flag.String("log-level",
+		Env("LOG_LEVEL", "info"), "log `level`: debug, info, warn, error or crit")
+	logFormat := flag.String("log-format",
+		Env("LOG_FORMAT", "terminal"), "log `format`: json, logfmt or terminal")
+	logOutput := flag.String("log-output",
+		Env("LOG_OUTPUT", "stderr"), "log output: stdout, stderr or file `path`")
+	logSample := flag.Uint64("log-sample", 10,
+		"log every `n`th successful event publishing request")
+	drain := flag.Duration("drain", time.Second*5,
+		"readiness failure `period` before graceful shutdown")
+	tracing := flag.String("trace",
+		Env("TRACE_EXPORTER", ""), "trace `exporter`: otlp or stdout")
+	rateLimits := flag.String("rate-limits",
+		Env("RATE_LIMITS", DefaultRateLimits),
+		"request rate `limits` by class: login, ingest, read and write")
+	rateStore := flag.String("rate-store",
+		Env("RATE_STORE", "memory"), "rate limits `storage`: memory or mongodb")
+	proxies := flag.String("trusted-proxies",
+		Env("TRUSTED_PROXIES", ""), "comma-separated trusted proxy `addresses` or networks")
+	flag.StringVar(&publicURL, "public-url",
+		Env("PUBLIC_URL", ""), "public API base `URL` for invitation links")
+	webhookPrivate := flag.Bool("webhook-private", Env("WEBHOOK_PRIVATE", "") == "true",
+		"allow webhook delivery to loopback and private network addresses")
 	flag.Parse()
 
+	logHandler, err := LogHandler(*logLevel, *logFormat, *logOutput)
+	if err != nil {
+		llog.Error("Bad log parameters", "err", err)
+		os.Exit(2)
+	}
+	llog.SetHandler(logHandler)
+	traceShutdown, err := InitTracing(*tracing)
+	if err != nil {
+		llog.Error("Bad trace parameters", "err", err)
+		os.Exit(2)
+	}
+	limits, err := ParseRateLimits(*rateLimits)
+	if err == nil && *rateStore != "memory" && *rateStore != "mongodb" {
+		err = fmt.Errorf("bad rate limits storage %q", *rateStore)
+	}
+	if err != nil {
+		llog.Error("Bad rate limit parameters", "err", err)
+		os.Exit(2)
+	}
+	if trustedProxies, err = ParseTrustedProxies(*proxies); err != nil {
+		llog.Error("Bad trusted proxies", "err", err)
+		os.Exit(2)
+	}
+
+	// сервер запускается до подключения к хранилищу, чтобы отвечать на
+	// запросы о готовности, а API становится доступным после подключения
+	health := new(Health)
+	health.Set("storage", ErrNotReady)
+	health.Set("indexes", ErrNotReady)
+	health.Set("keys", ErrNotReady)
+	health.Set("api", ErrNotReady)
+	health.Set("shutdown", nil)
+	api := Gate{Health: health}
+	root := http.NewServeMux()
+	root.HandleFunc("/healthz", health.Live) // процесс работает
+	root.HandleFunc("/readyz", health.Ready) // сервис готов к работе
+	root.Handle("/", &api)
+	server := &http.Server{ // инициализируем HTTP-сервер
+		Addr:         *addr,
+		Handler:      root,
+		ReadTimeout:  time.Second * 10,
+		WriteTimeout: time.Second * 10,
+	}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			llog.Error("HTTP Server error", "err", err)
+			os.Exit(1)
+		}
+	}()
+	// метрики отдаются на отдельном адресе, недоступном клиентам API
+	var metricsServer *http.Server
+	if *metricsAddr != "" {
+		metrics := http.NewServeMux()
+		metrics.Handle("/metrics", promhttp.Handler()) // метрики для Prometheus
+		metricsServer = &http.Server{
+			Addr:         *metricsAddr,
+			Handler:      metrics,
+			ReadTimeout:  time.Second * 10,
+			WriteTimeout: time.Second * 10,
+		}
+		go func() {
+			if err := metricsServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				llog.Error("Metrics server error", "err", err)
+				os.Exit(1)
+			}
+		}()
+	}
+
 	key := make([]byte, 1<<8) // создаем ключ для подписи токенов
 	if _, err := rand.Read(key); err != nil {
 		llog.Error("Error generating token signer key", "err", err)
@@ -132,23 +375,59 @@ func main() {
 			Signer:  jwt.NewSignerHS256(key), // подпись токена
 		},
 	}
+	health.Set("keys", nil)
 
-	store, err := Connect(*mongoURL) // подключаемся к MongoDB
+	store, err := Connect(*mongoURL, health) // подключаемся к MongoDB
 	if err != nil {
 		llog.Error("Connection error", "err", err)
 		os.Exit(1)
 	}
 	defer store.Close()
+	store.hooks.Private = *webhookPrivate
+	go store.WatchOffline(time.Minute)          // отслеживаем отключение устройств
+	go store.PurgeTrash(time.Hour)              // очищаем корзину
+	go store.WatchMongo(time.Second*15, health) // проверяем соединение с MongoDB
+	go store.ResumeGroupDeletes()               // завершаем прерванное удаление групп
 
-	mux := InitAPI(store, tokenEngine) // инициализируем API
-	server := http.Server{             // инициализируем HTTP-сервер
-		Addr:         *addr,
-		Handler:      mux,
-		ReadTimeout:  time.Second * 10,
-		WriteTimeout: time.Second * 10,
+	limiter := &RateLimiter{ // ограничиваем количество запросов
+		Limits: limits,
+		Store:  new(MemoryRates),
+		Token:  tokenEngine,
+	}
+	if *rateStore == "mongodb" { // общие ограничения для нескольких серверов
+		limiter.Store = store
+	}
+	mux := InitAPI(store, tokenEngine, limiter) // инициализируем API
+	// трассируем и выводим запросы в лог
+	api.Open(Traced(&AccessLog{
+		Handler: MuxProblems(mux),
+		Log:     llog.New("module", "http"),
+		Sampled: []string{"device/events"},
+		Sample:  *logSample,
+	}))
+	llog.Info("Server started", "address", *addr)
+
+	// при остановке сначала сообщаем о неготовности, чтобы балансировщик
+	// перестал направлять новые запросы, а затем дожидаемся завершения
+	// уже начатых
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
+	health.Set("shutdown", ErrShuttingDown)
+	llog.Info("Shutting down", "drain", *drain)
+	time.Sleep(*drain)
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		llog.Error("HTTP Server shutdown error", "err", err)
+	}
+	if metricsServer != nil {
+		if err := metricsServer.Shutdown(ctx); err != nil {
+			llog.Error("Metrics server shutdown error", "err", err)
+		}
 	}
-	if err := server.ListenAndServe(); err != nil {
-		llog.Error("HTTP Server error", "err", err)
+	if err := traceShutdown(ctx); err != nil {
+		llog.Error("Trace exporter shutdown error", "err", err)
 	}
 }
 
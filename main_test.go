@@ -28,6 +28,7 @@ import (
 var store *Store
 var baseURL string
 var usertoken []byte
+var devicetoken []byte
 
 const mongoURL = "mongodb://localhost/geotrace-test"
 
@@ -60,7 +61,7 @@ func TestMain(m *testing.M) {
 		os.Exit(2)
 	}
 	// доступ к хранилищу данных
-	store = &Store{model.InitDB(session, di.Database)}
+	store = NewStore(session, di.Database)
 
 	group := "test_group"
 
@@ -91,6 +92,12 @@ func TestMain(m *testing.M) {
 		}
 	}
 
+	// основной тестовый пользователь администрирует группу
+	if err = store.addMember(group, "test", RoleAdmin); err != nil {
+		llog.Error("Error add test group admin", "err", err)
+		os.Exit(2)
+	}
+
 	// создаем тестовые устройства
 	for _, device := range []*model.Device{
 		{
@@ -116,11 +123,12 @@ func TestMain(m *testing.M) {
 	}
 
 	// инициализируем API
-	mux := InitAPI(store, tokenEngine)
+	mux := InitAPI(store, tokenEngine, nil)
 	// тестовый веб-сервер
-	ts := httptest.NewServer(mux)
+	ts := httptest.NewServer(Traced(&AccessLog{Handler: MuxProblems(mux), Log: llog}))
 	// базовый путь для вызовов API
 	baseURL = ts.URL + mux.BasePath
+	publicURL = baseURL
 	// pretty.Println(mux)
 	// запускаем тесты
 	code := m.Run()
@@ -137,17 +145,31 @@ func getUserToken() (token []byte, err error) {
 	if len(usertoken) > 0 {
 		return usertoken, nil
 	}
+	fmt.Printf("#### %s\n", "Авторизация пользователя")
+	usertoken, err = getToken("user", "test", "test")
+	return usertoken, err
+}
+
+// getDeviceToken возвращает токен устройства
+func getDeviceToken() (token []byte, err error) {
+	if len(devicetoken) > 0 {
+		return devicetoken, nil
+	}
+	fmt.Printf("#### %s\n", "Авторизация устройства")
+	devicetoken, err = getToken("device", "test", "test")
+	return devicetoken, err
+}
+
+// getToken авторизуется с помощью HTTP Basic и возвращает полученный токен.
+func getToken(url, login, password string) ([]byte, error) {
 	if store == nil {
 		return nil, errors.New("not connected to store")
 	}
-
-	fmt.Printf("#### %s\n", "Авторизация пользователя")
-
-	req, err := http.NewRequest("GET", baseURL+"user", nil)
+	req, err := http.NewRequest("GET", baseURL+url, nil)
 	if err != nil {
 		return nil, err
 	}
-	req.SetBasicAuth("test", "test")
+	req.SetBasicAuth(login, password)
 	if OutResponse {
 		dump, err := httputil.DumpRequest(req, true)
 		if err != nil {
@@ -167,19 +189,19 @@ func getUserToken() (token []byte, err error) {
 		fmt.Printf("###### Response:\n```http\n%s\n```\n", dump)
 		fmt.Print("\n", strings.Repeat("-", 40), "\n\n")
 	}
-	usertoken, err := ioutil.ReadAll(resp.Body)
+	token, err := ioutil.ReadAll(resp.Body)
 	resp.Body.Close()
 	if err != nil {
 		return nil, err
 	}
 	if resp.StatusCode != 200 {
-		var errJSON = make(rest.JSON)
-		if err = json.Unmarshal(usertoken, &errJSON); err != nil {
+		var problem = new(Problem)
+		if err = json.Unmarshal(token, problem); err != nil {
 			return nil, err
 		}
-		return nil, errors.New(errJSON["error"].(string))
+		return nil, problem
 	}
-	return usertoken, nil
+	return token, nil
 }
 
 type TestRequest struct {
@@ -201,6 +223,12 @@ func init() {
 // request выводит в консоль запрос, делает его и потом выводит в консоль
 // ответ на запрос.
 func request(test TestRequest, token []byte) (*http.Response, error) {
+	return requestWithHeader(test, token, nil)
+}
+
+// requestWithHeader выполняет запрос, как и request, но добавляет к нему
+// указанные заголовки.
+func requestWithHeader(test TestRequest, token []byte, header http.Header) (*http.Response, error) {
 	if test.Name != "" {
 		fmt.Printf("#### %s\n", test.Name)
 	}
@@ -223,6 +251,9 @@ func request(test TestRequest, token []byte) (*http.Response, error) {
 	if body != nil {
 		req.Header.Set("Content-Type", "application/json")
 	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
 	// req.Header.Set("Accept", "application/cbor")
 	if OutResponse {
 		dump, err := httputil.DumpRequest(req, true)
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/mdigger/rest"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"gopkg.in/mgo.v2"
+)
+
+// префикс названий метрик
+const metricsNamespace = "geotrace"
+
+// Метрики сервиса. Метрики среды выполнения Go и процесса регистрируются
+// библиотекой Prometheus автоматически.
+var (
+	metricRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "http",
+		Name:      "requests_total",
+		Help:      "Number of HTTP requests by route, method and status.",
+	}, []string{"route", "method", "status"})
+	metricLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "http",
+		Name:      "request_duration_seconds",
+		Help:      "HTTP request latency by route, method and status.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method", "status"})
+	metricLogins = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "logins_total",
+		Help:      "Number of login attempts by token type and result.",
+	}, []string{"type", "result"})
+	metricEvents = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "events_ingested_total",
+		Help:      "Number of events published by devices.",
+	})
+	metricGeofence = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "geofence_transitions_total",
+		Help:      "Number of devices entering or exiting places.",
+	}, []string{"transition"})
+	metricRateLimited = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "rate_limited_total",
+		Help:      "Number of requests rejected by rate limits by request class.",
+	}, []string{"class"})
+	metricMongoLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "mongodb",
+		Name:      "operation_duration_seconds",
+		Help:      "MongoDB operation latency.",
+		Buckets:   []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+	}, []string{"operation"})
+	metricMongoUp = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "mongodb",
+		Name:      "up",
+		Help:      "Whether the MongoDB connection is alive (1) or not (0).",
+	})
+	metricMongoSockets = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "mongodb",
+		Name:      "sockets_in_use",
+		Help:      "Number of MongoDB sockets in use.",
+	}, func() float64 { return float64(mgo.GetStats().SocketsInUse) })
+)
+
+func init() {
+	mgo.SetStats(true) // для количества используемых соединений
+	prometheus.MustRegister(metricRequests, metricLatency, metricLogins,
+		metricEvents, metricGeofence, metricRateLimited, metricMongoLatency,
+		metricMongoUp, metricMongoSockets)
+	// переходы отдаются в метриках, даже если их еще не было
+	metricGeofence.WithLabelValues("enter")
+	metricGeofence.WithLabelValues("exit")
+}
+
+// Route сохраняет в описании запроса шаблон пути обработчика h, который
+// используется в метриках и названии span запроса вместо пути запроса.
+// Span обработчика после проверки токена называется по методу и шаблону
+// пути, потому что обработчики обычно обернуты в проверки доступа.
+func Route(route string, h rest.Handler) rest.Handler {
+	return func(c *rest.Context) error {
+		if info := requestInfo(c.Request); info != nil {
+			info.Route = route
+		}
+		c.SetData(ctxType(98), "handler "+c.Request.Method+" "+route)
+		span := trace.SpanFromContext(c.Request.Context())
+		span.SetName(c.Request.Method + " " + route)
+		span.SetAttributes(attribute.String("http.route", route))
+		return h(c)
+	}
+}
+
+// observeRequest сохраняет в метриках выполненный запрос. Запросы, для
+// которых не нашелся обработчик, учитываются с пустым шаблоном пути.
+func observeRequest(route, method string, status int, latency time.Duration) {
+	code := strconv.Itoa(status)
+	metricRequests.WithLabelValues(route, method, code).Inc()
+	metricLatency.WithLabelValues(route, method, code).Observe(latency.Seconds())
+}
+
+// observeLogin сохраняет в метриках результат авторизации.
+func observeLogin(kind string, err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	metricLogins.WithLabelValues(kind, result).Inc()
+}
+
+// observeRateLimited сохраняет в метриках запрос, отклоненный из-за
+// превышения ограничения.
+func observeRateLimited(class string) {
+	metricRateLimited.WithLabelValues(class).Inc()
+}
+
+// observeMongo сохраняет в метриках время выполнения операции с MongoDB,
+// начатой в start.
+func observeMongo(operation string, start time.Time) {
+	metricMongoLatency.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+}
+
+// WatchMongo периодически проверяет соединение с MongoDB и сохраняет его
+// состояние и время ответа в метриках. Если указан health, то результат
+// проверки сохраняется в нем как проверка storage, поэтому запрос
+// готовности сервиса не обращается к MongoDB.
+func (s *Store) WatchMongo(interval time.Duration, health *Health) {
+	s.checkMongo(health)
+	for range time.Tick(interval) {
+		s.checkMongo(health)
+	}
+}
+
+// checkMongo проверяет соединение с MongoDB.
+func (s *Store) checkMongo(health *Health) {
+	start := time.Now()
+	err := s.Ping()
+	observeMongo("ping", start)
+	if health != nil {
+		health.Set("storage", err)
+	}
+	if err != nil {
+		llog.Error("MongoDB ping error", "err", err)
+		metricMongoUp.Set(0)
+		return
+	}
+	metricMongoUp.Set(1)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mdigger/rest"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+func TestRequestMetrics(t *testing.T) {
+	handler := &AccessLog{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			h := Route("places/:place-id", func(c *rest.Context) error {
+				return nil
+			})
+			h(&rest.Context{Request: r, ResponseWriter: w})
+			w.WriteHeader(http.StatusNotFound)
+		}),
+		Log: log15.New(),
+	}
+	counter := metricRequests.WithLabelValues("places/:place-id", "GET", "404")
+	before := testutil.ToFloat64(counter)
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/v0/places/test", nil))
+	if value := testutil.ToFloat64(counter); value != before+1 {
+		t.Errorf("bad requests count: %v", value)
+	}
+
+	failed := metricLogins.WithLabelValues("user", "failure")
+	before = testutil.ToFloat64(failed)
+	observeLogin("user", ErrBadPassword)
+	if value := testutil.ToFloat64(failed); value != before+1 {
+		t.Errorf("bad failed logins count: %v", value)
+	}
+	observeMongo("ping", time.Now())
+	startOperation(context.Background(), "model.Places.List")(nil)
+
+	w := httptest.NewRecorder()
+	promhttp.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	data, _ := ioutil.ReadAll(w.Body)
+	for _, name := range []string{
+		"geotrace_http_requests_total",
+		"geotrace_logins_total",
+		"geotrace_events_ingested_total",
+		"geotrace_geofence_transitions_total",
+		"geotrace_mongodb_operation_duration_seconds",
+		"geotrace_mongodb_up",
+		"go_goroutines",
+		`operation="places.list"`,
+	} {
+		if !strings.Contains(string(data), name) {
+			t.Errorf("metric %s not found", name)
+		}
+	}
+}
+
+func TestLoginMetrics(t *testing.T) {
+	success := metricLogins.WithLabelValues("device", "success")
+	events := testutil.ToFloat64(metricEvents)
+	before := testutil.ToFloat64(success)
+	devicetoken = nil // авторизуемся заново
+	token, err := getDeviceToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value := testutil.ToFloat64(success); value != before+1 {
+		t.Errorf("bad device logins count: %v", value)
+	}
+	if _, err := request(TestRequest{"Публикация события", "POST", "device/events",
+		[]rest.JSON{{"location": []float64{37.6, 55.7}}}, 201}, token); err != nil {
+		t.Fatal(err)
+	}
+	if value := testutil.ToFloat64(metricEvents); value != events+1 {
+		t.Errorf("bad ingested events count: %v", value)
+	}
+}
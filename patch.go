@@ -0,0 +1,327 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/mdigger/rest"
+)
+
+// Типы содержимого запросов на частичное изменение документов.
+const (
+	MergePatchType = "application/merge-patch+json" // RFC 7396
+	JSONPatchType  = "application/json-patch+json"  // RFC 6902
+)
+
+var (
+	ErrBadPatch         = errors.New("bad patch document")
+	ErrPatchTestFailed  = errors.New("patch test operation failed")
+	ErrUnsupportedPatch = errors.New("unsupported patch content type")
+)
+
+// patchRequest применяет изменения из тела запроса к документу и сохраняет
+// результат в result. Формат изменений определяется по типу содержимого
+// запроса: JSON Merge Patch или JSON Patch. Тело запроса ограничено размером
+// bodyMax, а измененный документ разбирается так же строго, как в
+// bindStrict.
+func patchRequest(c *rest.Context, doc, result interface{}) error {
+	contentType := c.Request.Header.Get("Content-Type")
+	if i := strings.IndexByte(contentType, ';'); i >= 0 {
+		contentType = contentType[:i]
+	}
+	contentType = strings.TrimSpace(strings.ToLower(contentType))
+	if contentType != MergePatchType && contentType != JSONPatchType {
+		return ErrUnsupportedPatch
+	}
+	original, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	patch, err := readBody(c, bodyMax)
+	if err != nil {
+		return err
+	}
+	if !json.Valid(patch) {
+		return ErrBadPatch
+	}
+	var patched []byte
+	if contentType == MergePatchType {
+		patched, err = MergePatch(original, patch)
+	} else {
+		patched, err = JSONPatch(original, patch)
+	}
+	if err != nil {
+		return err
+	}
+	return decodeStrict(patched, result)
+}
+
+// MergePatch применяет к документу изменения в формате JSON Merge Patch
+// (RFC 7396).
+func MergePatch(doc, patch []byte) ([]byte, error) {
+	var target, changes interface{}
+	if err := json.Unmarshal(doc, &target); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(patch, &changes); err != nil {
+		return nil, ErrBadPatch
+	}
+	return json.Marshal(mergeValue(target, changes))
+}
+
+// mergeValue рекурсивно применяет изменения к значению.
+func mergeValue(target, patch interface{}) interface{} {
+	changes, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	object, ok := target.(map[string]interface{})
+	if !ok {
+		object = make(map[string]interface{})
+	}
+	for name, value := range changes {
+		if value == nil {
+			delete(object, name)
+		} else {
+			object[name] = mergeValue(object[name], value)
+		}
+	}
+	return object
+}
+
+// patchOperation описывает операцию JSON Patch.
+type patchOperation struct {
+	Op    string           `json:"op"`
+	Path  *string          `json:"path"`
+	From  string           `json:"from"`
+	Value *json.RawMessage `json:"value"`
+}
+
+// JSONPatch применяет к документу изменения в формате JSON Patch (RFC 6902).
+// Операции применяются последовательно, и при ошибке в любой из них документ
+// не изменяется.
+func JSONPatch(doc, patch []byte) ([]byte, error) {
+	var target interface{}
+	if err := json.Unmarshal(doc, &target); err != nil {
+		return nil, err
+	}
+	var operations []patchOperation
+	if err := json.Unmarshal(patch, &operations); err != nil {
+		return nil, ErrBadPatch
+	}
+	for _, op := range operations {
+		if op.Path == nil {
+			return nil, ErrBadPatch
+		}
+		var (
+			value interface{}
+			err   error
+		)
+		switch op.Op {
+		case "add", "replace", "test":
+			if op.Value == nil {
+				return nil, ErrBadPatch
+			}
+			if err := json.Unmarshal(*op.Value, &value); err != nil {
+				return nil, ErrBadPatch
+			}
+		case "move", "copy":
+			if value, err = pointerGet(target, op.From); err != nil {
+				return nil, err
+			}
+			// значение добавляется копией, чтобы следующие операции с ним
+			// не изменяли исходное значение
+			if value, err = copyValue(value); err != nil {
+				return nil, err
+			}
+			if op.Op == "move" {
+				if strings.HasPrefix(*op.Path, op.From+"/") {
+					return nil, ErrBadPatch // нельзя переместить в самого себя
+				}
+				if target, err = pointerRemove(target, op.From); err != nil {
+					return nil, err
+				}
+			}
+		case "remove":
+		default:
+			return nil, fmt.Errorf("unsupported patch operation %q", op.Op)
+		}
+		switch op.Op {
+		case "add", "move", "copy":
+			target, err = pointerAdd(target, *op.Path, value, false)
+		case "replace":
+			target, err = pointerAdd(target, *op.Path, value, true)
+		case "remove":
+			target, err = pointerRemove(target, *op.Path)
+		case "test":
+			var current interface{}
+			if current, err = pointerGet(target, *op.Path); err == nil &&
+				!reflect.DeepEqual(current, value) {
+				err = ErrPatchTestFailed
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(target)
+}
+
+// copyValue возвращает полную копию значения, полученного из документа JSON.
+func copyValue(value interface{}) (interface{}, error) {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	var result interface{}
+	if err := json.Unmarshal(raw, &result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// pointerTokens разбирает JSON Pointer (RFC 6901) на элементы пути.
+func pointerTokens(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if pointer[0] != '/' {
+		return nil, ErrBadPatch
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		token = strings.Replace(token, "~1", "/", -1)
+		tokens[i] = strings.Replace(token, "~0", "~", -1)
+	}
+	return tokens, nil
+}
+
+// arrayIndex возвращает индекс элемента массива. Если allowEnd равен true,
+// то допускается индекс, равный длине массива, и символ "-".
+func arrayIndex(token string, length int, allowEnd bool) (int, error) {
+	if allowEnd && token == "-" {
+		return length, nil
+	}
+	index, err := strconv.Atoi(token)
+	if err != nil || index < 0 || index > length ||
+		(index == length && !allowEnd) || (len(token) > 1 && token[0] == '0') {
+		return 0, fmt.Errorf("bad array index %q", token)
+	}
+	return index, nil
+}
+
+// pointerGet возвращает значение по указанному пути.
+func pointerGet(doc interface{}, pointer string) (interface{}, error) {
+	tokens, err := pointerTokens(pointer)
+	if err != nil {
+		return nil, err
+	}
+	for _, token := range tokens {
+		switch node := doc.(type) {
+		case map[string]interface{}:
+			var ok bool
+			if doc, ok = node[token]; !ok {
+				return nil, fmt.Errorf("path %q not found", pointer)
+			}
+		case []interface{}:
+			index, err := arrayIndex(token, len(node), false)
+			if err != nil {
+				return nil, err
+			}
+			doc = node[index]
+		default:
+			return nil, fmt.Errorf("path %q not found", pointer)
+		}
+	}
+	return doc, nil
+}
+
+// pointerAdd добавляет или заменяет значение по указанному пути и возвращает
+// измененный документ. При замене значение по указанному пути должно
+// существовать.
+func pointerAdd(doc interface{}, pointer string, value interface{}, replace bool) (interface{}, error) {
+	tokens, err := pointerTokens(pointer)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return value, nil // замена всего документа
+	}
+	parent, err := pointerGet(doc, pointer[:strings.LastIndex(pointer, "/")])
+	if err != nil {
+		return nil, err
+	}
+	last := tokens[len(tokens)-1]
+	switch node := parent.(type) {
+	case map[string]interface{}:
+		if _, ok := node[last]; replace && !ok {
+			return nil, fmt.Errorf("path %q not found", pointer)
+		}
+		node[last] = value
+		return doc, nil
+	case []interface{}:
+		index, err := arrayIndex(last, len(node), !replace)
+		if err != nil {
+			return nil, err
+		}
+		if replace {
+			node[index] = value
+			return doc, nil
+		}
+		node = append(node, nil)
+		copy(node[index+1:], node[index:])
+		node[index] = value
+		return pointerSet(doc, pointer[:strings.LastIndex(pointer, "/")], node)
+	}
+	return nil, fmt.Errorf("path %q not found", pointer)
+}
+
+// pointerRemove удаляет значение по указанному пути и возвращает измененный
+// документ.
+func pointerRemove(doc interface{}, pointer string) (interface{}, error) {
+	tokens, err := pointerTokens(pointer)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, ErrBadPatch
+	}
+	parent, err := pointerGet(doc, pointer[:strings.LastIndex(pointer, "/")])
+	if err != nil {
+		return nil, err
+	}
+	last := tokens[len(tokens)-1]
+	switch node := parent.(type) {
+	case map[string]interface{}:
+		if _, ok := node[last]; !ok {
+			return nil, fmt.Errorf("path %q not found", pointer)
+		}
+		delete(node, last)
+		return doc, nil
+	case []interface{}:
+		index, err := arrayIndex(last, len(node), false)
+		if err != nil {
+			return nil, err
+		}
+		node = append(node[:index], node[index+1:]...)
+		return pointerSet(doc, pointer[:strings.LastIndex(pointer, "/")], node)
+	}
+	return nil, fmt.Errorf("path %q not found", pointer)
+}
+
+// pointerSet заменяет значение по указанному существующему пути. Используется
+// для сохранения массивов, длина которых изменилась.
+func pointerSet(doc interface{}, pointer string, value interface{}) (interface{}, error) {
+	tokens, err := pointerTokens(pointer)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return value, nil
+	}
+	return pointerAdd(doc, pointer, value, true)
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/geotrace/geo"
+	"github.com/mdigger/rest"
+)
+
+func jsonEqual(t *testing.T, got []byte, want string) {
+	var a, b interface{}
+	if err := json.Unmarshal(got, &a); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(want), &b); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(a, b) {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestMergePatch(t *testing.T) {
+	for _, test := range []struct {
+		doc, patch, result string
+	}{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`{"a":"foo"}`, `["c"]`, `["c"]`},
+	} {
+		result, err := MergePatch([]byte(test.doc), []byte(test.patch))
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		jsonEqual(t, result, test.result)
+	}
+}
+
+func TestJSONPatch(t *testing.T) {
+	for _, test := range []struct {
+		doc, patch, result string
+	}{
+		{`{"foo":"bar"}`, `[{"op":"add","path":"/baz","value":"qux"}]`,
+			`{"foo":"bar","baz":"qux"}`},
+		{`{"foo":["bar","baz"]}`, `[{"op":"add","path":"/foo/1","value":"qux"}]`,
+			`{"foo":["bar","qux","baz"]}`},
+		{`{"foo":["bar"]}`, `[{"op":"add","path":"/foo/-","value":"qux"}]`,
+			`{"foo":["bar","qux"]}`},
+		{`{"foo":["bar","qux","baz"]}`, `[{"op":"remove","path":"/foo/1"}]`,
+			`{"foo":["bar","baz"]}`},
+		{`{"baz":"qux","foo":"bar"}`, `[{"op":"replace","path":"/baz","value":"boo"}]`,
+			`{"baz":"boo","foo":"bar"}`},
+		{`{"foo":{"bar":"baz","waldo":"fred"},"qux":{"corge":"grault"}}`,
+			`[{"op":"move","from":"/foo/waldo","path":"/qux/thud"}]`,
+			`{"foo":{"bar":"baz"},"qux":{"corge":"grault","thud":"fred"}}`},
+		{`{"foo":{"bar":"baz"}}`, `[{"op":"copy","from":"/foo/bar","path":"/a~1b"}]`,
+			`{"foo":{"bar":"baz"},"a/b":"baz"}`},
+		{`{"baz":"qux"}`, `[{"op":"test","path":"/baz","value":"qux"}]`,
+			`{"baz":"qux"}`},
+		// копия не связана с исходным значением
+		{`{"foo":{"bar":"baz"}}`, `[{"op":"copy","from":"/foo","path":"/qux"},
+			{"op":"add","path":"/qux/bar","value":"thud"}]`,
+			`{"foo":{"bar":"baz"},"qux":{"bar":"thud"}}`},
+		{`{"foo":[1]}`, `[{"op":"copy","from":"/foo","path":"/qux"},
+			{"op":"replace","path":"/qux/0","value":2}]`,
+			`{"foo":[1],"qux":[2]}`},
+	} {
+		result, err := JSONPatch([]byte(test.doc), []byte(test.patch))
+		if err != nil {
+			t.Errorf("%s: %v", test.patch, err)
+			continue
+		}
+		jsonEqual(t, result, test.result)
+	}
+	for _, test := range []struct {
+		doc, patch string
+	}{
+		{`{"baz":"qux"}`, `[{"op":"test","path":"/baz","value":"bar"}]`},
+		{`{"baz":"qux"}`, `[{"op":"replace","path":"/foo","value":"bar"}]`},
+		{`{"baz":"qux"}`, `[{"op":"remove","path":"/foo"}]`},
+		{`{"foo":[]}`, `[{"op":"add","path":"/foo/1","value":"bar"}]`},
+		{`{"baz":"qux"}`, `[{"op":"unknown","path":"/baz"}]`},
+		{`{"baz":"qux"}`, `[{"op":"add","value":"bar"}]`},
+	} {
+		if _, err := JSONPatch([]byte(test.doc), []byte(test.patch)); err == nil {
+			t.Errorf("%s must fail", test.patch)
+		}
+	}
+}
+
+func TestPlacePatch(t *testing.T) {
+	token, err := getUserToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := request(TestRequest{
+		"Создание места для частичного изменения",
+		"POST",
+		"places",
+		rest.JSON{
+			"name": "test_patch_place",
+			"circle": rest.JSON{
+				"center": geo.Point{88, 55},
+				"radius": 100,
+			},
+		},
+		201,
+	}, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var created struct {
+		ID string `json:"id"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+	url := fmt.Sprintf("places/%s", created.ID)
+	for _, test := range []struct {
+		TestRequest
+		contentType string
+	}{
+		{TestRequest{"Переименование места с помощью JSON Merge Patch", "PATCH", url,
+			rest.JSON{"name": "test_patch_place_2"}, 204}, MergePatchType},
+		{TestRequest{"Изменение радиуса места с помощью JSON Patch", "PATCH", url,
+			[]rest.JSON{{"op": "replace", "path": "/circle/radius", "value": 200}},
+			204}, JSONPatchType},
+		{TestRequest{"Ошибка удаления геометрии места", "PATCH", url,
+			rest.JSON{"circle": nil}, 400}, MergePatchType},
+		{TestRequest{"Ошибка добавления неизвестного поля места", "PATCH", url,
+			rest.JSON{"color": "red"}, 400}, MergePatchType},
+		{TestRequest{"Ошибка изменения места слишком большим документом", "PATCH", url,
+			rest.JSON{"name": strings.Repeat("x", int(bodyMax))}, 413}, MergePatchType},
+		{TestRequest{"Ошибка изменения места без типа изменений", "PATCH", url,
+			rest.JSON{"name": "test"}, 415}, "application/json"},
+		{TestRequest{"Ошибка изменения несуществующего места", "PATCH",
+			"places/bad_place", rest.JSON{"name": "test"}, 404}, MergePatchType},
+	} {
+		if _, err := requestWithHeader(test.TestRequest, token,
+			http.Header{"Content-Type": {test.contentType}}); err != nil {
+			t.Error(err)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"time"
+
+	"github.com/geotrace/model"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// PlaceInfo описывает место вместе с его дополнительными параметрами.
+type PlaceInfo struct {
+	model.Place `bson:",inline"`
+	Schedule    *Schedule `bson:"schedule,omitempty" json:"schedule,omitempty"`
+	Devices     []string  `bson:"devices,omitempty" json:"devices,omitempty"`
+	Users       []string  `bson:"users,omitempty" json:"users,omitempty"`
+	// устройства, находящиеся в месте в данный момент
+	Present []*DeviceInfo `bson:"-" json:"present,omitempty"`
+}
+
+// placeMeta описывает дополнительные параметры места. Они хранятся отдельно
+// от описания самого места.
+type placeMeta struct {
+	ID       string    `bson:"_id"`
+	Group    string    `bson:"group"`
+	Schedule *Schedule `bson:"schedule,omitempty"`
+	Devices  []string  `bson:"devices,omitempty"` // устройства, для которых действует место
+	Users    []string  `bson:"users,omitempty"`   // пользователи, получающие уведомления
+	Version  int       `bson:"version"`
+}
+
+// Active возвращает true, если место активно в указанное время.
+func (m *placeMeta) Active(t time.Time) bool {
+	return m == nil || m.Schedule.Active(t)
+}
+
+// For возвращает true, если место действует для указанного устройства. Если
+// список устройств не задан, то место действует для всех устройств группы.
+func (m *placeMeta) For(device string) bool {
+	if m == nil || len(m.Devices) == 0 {
+		return true
+	}
+	for _, id := range m.Devices {
+		if id == device {
+			return true
+		}
+	}
+	return false
+}
+
+// placeMeta возвращает дополнительные параметры места. Если они не заданы, то
+// возвращается nil.
+func (s *Store) placeMeta(id string) (*placeMeta, error) {
+	session, coll := s.coll("placemeta")
+	defer session.Close()
+	var meta = new(placeMeta)
+	err := coll.FindId(id).One(meta)
+	if err == mgo.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+// placeMetas возвращает дополнительные параметры всех мест группы. В качестве
+// ключа используется идентификатор места.
+func (s *Store) placeMetas(group string) (map[string]*placeMeta, error) {
+	session, coll := s.coll("placemeta")
+	defer session.Close()
+	var list []*placeMeta
+	if err := coll.Find(bson.M{"group": group}).All(&list); err != nil {
+		return nil, err
+	}
+	var result = make(map[string]*placeMeta, len(list))
+	for _, meta := range list {
+		result[meta.ID] = meta
+	}
+	return result, nil
+}
+
+// setPlaceMeta изменяет дополнительные параметры места: устанавливает
+// значения полей из set и удаляет поля, перечисленные в unset.
+func (s *Store) setPlaceMeta(group, id string, set bson.M, unset ...string) error {
+	var update = bson.M{"$set": set}
+	if len(unset) > 0 {
+		var fields = make(bson.M, len(unset))
+		for _, name := range unset {
+			fields[name] = ""
+		}
+		update["$unset"] = fields
+	}
+	return s.updatePlaceMeta(group, id, update)
+}
+
+// updatePlaceMeta применяет изменения к дополнительным параметрам места. Если
+// параметры еще не сохранены, то они создаются.
+func (s *Store) updatePlaceMeta(group, id string, update bson.M) error {
+	session, coll := s.coll("placemeta")
+	defer session.Close()
+	set, _ := update["$set"].(bson.M)
+	if set == nil {
+		set = make(bson.M, 1)
+		update["$set"] = set
+	}
+	set["group"] = group
+	_, err := coll.UpsertId(id, update)
+	return err
+}
+
+// deletePlaceMeta удаляет дополнительные параметры места.
+func (s *Store) deletePlaceMeta(id string) error {
+	session, coll := s.coll("placemeta")
+	defer session.Close()
+	if err := coll.RemoveId(id); err != nil && err != mgo.ErrNotFound {
+		return err
+	}
+	return nil
+}
+
+// placeInfo возвращает описание места вместе с его дополнительными
+// параметрами.
+func placeInfo(place model.Place, meta *placeMeta) *PlaceInfo {
+	var info = &PlaceInfo{Place: place}
+	if meta != nil {
+		info.Schedule = meta.Schedule
+		info.Devices = meta.Devices
+		info.Users = meta.Users
+	}
+	return info
+}
@@ -1,98 +1,404 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/geotrace/model"
 	"github.com/mdigger/rest"
+	"gopkg.in/mgo.v2/bson"
 )
 
-// PlacesList возвращает список мест, определенных для данной группы.
+// PlacesList возвращает список мест, определенных для данной группы. Список
+// может быть экспортирован в формате GeoJSON. С параметрами contains или near
+// возвращаются только места, содержащие точку или ближайшие к ней. С
+// параметром active=true возвращаются только места, активные в данный момент
+// по расписанию. Устройству возвращаются только назначенные ему места.
+// Обычный список поддерживает постраничный вывод, сортировку и фильтрацию
+// (см. ListQuery), а также выбор возвращаемых полей. С параметром
+// include=present для каждого места добавляются устройства, которые
+// находятся в нем в данный момент.
 func (s *Store) PlacesList(c *rest.Context) error {
 	token := GetToken(c)
 	if token == nil {
 		return ErrBadToken
 	}
-	places, err := (*model.Places)(s.db).List(token.Group)
-	if err == model.ErrNotFound {
-		return c.Send(rest.ErrNotFound)
+	format := exportFormat(c)
+	if format != "" && format != "geojson" {
+		return sendProblem(c, http.StatusNotAcceptable, "unsupported format")
+	}
+	includes, err := parseIncludes(c, "present")
+	if err != nil {
+		return badRequest(c, err)
 	}
+	params := c.Request.URL.Query()
+	active := params.Get("active") == "true"
+	spatial := params.Get("contains") != "" || params.Get("near") != ""
+	query, err := parseListQuery(c)
 	if err != nil {
 		return err
 	}
-	return c.Send(places)
+	metas, err := s.placeMetas(token.Group)
+	if err != nil {
+		return err
+	}
+	// keep возвращает true, если место с такими параметрами попадает в список
+	now := time.Now()
+	keep := func(meta *placeMeta) bool {
+		if active && !meta.Active(now) {
+			return false
+		}
+		// устройству не возвращаются места, назначенные другим устройствам
+		return token.Type != "device" || meta.For(token.Id)
+	}
+	if spatial {
+		var exclude []string
+		for id, meta := range metas {
+			if !keep(meta) {
+				exclude = append(exclude, id)
+			}
+		}
+		return s.placesSpatial(c, token.Group, exclude)
+	}
+	var places = make([]model.Place, 0)
+	var page *listPage
+	if !active && format == "" && token.Type != "device" &&
+		query.Supports(placesSource) {
+		// обычный список выбирается в MongoDB
+		page, err = query.Find(s, placesSource, placesSource.Group(token.Group), &places)
+		if err != nil {
+			return err
+		}
+	} else {
+		places, err = s.model(c.Request.Context()).Places.List(token.Group)
+		if err != nil && err != model.ErrNotFound {
+			return err
+		}
+		if active || token.Type == "device" {
+			var filtered = make([]model.Place, 0, len(places))
+			for _, place := range places {
+				if keep(metas[place.ID]) {
+					filtered = append(filtered, place)
+				}
+			}
+			places = filtered
+		}
+		if format == "geojson" {
+			data, err := PlacesGeoJSON(places)
+			if err != nil {
+				return err
+			}
+			c.Header().Set("X-Total-Count", strconv.Itoa(len(places)))
+			return sendExport(c, format, data)
+		}
+	}
+	var present map[string][]*DeviceInfo
+	if includes["present"] {
+		if present, err = s.presentDevices(c.Request.Context(), token.Group); err != nil {
+			return err
+		}
+	}
+	var result = make([]*PlaceInfo, len(places))
+	for i, place := range places {
+		result[i] = placeInfo(place, metas[place.ID])
+		result[i].Present = present[place.ID]
+	}
+	if page != nil {
+		return sendPage(c, result, page)
+	}
+	return sendList(c, query, result, placesSource.Key())
 }
 
-// PlaceGet возвращает описание конкретного места в данной группе.
+// PlaceGet возвращает описание конкретного места в данной группе. С
+// параметром include=present добавляются устройства, которые находятся в
+// месте в данный момент.
 func (s *Store) PlaceGet(c *rest.Context) error {
 	token := GetToken(c)
 	if token == nil {
 		return ErrBadToken
 	}
-	place, err := (*model.Places)(s.db).Get(token.Group, c.Param("place-id"))
+	includes, err := parseIncludes(c, "present")
+	if err != nil {
+		return badRequest(c, err)
+	}
+	place, err := s.model(c.Request.Context()).Places.Get(token.Group, c.Param("place-id"))
 	if err == model.ErrNotFound {
-		return c.Send(rest.ErrNotFound)
+		return notFound(c)
+	}
+	if err != nil {
+		return err
 	}
+	meta, err := s.placeMeta(place.ID)
 	if err != nil {
 		return err
 	}
-	return c.Send(place)
+	var version int
+	if meta != nil {
+		version = meta.Version
+	}
+	info := placeInfo(*place, meta)
+	if includes["present"] {
+		present, err := s.presentDevices(c.Request.Context(), token.Group)
+		if err != nil {
+			return err
+		}
+		info.Present = present[place.ID]
+	}
+	return sendVersion(c, version, includes, info)
 }
 
-// PlaceAdd добавляет описание нового места в группу.
+// PlaceAdd добавляет описание нового места в группу. Устройства и
+// пользователи, для которых действует место, должны входить в группу.
 func (s *Store) PlaceAdd(c *rest.Context) error {
 	token := GetToken(c)
 	if token == nil {
 		return ErrBadToken
 	}
-	place := new(model.Place)
-	if err := c.Bind(place); err != nil {
+	data := new(PlaceInfo)
+	if err := bindStrict(c, data); err != nil {
+		return err
+	}
+	if err := s.checkPlace(c.Request.Context(), data); err != nil {
 		return err
 	}
-	if err := (*model.Places)(s.db).Create(token.Group, place); err != nil {
+	if err := s.checkPlaceTargets(c.Request.Context(), token.Group, data); err != nil {
+		return err
+	}
+	place := &data.Place
+	if err := s.model(c.Request.Context()).Places.Create(token.Group, place); err != nil {
 		if err == model.ErrBadPlaceData {
-			return c.Error(http.StatusBadRequest, err.Error())
+			return badRequest(c, err)
 		}
 		return err
 	}
+	s.indexPlace(c.Request.Context(), token.Group, place)
+	var set = bson.M{"version": 1}
+	if data.Schedule != nil {
+		set["schedule"] = data.Schedule
+	}
+	if len(data.Devices) > 0 {
+		set["devices"] = data.Devices
+	}
+	if len(data.Users) > 0 {
+		set["users"] = data.Users
+	}
+	if err := s.setPlaceMeta(token.Group, place.ID, set); err != nil {
+		// место без расписания и назначений действовало бы всегда и для всех
+		// устройств, поэтому оно удаляется
+		if err := s.model(c.Request.Context()).Places.Delete(token.Group, place.ID); err != nil {
+			llog.Error("Error delete place", "id", place.ID, "err", err)
+		}
+		s.unindexPlace(c.Request.Context(), token.Group, place.ID)
+		return err
+	}
+	s.audit(c, "place.create", place.ID, nil, data)
+	c.Header().Set("ETag", versionTag(1))
 	return c.Status(http.StatusCreated).Send(rest.JSON{"id": place.ID})
 }
 
-// PlaceDelete удаляет описание места группы по его идентификатору.
+// checkPlaceTargets проверяет, что устройства и пользователи, для которых
+// действует место, входят в группу.
+func (s *Store) checkPlaceTargets(ctx context.Context, group string, data *PlaceInfo) error {
+	var errs Validation
+	for i, id := range data.Devices {
+		_, err := s.device(ctx, group, id)
+		if err != nil && err != model.ErrNotFound {
+			return err
+		}
+		errs.Check(err == nil, fmt.Sprintf("devices[%d]", i), "not_found",
+			"device not found")
+	}
+	for i, login := range data.Users {
+		_, err := s.user(ctx, group, login)
+		if err != nil && err != model.ErrNotFound {
+			return err
+		}
+		errs.Check(err == nil, fmt.Sprintf("users[%d]", i), "not_found",
+			"user not found")
+	}
+	return errs.Err()
+}
+
+// PlaceDelete перемещает место группы в корзину, откуда его можно
+// восстановить до истечения срока хранения. Если указан заголовок If-Match,
+// то место удаляется только при совпадении версии.
 func (s *Store) PlaceDelete(c *rest.Context) error {
 	token := GetToken(c)
 	if token == nil {
 		return ErrBadToken
 	}
-	if err := (*model.Places)(s.db).Delete(token.Group,
-		c.Param("place-id")); err != nil {
+	place, err := s.model(c.Request.Context()).Places.Get(token.Group, c.Param("place-id"))
+	if err == model.ErrNotFound {
+		return notFound(c)
+	}
+	if err != nil {
+		return err
+	}
+	meta, err := s.placeMeta(place.ID)
+	if err != nil {
+		return err
+	}
+	if c.Request.Header.Get("If-Match") != "" {
+		if version, err := s.checkVersion(c, "placemeta", place.ID); version == 0 {
+			return err
+		}
+	}
+	info := placeInfo(*place, meta)
+	// запись в корзине создается до удаления, чтобы место не пропало, и
+	// удаляется, если удалить место не удалось
+	trash := &TrashItem{
+		Kind:   "place",
+		Target: place.ID,
+		Name:   place.Name,
+		Place:  info,
+	}
+	if err := s.toTrash(c.Request.Context(), token, trash); err != nil {
+		return err
+	}
+	if err := s.model(c.Request.Context()).Places.Delete(token.Group, place.ID); err != nil {
+		s.dropTrash(trash)
 		if err == model.ErrNotFound {
-			return c.Send(rest.ErrNotFound)
+			return notFound(c)
 		}
 		return err
 	}
+	s.unindexPlace(c.Request.Context(), token.Group, place.ID)
+	if err := s.deletePlaceMeta(place.ID); err != nil {
+		return err
+	}
+	s.audit(c, "place.delete", place.ID, info, nil)
 	return c.Send(nil)
 }
 
-// PlaceChange изменяет описание места в группе.
+// PlaceChange изменяет описание места в группе. Если расписание не указано,
+// то место становится активным всегда, а если не указаны устройства — то
+// действует для всех устройств группы. Если указан заголовок If-Match, то
+// место изменяется только при совпадении версии.
 func (s *Store) PlaceChange(c *rest.Context) error {
 	token := GetToken(c)
 	if token == nil {
 		return ErrBadToken
 	}
-	place := new(model.Place)
-	if err := c.Bind(place); err != nil {
+	data := new(PlaceInfo)
+	if err := bindStrict(c, data); err != nil {
+		return err
+	}
+	return s.savePlace(c, token.Group, c.Param("place-id"), data)
+}
+
+// PlacePatch частично изменяет описание места в группе. Изменения
+// принимаются в формате JSON Merge Patch или JSON Patch и проверяются так
+// же, как и при полном изменении места.
+func (s *Store) PlacePatch(c *rest.Context) error {
+	token := GetToken(c)
+	if token == nil {
+		return ErrBadToken
+	}
+	place, err := s.model(c.Request.Context()).Places.Get(token.Group, c.Param("place-id"))
+	if err == model.ErrNotFound {
+		return notFound(c)
+	}
+	if err != nil {
+		return err
+	}
+	meta, err := s.placeMeta(place.ID)
+	if err != nil {
+		return err
+	}
+	data := new(PlaceInfo)
+	if err := patchRequest(c, placeInfo(*place, meta), data); err != nil {
+		if err == ErrUnsupportedPatch {
+			return sendProblem(c, http.StatusUnsupportedMediaType, err.Error())
+		}
+		return badRequest(c, err)
+	}
+	return s.savePlace(c, token.Group, place.ID, data)
+}
+
+// checkPlace проверяет описание места и его геометрию: например, что контур
+// многоугольника не пересекает сам себя. Геометрия, которую не примет
+// географический индекс, возвращается как ошибка в значении поля.
+func (s *Store) checkPlace(ctx context.Context, data *PlaceInfo) error {
+	if err := validatePlace(data); err != nil {
+		return err
+	}
+	err := s.checkPlaceGeometry(ctx, &data.Place)
+	if err != model.ErrBadPlaceData {
+		return err
+	}
+	var errs Validation
+	field := "polygon"
+	if data.Circle != nil {
+		field = "circle"
+	}
+	errs.Add(field, "invalid", "geometry is not valid")
+	return errs.Err()
+}
+
+// savePlace проверяет и сохраняет измененное описание места группы вместе с
+// расписанием и списками устройств и пользователей. Параметры, которые не
+// указаны, удаляются.
+func (s *Store) savePlace(c *rest.Context, group, id string, data *PlaceInfo) error {
+	if err := s.checkPlace(c.Request.Context(), data); err != nil {
+		return err
+	}
+	if err := s.checkPlaceTargets(c.Request.Context(), group, data); err != nil {
+		return err
+	}
+	place := &data.Place
+	place.ID = id
+	old, err := s.model(c.Request.Context()).Places.Get(group, place.ID)
+	if err == model.ErrNotFound {
+		return notFound(c)
+	}
+	if err != nil {
+		return err
+	}
+	meta, err := s.placeMeta(place.ID)
+	if err != nil {
 		return err
 	}
-	place.ID = c.Param("place-id")
-	if err := (*model.Places)(s.db).Update(token.Group, place); err != nil {
+	version, err := s.checkVersion(c, "placemeta", place.ID)
+	if version == 0 {
+		return err
+	}
+	if err := s.model(c.Request.Context()).Places.Update(group, place); err != nil {
 		if err == model.ErrNotFound {
-			return c.Send(rest.ErrNotFound)
+			return notFound(c)
 		}
 		if err == model.ErrBadPlaceData {
-			return c.Error(http.StatusBadRequest, err.Error())
+			return badRequest(c, err)
 		}
 		return err
 	}
+	s.indexPlace(c.Request.Context(), group, place)
+	var set = bson.M{}
+	var unset []string
+	if data.Schedule != nil {
+		set["schedule"] = data.Schedule
+	} else {
+		unset = append(unset, "schedule")
+	}
+	if len(data.Devices) > 0 {
+		set["devices"] = data.Devices
+	} else {
+		unset = append(unset, "devices")
+	}
+	if len(data.Users) > 0 {
+		set["users"] = data.Users
+	} else {
+		unset = append(unset, "users")
+	}
+	if err := s.setPlaceMeta(group, place.ID, set, unset...); err != nil {
+		return err
+	}
+	if version, err = s.commitVersion("placemeta", group, place.ID, version); err != nil {
+		return err
+	}
+	s.audit(c, "place.change", place.ID, placeInfo(*old, meta), data)
+	c.Header().Set("ETag", versionTag(version))
 	return c.Send(nil)
 }
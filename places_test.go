@@ -39,6 +39,60 @@ func TestPlaces(t *testing.T) {
 			},
 			400,
 		},
+		{
+			"Создание места с расписанием",
+			"POST",
+			"places",
+			rest.JSON{
+				"name": "test_scheduled_place",
+				"circle": rest.JSON{
+					"center": geo.Point{88, 55},
+					"radius": 100,
+				},
+				"schedule": rest.JSON{
+					"timezone": "Asia/Novosibirsk",
+					"windows": []rest.JSON{
+						{"days": []string{"mon", "fri"}, "from": "08:00", "to": "17:00"},
+					},
+				},
+			},
+			201,
+		},
+		{
+			"Ошибка создания места с самопересекающимся контуром",
+			"POST",
+			"places",
+			rest.JSON{
+				"name": "test_bad_polygon",
+				"polygon": geo.Polygon{{
+					{37.6, 55.7}, {37.7, 55.8}, {37.7, 55.7}, {37.6, 55.8}, {37.6, 55.7},
+				}},
+			},
+			400,
+		},
+		{
+			"Ошибка создания места с неверным расписанием",
+			"POST",
+			"places",
+			rest.JSON{
+				"name": "test_bad_schedule",
+				"circle": rest.JSON{
+					"center": geo.Point{88, 55},
+					"radius": 100,
+				},
+				"schedule": rest.JSON{
+					"windows": []rest.JSON{{"from": "25:00", "to": "17:00"}},
+				},
+			},
+			400,
+		},
+		{
+			"Получение списка активных мест",
+			"GET",
+			"places?active=true",
+			nil,
+			200,
+		},
 		{
 			"Ошибка удаления несуществующего места",
 			"DELETE",
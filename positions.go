@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/geotrace/geo"
+	"github.com/geotrace/model"
+	"github.com/mdigger/rest"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var (
+	// время без связи, после которого устройство считается отключенным
+	deviceOffline = time.Minute * 15
+	// уровень заряда батареи в процентах, который считается низким
+	lowBattery = 20
+)
+
+// Position описывает последнее известное местоположение устройства. Документ
+// обновляется при получении новых событий от устройства.
+type Position struct {
+	Device   string    `bson:"_id" json:"-"`
+	Group    string    `bson:"group" json:"-"`
+	Time     time.Time `bson:"time" json:"time"`
+	Location geo.Point `bson:"location" json:"location"`
+	Accuracy float64   `bson:"accuracy,omitempty" json:"accuracy,omitempty"`
+	Power    int       `bson:"power,omitempty" json:"power,omitempty"`
+	Online   bool      `bson:"online" json:"online"`
+	Places   []string  `bson:"places,omitempty" json:"places,omitempty"`
+	// места из Places, активные по расписанию; переходы определяются по ним
+	Active []string `bson:"active,omitempty" json:"-"`
+}
+
+// DeviceInfo описывает устройство вместе с его последним местоположением.
+type DeviceInfo struct {
+	model.Device `bson:",inline"`
+	Position     *Position `bson:"position,omitempty" json:"position,omitempty"`
+}
+
+// position возвращает последнее известное местоположение устройства.
+func (s *Store) position(ctx context.Context, device string) (*Position, error) {
+	session, coll := s.collContext(ctx, "positions")
+	defer session.Close()
+	var position = new(Position)
+	if err := coll.FindId(device).One(position); err != nil {
+		return nil, err
+	}
+	return position, nil
+}
+
+// positions возвращает последние известные местоположения всех устройств
+// группы. В качестве ключа используется идентификатор устройства.
+func (s *Store) positions(ctx context.Context, group string) (map[string]*Position, error) {
+	session, coll := s.collContext(ctx, "positions")
+	defer session.Close()
+	var list []*Position
+	if err := coll.Find(bson.M{"group": group}).All(&list); err != nil {
+		return nil, err
+	}
+	var result = make(map[string]*Position, len(list))
+	for _, position := range list {
+		result[position.Device] = position
+	}
+	return result, nil
+}
+
+// presentDevices возвращает устройства группы, которые находятся на связи,
+// вместе с их местоположением. В качестве ключа используется идентификатор
+// места, в котором находится устройство.
+func (s *Store) presentDevices(ctx context.Context, group string) (map[string][]*DeviceInfo, error) {
+	devices, err := s.model(ctx).Devices.List(group)
+	if err != nil && err != model.ErrNotFound {
+		return nil, err
+	}
+	positions, err := s.positions(ctx, group)
+	if err != nil {
+		return nil, err
+	}
+	var result = make(map[string][]*DeviceInfo)
+	for _, device := range devices {
+		position, ok := positions[device.ID]
+		if !ok || !position.Online || time.Since(position.Time) >= deviceOffline {
+			continue
+		}
+		info := &DeviceInfo{Device: device, Position: position}
+		for _, id := range position.Places {
+			result[id] = append(result[id], info)
+		}
+	}
+	return result, nil
+}
+
+// updatePosition обновляет последнее известное местоположение устройства,
+// если событие новее сохраненного, и рассылает уведомления о входе в места и
+// выходе из них, а также о низком заряде батареи. Учитываются только места,
+// назначенные устройству, а уведомления о них рассылаются только в то время,
+// когда место активно по расписанию: если расписание места начинает
+// действовать, когда устройство уже в нем, то уведомление о входе
+// рассылается при следующем событии устройства.
+func (s *Store) updatePosition(ctx context.Context, event *Event) error {
+	metas, err := s.placeMetas(event.Group)
+	if err != nil {
+		return err
+	}
+	var exclude []string // места, назначенные другим устройствам
+	for id, meta := range metas {
+		if !meta.For(event.Device) {
+			exclude = append(exclude, id)
+		}
+	}
+	// места, содержащие точку, выбираются из географического индекса
+	if err := s.syncPlaceIndex(ctx, event.Group); err != nil {
+		return err
+	}
+	places, err := s.placesContaining(ctx, event.Group, exclude, event.Location)
+	if err != nil {
+		return err
+	}
+	position := &Position{
+		Device:   event.Device,
+		Group:    event.Group,
+		Time:     event.Time,
+		Location: event.Location,
+		Accuracy: event.Accuracy,
+		Power:    event.Power,
+		Online:   true,
+	}
+	for _, place := range places {
+		position.Places = append(position.Places, place.ID)
+		if metas[place.ID].Active(event.Time) {
+			position.Active = append(position.Active, place.ID)
+		}
+	}
+	prev, saved, err := s.savePosition(ctx, position)
+	if err != nil || !saved {
+		return err
+	}
+
+	// уведомления рассылаются только для мест, активных по расписанию
+	var was []string
+	if prev != nil {
+		was = prev.Active
+	}
+	enter, exit := geofenceTransitions(was, position.Active)
+	for _, id := range enter {
+		metricGeofence.WithLabelValues("enter").Inc()
+		s.Notify(event.Group, EventGeofenceEnter, geofenceData(event, id, metas[id]))
+	}
+	for _, id := range exit {
+		if !metas[id].Active(event.Time) {
+			continue // место перестало действовать, но устройство его не покидало
+		}
+		metricGeofence.WithLabelValues("exit").Inc()
+		s.Notify(event.Group, EventGeofenceExit, geofenceData(event, id, metas[id]))
+	}
+	if event.Power > 0 && event.Power <= lowBattery &&
+		(prev == nil || prev.Power == 0 || prev.Power > lowBattery) {
+		s.Notify(event.Group, EventLowBattery, rest.JSON{
+			"device": event.Device,
+			"time":   event.Time,
+			"power":  event.Power,
+		})
+	}
+	return nil
+}
+
+// geofenceTransitions возвращает места, в которые устройство вошло и из
+// которых вышло, по спискам мест предыдущего и нового местоположения.
+func geofenceTransitions(prev, current []string) (enter, exit []string) {
+	var was = make(map[string]bool, len(prev))
+	for _, id := range prev {
+		was[id] = true
+	}
+	for _, id := range current {
+		if !was[id] {
+			enter = append(enter, id)
+		}
+		delete(was, id)
+	}
+	for _, id := range prev {
+		if was[id] {
+			exit = append(exit, id)
+		}
+	}
+	return enter, exit
+}
+
+// savePosition сохраняет местоположение устройства, только если оно новее
+// сохраненного, и возвращает предыдущее местоположение. Проверка и изменение
+// выполняются одной операцией, поэтому одновременно обработанные события
+// устройства не теряют переходы между местами. Если сохранено более новое
+// местоположение, то saved равен false.
+func (s *Store) savePosition(ctx context.Context, position *Position) (prev *Position, saved bool, err error) {
+	session, coll := s.collContext(ctx, "positions")
+	defer session.Close()
+	query := bson.M{"_id": position.Device, "time": bson.M{"$lt": position.Time}}
+	change := mgo.Change{Update: position, Upsert: true}
+	prev = new(Position)
+	start := time.Now()
+	info, err := coll.Find(query).Apply(change, prev)
+	if mgo.IsDup(err) {
+		// документ устройства уже существует, но не подошел по времени или
+		// был одновременно создан другим запросом: повторная попытка его
+		// только изменит
+		info, err = coll.Find(query).Apply(change, prev)
+	}
+	observeMongo("positions.upsert", start)
+	if mgo.IsDup(err) {
+		return nil, false, nil // сохранено более новое местоположение
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if info.Updated == 0 {
+		prev = nil // местоположение устройства сохранено впервые
+	}
+	return prev, true, nil
+}
+
+// geofenceData возвращает описание события входа или выхода из места. Если
+// для места задан список пользователей, получающих уведомления, то он тоже
+// добавляется в описание.
+func geofenceData(event *Event, place string, meta *placeMeta) rest.JSON {
+	var data = rest.JSON{
+		"device":   event.Device,
+		"place":    place,
+		"time":     event.Time,
+		"location": event.Location,
+	}
+	if meta != nil && len(meta.Users) > 0 {
+		data["users"] = meta.Users
+	}
+	return data
+}
+
+// WatchOffline периодически проверяет время последней связи с устройствами и
+// помечает как отключенные те, что давно не выходили на связь.
+func (s *Store) WatchOffline(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := s.checkOffline(); err != nil {
+			llog.Error("Error check offline devices", "err", err)
+		}
+	}
+}
+
+// checkOffline помечает устройства, не выходившие на связь дольше допустимого,
+// как отключенные и рассылает об этом уведомления.
+func (s *Store) checkOffline() error {
+	session, coll := s.coll("positions")
+	defer session.Close()
+	var list []*Position
+	if err := coll.Find(bson.M{
+		"online": true,
+		"time":   bson.M{"$lt": time.Now().Add(-deviceOffline)},
+	}).All(&list); err != nil {
+		return err
+	}
+	for _, position := range list {
+		err := coll.Update(bson.M{"_id": position.Device, "online": true},
+			bson.M{"$set": bson.M{"online": false}})
+		if err == mgo.ErrNotFound {
+			continue // устройство уже вышло на связь
+		}
+		if err != nil {
+			return err
+		}
+		s.Notify(position.Group, EventDeviceOffline, rest.JSON{
+			"device":   position.Device,
+			"time":     position.Time,
+			"location": position.Location,
+		})
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/geotrace/model"
+	"github.com/mdigger/rest"
+	"gopkg.in/mgo.v2"
+)
+
+var ErrBadProfile = errors.New("bad profile data")
+
+// Profile описывает личные данные пользователя: имя, контактную информацию
+// и настройки. Профиль общий для всех групп пользователя.
+type Profile struct {
+	Login       string                 `bson:"_id" json:"login"`
+	Name        string                 `bson:"name,omitempty" json:"name,omitempty"`
+	Email       string                 `bson:"email,omitempty" json:"email,omitempty"`
+	Phone       string                 `bson:"phone,omitempty" json:"phone,omitempty"`
+	Preferences map[string]interface{} `bson:"preferences,omitempty" json:"preferences,omitempty"`
+}
+
+// Validate проверяет данные профиля.
+func (p *Profile) Validate() error {
+	if len(p.Name) > 200 || len(p.Phone) > 50 {
+		return ErrBadProfile
+	}
+	if p.Email != "" {
+		i := strings.IndexByte(p.Email, '@')
+		if i < 1 || i == len(p.Email)-1 || len(p.Email) > 254 {
+			return errors.New("bad email")
+		}
+	}
+	return nil
+}
+
+// profile возвращает профиль пользователя. Если профиль еще не сохранен, то
+// он заполняется данными из описания пользователя.
+func (s *Store) profile(user *model.User) (*Profile, error) {
+	session, coll := s.coll("profiles")
+	defer session.Close()
+	profile := new(Profile)
+	err := coll.FindId(user.Login).One(profile)
+	if err != nil && err != mgo.ErrNotFound {
+		return nil, err
+	}
+	profile.Login = user.Login
+	if profile.Name == "" {
+		profile.Name = user.Name
+	}
+	return profile, nil
+}
+
+// ProfileGet возвращает профиль текущего пользователя.
+func (s *Store) ProfileGet(c *rest.Context) error {
+	token := GetToken(c)
+	if token == nil {
+		return ErrBadToken
+	}
+	user, err := s.model(c.Request.Context()).Users.Login(token.Id)
+	if err == model.ErrNotFound {
+		return notFound(c)
+	}
+	if err != nil {
+		return err
+	}
+	profile, err := s.profile(user)
+	if err != nil {
+		return err
+	}
+	return c.Send(profile)
+}
+
+// ProfileChange изменяет профиль текущего пользователя.
+func (s *Store) ProfileChange(c *rest.Context) error {
+	token := GetToken(c)
+	if token == nil {
+		return ErrBadToken
+	}
+	profile := new(Profile)
+	if err := bind(c, profile); err != nil {
+		return err
+	}
+	return s.saveProfile(c, token.Id, profile)
+}
+
+// ProfilePatch частично изменяет профиль текущего пользователя. Изменения
+// принимаются в формате JSON Merge Patch или JSON Patch.
+func (s *Store) ProfilePatch(c *rest.Context) error {
+	token := GetToken(c)
+	if token == nil {
+		return ErrBadToken
+	}
+	user, err := s.model(c.Request.Context()).Users.Login(token.Id)
+	if err == model.ErrNotFound {
+		return notFound(c)
+	}
+	if err != nil {
+		return err
+	}
+	current, err := s.profile(user)
+	if err != nil {
+		return err
+	}
+	profile := new(Profile)
+	if err := patchRequest(c, current, profile); err != nil {
+		if err == ErrUnsupportedPatch {
+			return sendProblem(c, http.StatusUnsupportedMediaType, err.Error())
+		}
+		return badRequest(c, err)
+	}
+	return s.saveProfile(c, token.Id, profile)
+}
+
+// saveProfile проверяет и сохраняет профиль пользователя.
+func (s *Store) saveProfile(c *rest.Context, login string, profile *Profile) error {
+	if err := profile.Validate(); err != nil {
+		return badRequest(c, err)
+	}
+	user, err := s.model(c.Request.Context()).Users.Login(login)
+	if err == model.ErrNotFound {
+		return notFound(c)
+	}
+	if err != nil {
+		return err
+	}
+	before, err := s.profile(user)
+	if err != nil {
+		return err
+	}
+	profile.Login = login
+	session, coll := s.coll("profiles")
+	defer session.Close()
+	if _, err := coll.UpsertId(login, profile); err != nil {
+		return err
+	}
+	s.audit(c, "profile.change", login, before, profile)
+	return c.Send(nil)
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mdigger/rest"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Ограничения количества запросов по умолчанию для классов запросов:
+// авторизация, публикация событий устройствами, чтение и изменение данных.
+var DefaultRateLimits = "login=10/m,ingest=60/m:120,read=300/m:60,write=60/m:30"
+
+// ErrBadRateLimit возвращается при ошибке в описании ограничений.
+var ErrBadRateLimit = errors.New("bad rate limit")
+
+// Limit описывает ограничение количества запросов по алгоритму token bucket:
+// Rate запросов в секунду в среднем и не больше Burst запросов подряд.
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+// ParseRateLimits разбирает описание ограничений для классов запросов в
+// формате "class=count/unit[:burst],...", где unit — s, m или h. Если
+// burst не указан, то он равен count.
+func ParseRateLimits(s string) (map[string]Limit, error) {
+	var limits = make(map[string]Limit)
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		var class, value string
+		if i := strings.IndexByte(item, '='); i > 0 {
+			class, value = item[:i], item[i+1:]
+		} else {
+			return nil, fmt.Errorf("%v: %q", ErrBadRateLimit, item)
+		}
+		var burst string
+		if i := strings.IndexByte(value, ':'); i >= 0 {
+			value, burst = value[:i], value[i+1:]
+		}
+		var per = time.Second
+		if i := strings.IndexByte(value, '/'); i >= 0 {
+			switch value[i+1:] {
+			case "s":
+			case "m":
+				per = time.Minute
+			case "h":
+				per = time.Hour
+			default:
+				return nil, fmt.Errorf("%v: %q", ErrBadRateLimit, item)
+			}
+			value = value[:i]
+		}
+		count, err := strconv.Atoi(value)
+		if err != nil || count < 1 {
+			return nil, fmt.Errorf("%v: %q", ErrBadRateLimit, item)
+		}
+		limit := Limit{Rate: float64(count) / per.Seconds(), Burst: count}
+		if burst != "" {
+			if limit.Burst, err = strconv.Atoi(burst); err != nil || limit.Burst < 1 {
+				return nil, fmt.Errorf("%v: %q", ErrBadRateLimit, item)
+			}
+		}
+		limits[class] = limit
+	}
+	return limits, nil
+}
+
+// take забирает из корзины, в которой на момент updated было tokens
+// запросов, один запрос в момент now. Возвращает новое количество запросов в
+// корзине и результат.
+func (l Limit) take(tokens float64, updated, now time.Time) (float64, *RateResult) {
+	if elapsed := now.Sub(updated).Seconds(); elapsed > 0 {
+		tokens = math.Min(float64(l.Burst), tokens+elapsed*l.Rate)
+	}
+	var allowed = tokens >= 1
+	if allowed {
+		tokens--
+	}
+	return tokens, l.result(tokens, allowed)
+}
+
+// result возвращает результат проверки ограничения, после которой в корзине
+// осталось tokens запросов.
+func (l Limit) result(tokens float64, allowed bool) *RateResult {
+	var result = &RateResult{
+		Allowed:   allowed,
+		Limit:     l.Burst,
+		Remaining: int(tokens),
+		Reset:     l.duration(float64(l.Burst) - tokens),
+	}
+	if !allowed {
+		result.RetryAfter = l.duration(1 - tokens)
+	}
+	return result
+}
+
+// duration возвращает время, за которое в корзине восстанавливается
+// указанное количество запросов.
+func (l Limit) duration(tokens float64) time.Duration {
+	return time.Duration(tokens / l.Rate * float64(time.Second))
+}
+
+// RateResult описывает результат проверки ограничения.
+type RateResult struct {
+	Allowed    bool          // запрос разрешен
+	Limit      int           // максимальное количество запросов подряд
+	Remaining  int           // сколько запросов еще можно выполнить
+	RetryAfter time.Duration // через сколько можно повторить запрос
+	Reset      time.Duration // через сколько ограничение будет снято полностью
+}
+
+// RateStore хранит состояние ограничений. Хранилище в памяти подходит для
+// одного экземпляра сервиса; для нескольких экземпляров используется общее
+// хранилище в MongoDB.
+type RateStore interface {
+	// TakeToken забирает один запрос из корзины с ключом key.
+	TakeToken(ctx context.Context, key string, limit Limit, now time.Time) (*RateResult, error)
+}
+
+// MemoryRates хранит состояние ограничений в памяти.
+type MemoryRates struct {
+	mu      sync.Mutex
+	buckets map[string]*memoryBucket
+	swept   time.Time
+}
+
+type memoryBucket struct {
+	tokens  float64
+	updated time.Time
+	full    time.Time // когда корзина снова будет полной
+}
+
+// TakeToken забирает один запрос из корзины с ключом key. Раз в минуту из
+// памяти удаляются полные корзины: их состояние не отличается от нового.
+func (m *MemoryRates) TakeToken(_ context.Context, key string, limit Limit, now time.Time) (*RateResult, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.buckets == nil {
+		m.buckets = make(map[string]*memoryBucket)
+	}
+	if now.Sub(m.swept) > time.Minute {
+		for key, bucket := range m.buckets {
+			if bucket.full.Before(now) {
+				delete(m.buckets, key)
+			}
+		}
+		m.swept = now
+	}
+	bucket, ok := m.buckets[key]
+	if !ok {
+		bucket = &memoryBucket{tokens: float64(limit.Burst), updated: now}
+		m.buckets[key] = bucket
+	}
+	tokens, result := limit.take(bucket.tokens, bucket.updated, now)
+	bucket.tokens, bucket.updated = tokens, now
+	bucket.full = now.Add(result.Reset)
+	return result, nil
+}
+
+// rateBucket описывает состояние ограничения в MongoDB.
+type rateBucket struct {
+	Key     string    `bson:"_id"`
+	Tokens  float64   `bson:"tokens"`
+	Allowed bool      `bson:"allowed"` // последний запрос разрешен
+	Updated time.Time `bson:"updated"`
+	Expires time.Time `bson:"expires"` // корзина полна и больше не нужна
+}
+
+// TakeToken забирает один запрос из корзины с ключом key, сохраненной в
+// MongoDB. Корзина пополняется и изменяется одной атомарной операцией
+// findAndModify с конвейером агрегации (MongoDB 4.2 и выше), поэтому
+// одновременные запросы с разных экземпляров сервиса не мешают друг другу.
+// Полные корзины удаляются MongoDB автоматически.
+func (s *Store) TakeToken(ctx context.Context, key string, limit Limit, now time.Time) (*RateResult, error) {
+	session, coll := s.collContext(ctx, "ratelimits")
+	defer session.Close()
+	burst := float64(limit.Burst)
+	// сколько запросов восстановилось с последнего изменения; разница
+	// времени между серверами не должна уменьшать количество запросов
+	refill := bson.M{"$multiply": []interface{}{
+		bson.M{"$max": []interface{}{0, bson.M{"$subtract": []interface{}{
+			now, bson.M{"$ifNull": []interface{}{"$updated", now}}}}}},
+		limit.Rate / 1000, // разница дат в MongoDB — в миллисекундах
+	}}
+	pipeline := []bson.M{
+		{"$set": bson.M{"tokens": bson.M{"$min": []interface{}{burst,
+			bson.M{"$add": []interface{}{
+				bson.M{"$ifNull": []interface{}{"$tokens", burst}}, refill}}}}}},
+		{"$set": bson.M{
+			"allowed": bson.M{"$gte": []interface{}{"$tokens", 1}},
+			"tokens": bson.M{"$cond": []interface{}{
+				bson.M{"$gte": []interface{}{"$tokens", 1}},
+				bson.M{"$subtract": []interface{}{"$tokens", 1}},
+				"$tokens"}},
+			"updated": bson.M{"$max": []interface{}{now, "$updated"}},
+		}},
+		{"$set": bson.M{"expires": bson.M{"$add": []interface{}{now,
+			bson.M{"$multiply": []interface{}{
+				bson.M{"$subtract": []interface{}{burst, "$tokens"}},
+				1000 / limit.Rate}}}}}},
+	}
+	change := mgo.Change{Update: pipeline, Upsert: true, ReturnNew: true}
+	var bucket rateBucket
+	_, err := coll.FindId(key).Apply(change, &bucket)
+	if mgo.IsDup(err) {
+		// корзину одновременно создал другой запрос: теперь она существует,
+		// и повторное изменение не создаст ее заново
+		_, err = coll.FindId(key).Apply(change, &bucket)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return limit.result(bucket.Tokens, bucket.Allowed), nil
+}
+
+// Классы запросов, которые не определяются по методу: авторизация и
+// публикация событий устройствами. Остальные запросы GET относятся к чтению,
+// а все другие — к изменению данных.
+var rateClasses = map[string]string{
+	"GET user":           "login",
+	"GET device":         "login",
+	"POST device/events": "ingest",
+}
+
+// rateClass возвращает класс запроса с указанным методом и шаблоном пути.
+func rateClass(method, route string) string {
+	if class, ok := rateClasses[method+" "+route]; ok {
+		return class
+	}
+	if method == "GET" || method == "HEAD" {
+		return "read"
+	}
+	return "write"
+}
+
+// RateLimiter ограничивает количество запросов. Запросы с токеном
+// учитываются по его владельцу, а запросы без токена и авторизация — по
+// IP-адресу клиента. Для каждого класса запросов ведется отдельный учет.
+type RateLimiter struct {
+	Limits map[string]Limit // ограничения по классам запросов
+	Store  RateStore        // хранилище состояния ограничений
+	Token  *TokenTemplate   // разбор токенов запросов
+}
+
+// Limit возвращает обработчик, который перед вызовом обработчика h
+// проверяет ограничение для класса запросов class. Если ограничение
+// превышено, то возвращается ошибка 429. Ошибка хранилища ограничений
+// выводится в лог, а запрос выполняется, чтобы сбой хранилища не остановил
+// работу API.
+func (l *RateLimiter) Limit(class string, h rest.Handler) rest.Handler {
+	if l == nil {
+		return h
+	}
+	limit, ok := l.Limits[class]
+	if !ok {
+		return h
+	}
+	return func(c *rest.Context) error {
+		key := class + ":" + l.key(class, c.Request)
+		result, err := l.Store.TakeToken(c.Request.Context(), key, limit, time.Now())
+		if err != nil {
+			llog.Error("Rate limit error", "key", key, "err", err)
+			return h(c)
+		}
+		header := c.Header()
+		header.Set("X-RateLimit-Limit", strconv.Itoa(result.Limit))
+		header.Set("X-RateLimit-Remaining", strconv.Itoa(result.Remaining))
+		header.Set("X-RateLimit-Reset", strconv.Itoa(seconds(result.Reset)))
+		if !result.Allowed {
+			observeRateLimited(class)
+			header.Set("Retry-After", strconv.Itoa(seconds(result.RetryAfter)))
+			return sendProblem(c, http.StatusTooManyRequests, "rate limit exceeded")
+		}
+		return h(c)
+	}
+}
+
+// key возвращает ключ учета запроса: владелец токена или IP-адрес клиента.
+func (l *RateLimiter) key(class string, r *http.Request) string {
+	if class != "login" && l.Token != nil {
+		if token, err := l.Token.ParseRequest(r); err == nil {
+			return token.Type + ":" + token.Id
+		}
+	}
+	return "ip:" + remoteIP(r)
+}
+
+// seconds возвращает время в секундах, округленное вверх.
+func seconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
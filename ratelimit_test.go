@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mdigger/rest"
+)
+
+func TestParseRateLimits(t *testing.T) {
+	limits, err := ParseRateLimits(DefaultRateLimits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, class := range []string{"login", "ingest", "read", "write"} {
+		if _, ok := limits[class]; !ok {
+			t.Errorf("no default limit for %s", class)
+		}
+	}
+	if limit := limits["ingest"]; limit.Rate != 1 || limit.Burst != 120 {
+		t.Errorf("bad ingest limit: %+v", limit)
+	}
+	limits, err = ParseRateLimits("read=5, write=3600/h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if limit := limits["write"]; limit.Rate != 1 || limit.Burst != 3600 {
+		t.Errorf("bad write limit: %+v", limit)
+	}
+	for _, s := range []string{"read", "read=0", "read=1/d", "read=10/m:x", "=1"} {
+		if _, err := ParseRateLimits(s); err == nil {
+			t.Errorf("%q: must be error", s)
+		}
+	}
+}
+
+func TestMemoryRates(t *testing.T) {
+	var rates MemoryRates
+	limit := Limit{Rate: 1, Burst: 2}
+	now, ctx := time.Now(), context.Background()
+	for i, allowed := range []bool{true, true, false} {
+		result, err := rates.TakeToken(ctx, "test", limit, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Allowed != allowed {
+			t.Errorf("%d: allowed %v", i, result.Allowed)
+		}
+	}
+	result, _ := rates.TakeToken(ctx, "test", limit, now)
+	if result.RetryAfter != time.Second || result.Reset != time.Second*2 {
+		t.Errorf("bad retry time: %v %v", result.RetryAfter, result.Reset)
+	}
+	if result, _ := rates.TakeToken(ctx, "other", limit, now); !result.Allowed {
+		t.Error("other key must be allowed")
+	}
+	result, _ = rates.TakeToken(ctx, "test", limit, now.Add(time.Second))
+	if !result.Allowed || result.Remaining != 0 {
+		t.Errorf("bad result after refill: %+v", result)
+	}
+	// полные корзины удаляются из памяти
+	rates.TakeToken(ctx, "test", limit, now.Add(time.Hour))
+	if len(rates.buckets) != 1 {
+		t.Errorf("buckets not swept: %d", len(rates.buckets))
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	limiter := &RateLimiter{
+		Limits: map[string]Limit{"read": {Rate: 1, Burst: 1}},
+		Store:  new(MemoryRates),
+	}
+	handler := Problems(limiter.Limit("read", func(c *rest.Context) error {
+		return c.Send(nil)
+	}))
+	serve := func(ip string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/api/v0/places", nil)
+		r.RemoteAddr = ip + ":1234"
+		handler(&rest.Context{Request: r, ResponseWriter: w})
+		return w
+	}
+	if w := serve("10.0.0.1"); w.Code != http.StatusOK ||
+		w.Header().Get("X-RateLimit-Limit") != "1" ||
+		w.Header().Get("X-RateLimit-Remaining") != "0" {
+		t.Errorf("bad first response: %d %v", w.Code, w.Header())
+	}
+	w := serve("10.0.0.1")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Content-Type") != ProblemType {
+		t.Errorf("bad limited response: %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	if w.Header().Get("Retry-After") != "1" || w.Header().Get("X-RateLimit-Reset") != "1" {
+		t.Errorf("bad limited headers: %v", w.Header())
+	}
+	if w := serve("10.0.0.2"); w.Code != http.StatusOK {
+		t.Errorf("other client must be allowed: %d", w.Code)
+	}
+	// ограничение для класса не задано
+	if limiter.Limit("write", nil) != nil {
+		t.Error("write requests must not be limited")
+	}
+}
+
+func TestRateClass(t *testing.T) {
+	for _, test := range []struct{ method, route, class string }{
+		{"GET", "user", "login"},
+		{"GET", "device", "login"},
+		{"POST", "device/events", "ingest"},
+		{"GET", "places", "read"},
+		{"PUT", "places/:place-id", "write"},
+		{"DELETE", "devices/:device-id", "write"},
+	} {
+		if class := rateClass(test.method, test.route); class != test.class {
+			t.Errorf("%s %s: %s != %s", test.method, test.route, class, test.class)
+		}
+	}
+}
+
+func TestMongoRates(t *testing.T) {
+	limit := Limit{Rate: 1, Burst: 2}
+	key := "test:" + time.Now().Format(time.RFC3339Nano)
+	now, ctx := time.Now(), context.Background()
+	for i, allowed := range []bool{true, true, false} {
+		result, err := store.TakeToken(ctx, key, limit, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Allowed != allowed {
+			t.Errorf("%d: allowed %v", i, result.Allowed)
+		}
+	}
+	result, err := store.TakeToken(ctx, key, limit, now.Add(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Allowed {
+		t.Error("must be allowed after refill")
+	}
+}
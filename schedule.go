@@ -0,0 +1,159 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+var ErrBadSchedule = errors.New("bad place schedule")
+
+// locations кеширует загруженные часовые пояса по их названиям.
+var locations sync.Map
+
+// loadLocation возвращает часовой пояс с указанным названием. Описание
+// часового пояса загружается только при первом обращении.
+func loadLocation(name string) (*time.Location, error) {
+	if loc, ok := locations.Load(name); ok {
+		return loc.(*time.Location), nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, err
+	}
+	locations.Store(name, loc)
+	return loc, nil
+}
+
+// weekdays задает сокращенные названия дней недели, используемые в
+// расписании.
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// Schedule описывает недельное расписание, в течение которого место активно.
+// Время указывается в заданном часовом поясе, а если он не задан — в UTC.
+type Schedule struct {
+	TimeZone string        `bson:"timezone,omitempty" json:"timezone,omitempty"`
+	Windows  []*TimeWindow `bson:"windows" json:"windows"`
+	// часовой пояс, определяется при проверке и загрузке расписания
+	loc *time.Location
+}
+
+// TimeWindow описывает интервал времени в течение дня в формате "15:04". Если
+// время окончания меньше времени начала, то интервал заканчивается на
+// следующий день. Если дни недели не указаны, то интервал действует каждый
+// день.
+type TimeWindow struct {
+	Days []string `bson:"days,omitempty" json:"days,omitempty"`
+	From string   `bson:"from" json:"from"`
+	To   string   `bson:"to" json:"to"`
+}
+
+// SetBSON загружает расписание из MongoDB и определяет его часовой пояс.
+func (s *Schedule) SetBSON(raw bson.Raw) error {
+	type schedule Schedule // тип без метода SetBSON
+	if err := raw.Unmarshal((*schedule)(s)); err != nil {
+		return err
+	}
+	s.loc, _ = loadLocation(s.TimeZone)
+	return nil
+}
+
+// Validate проверяет корректность расписания.
+func (s *Schedule) Validate() error {
+	var err error
+	if s.loc, err = loadLocation(s.TimeZone); err != nil {
+		return fmt.Errorf("bad time zone %q", s.TimeZone)
+	}
+	if len(s.Windows) == 0 {
+		return ErrBadSchedule
+	}
+	for _, w := range s.Windows {
+		if _, _, err := w.minutes(); err != nil {
+			return err
+		}
+		for _, day := range w.Days {
+			if _, ok := weekdays[day]; !ok {
+				return fmt.Errorf("bad weekday %q", day)
+			}
+		}
+	}
+	return nil
+}
+
+// Active возвращает true, если расписание активно в указанный момент времени.
+// Пустое расписание активно всегда.
+func (s *Schedule) Active(t time.Time) bool {
+	if s == nil || len(s.Windows) == 0 {
+		return true
+	}
+	loc := s.loc
+	if loc == nil { // расписание не проверялось и не загружалось
+		var err error
+		if loc, err = loadLocation(s.TimeZone); err != nil {
+			loc = time.UTC
+		}
+	}
+	t = t.In(loc)
+	now := t.Hour()*60 + t.Minute()
+	for _, w := range s.Windows {
+		from, to, err := w.minutes()
+		if err != nil {
+			continue
+		}
+		if from <= to {
+			if w.on(t.Weekday()) && now >= from && now < to {
+				return true
+			}
+			continue
+		}
+		// интервал переходит через полночь
+		if (w.on(t.Weekday()) && now >= from) ||
+			(w.on(t.AddDate(0, 0, -1).Weekday()) && now < to) {
+			return true
+		}
+	}
+	return false
+}
+
+// on возвращает true, если интервал начинается в указанный день недели.
+func (w *TimeWindow) on(day time.Weekday) bool {
+	if len(w.Days) == 0 {
+		return true
+	}
+	for _, name := range w.Days {
+		if weekdays[name] == day {
+			return true
+		}
+	}
+	return false
+}
+
+// minutes возвращает время начала и окончания интервала в минутах от начала
+// суток.
+func (w *TimeWindow) minutes() (from, to int, err error) {
+	start, err := time.Parse("15:04", w.From)
+	if err != nil {
+		return 0, 0, fmt.Errorf("bad time %q", w.From)
+	}
+	end, err := time.Parse("15:04", w.To)
+	if err != nil {
+		return 0, 0, fmt.Errorf("bad time %q", w.To)
+	}
+	from = start.Hour()*60 + start.Minute()
+	to = end.Hour()*60 + end.Minute()
+	if from == to {
+		return 0, 0, fmt.Errorf("empty time window %s-%s", w.From, w.To)
+	}
+	return from, to, nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSchedule(t *testing.T) {
+	schedule := &Schedule{
+		TimeZone: "Europe/Moscow",
+		Windows: []*TimeWindow{
+			{Days: []string{"mon", "tue", "wed", "thu", "fri"}, From: "08:00", To: "17:00"},
+			{Days: []string{"sat"}, From: "22:00", To: "02:00"},
+		},
+	}
+	if err := schedule.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if schedule.loc == nil || schedule.loc.String() != "Europe/Moscow" {
+		t.Fatalf("time zone must be resolved by Validate: %v", schedule.loc)
+	}
+	// 2016-01-04 — понедельник, в Москве UTC+3
+	for _, test := range []struct {
+		time   string
+		active bool
+	}{
+		{"2016-01-04T06:00:00Z", true},  // 09:00 понедельник
+		{"2016-01-04T04:59:00Z", false}, // 07:59 понедельник
+		{"2016-01-04T14:00:00Z", false}, // 17:00 понедельник
+		{"2016-01-09T06:00:00Z", false}, // 09:00 суббота
+		{"2016-01-09T19:30:00Z", true},  // 22:30 суббота
+		{"2016-01-09T22:30:00Z", true},  // 01:30 воскресенье
+		{"2016-01-10T19:30:00Z", false}, // 22:30 воскресенье
+	} {
+		tm, err := time.Parse(time.RFC3339, test.time)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if schedule.Active(tm) != test.active {
+			t.Errorf("bad active state for %s", test.time)
+		}
+	}
+	// часовой пояс загружается один раз и затем берется из кеша
+	first, err := loadLocation("Europe/Moscow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second, _ := loadLocation("Europe/Moscow"); second != first {
+		t.Error("time zone must be cached")
+	}
+	var empty *Schedule
+	if !empty.Active(time.Now()) {
+		t.Error("empty schedule must be always active")
+	}
+	for _, bad := range []*Schedule{
+		{},
+		{TimeZone: "Bad/Zone", Windows: []*TimeWindow{{From: "08:00", To: "09:00"}}},
+		{Windows: []*TimeWindow{{From: "8", To: "09:00"}}},
+		{Windows: []*TimeWindow{{Days: []string{"monday"}, From: "08:00", To: "09:00"}}},
+	} {
+		if bad.Validate() == nil {
+			t.Errorf("schedule must be invalid: %+v", bad)
+		}
+	}
+}
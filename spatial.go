@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/geotrace/geo"
+	"github.com/geotrace/model"
+	"github.com/mdigger/rest"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var (
+	// расстояние поиска ближайших мест в метрах по умолчанию
+	nearDistance = 10000.0
+	// количество возвращаемых ближайших мест по умолчанию
+	nearLimit = 20
+	// версия формата географического индекса; при ее изменении индекс
+	// каждой группы перестраивается при первом запросе
+	placeIndexVersion = 1
+
+	ErrBadPoint = errors.New("bad point coordinates")
+)
+
+// placeGeo описывает географический индекс места. Индекс хранится отдельно от
+// самих мест и обновляется при их изменении. Вместе с геометрией в индексе
+// хранится копия описания места, поэтому поиск по индексу не требует
+// загрузки всех мест группы.
+type placeGeo struct {
+	ID       string      `bson:"_id"`
+	Group    string      `bson:"group"`
+	Geometry bson.M      `bson:"geometry"`
+	Radius   float64     `bson:"radius,omitempty"`
+	Place    model.Place `bson:"place"`
+}
+
+// PlaceDistance описывает место с расстоянием до него в метрах.
+type PlaceDistance struct {
+	model.Place `bson:",inline"`
+	Distance    float64 `json:"distance"`
+}
+
+// newPlaceGeo возвращает описание географического индекса места в формате
+// GeoJSON. Для кругов индексируется их центр.
+func newPlaceGeo(group string, place *model.Place) *placeGeo {
+	var index = &placeGeo{ID: place.ID, Group: group, Place: *place}
+	switch {
+	case place.Circle != nil:
+		index.Geometry = bson.M{"type": "Point", "coordinates": place.Circle.Center}
+		index.Radius = place.Circle.Radius
+	case place.Polygon != nil:
+		index.Geometry = bson.M{"type": "Polygon", "coordinates": *place.Polygon}
+	default:
+		return nil
+	}
+	return index
+}
+
+// indexPlace обновляет географический индекс места после его создания или
+// изменения.
+func (s *Store) indexPlace(ctx context.Context, group string, place *model.Place) {
+	session, coll := s.collContext(ctx, "placegeo")
+	defer session.Close()
+	var err error
+	if index := newPlaceGeo(group, place); index != nil {
+		_, err = coll.UpsertId(index.ID, index)
+	} else {
+		err = coll.RemoveId(place.ID)
+	}
+	if err != nil && err != mgo.ErrNotFound {
+		llog.Error("Error index place", "id", place.ID, "err", err)
+		s.resetPlaceIndex(group)
+	}
+}
+
+// unindexPlace удаляет место из географического индекса.
+func (s *Store) unindexPlace(ctx context.Context, group, id string) {
+	session, coll := s.collContext(ctx, "placegeo")
+	defer session.Close()
+	if err := coll.RemoveId(id); err != nil && err != mgo.ErrNotFound {
+		llog.Error("Error unindex place", "id", id, "err", err)
+		s.resetPlaceIndex(group)
+	}
+}
+
+// resetPlaceIndex отмечает географический индекс группы как устаревший,
+// чтобы он был перестроен при следующем запросе.
+func (s *Store) resetPlaceIndex(group string) {
+	session, coll := s.coll("placeindex")
+	defer session.Close()
+	if err := coll.RemoveId(group); err != nil && err != mgo.ErrNotFound {
+		llog.Error("Error reset place index", "group", group, "err", err)
+	}
+}
+
+// syncPlaceIndex строит географический индекс мест группы, если он еще не
+// построен, построен в старом формате или не смог обновиться. Дальше индекс
+// обновляется по идентификатору места при каждом его изменении. Места,
+// которые не удалось проиндексировать, пропускаются и записываются в лог.
+// Индекс может строиться одновременно несколькими запросами, поэтому места
+// в нем заменяются по идентификатору.
+func (s *Store) syncPlaceIndex(ctx context.Context, group string) error {
+	session, coll := s.collContext(ctx, "placeindex")
+	defer session.Close()
+	var state struct {
+		Version int `bson:"version"`
+	}
+	err := coll.FindId(group).One(&state)
+	if err == nil && state.Version == placeIndexVersion {
+		return nil
+	}
+	if err != nil && err != mgo.ErrNotFound {
+		return err
+	}
+	places, err := s.model(ctx).Places.List(group)
+	if err != nil && err != model.ErrNotFound {
+		return err
+	}
+	index := session.DB(s.name).C("placegeo")
+	if _, err := index.RemoveAll(bson.M{"group": group}); err != nil {
+		return err
+	}
+	for i := range places {
+		item := newPlaceGeo(group, &places[i])
+		if item == nil {
+			continue
+		}
+		if _, err := index.UpsertId(item.ID, item); err != nil {
+			llog.Error("Error index place", "id", item.ID, "err", err)
+		}
+	}
+	_, err = coll.UpsertId(group, bson.M{"group": group, "version": placeIndexVersion})
+	return err
+}
+
+// checkPlaceGeometry проверяет, что MongoDB примет геометрию места: например,
+// что контур многоугольника не пересекает сам себя. Ошибка возвращается как
+// model.ErrBadPlaceData.
+func (s *Store) checkPlaceGeometry(ctx context.Context, place *model.Place) error {
+	index := newPlaceGeo("", place)
+	if index == nil {
+		return model.ErrBadPlaceData
+	}
+	session, coll := s.collContext(ctx, "placegeo")
+	defer session.Close()
+	// геометрия разбирается и проверяется при разборе условия запроса
+	_, err := coll.Find(bson.M{
+		"_id":      "",
+		"geometry": bson.M{"$geoIntersects": bson.M{"$geometry": index.Geometry}},
+	}).Count()
+	if _, ok := err.(*mgo.QueryError); ok {
+		return model.ErrBadPlaceData
+	}
+	return err
+}
+
+// placeQuery возвращает условие выборки из географического индекса мест
+// группы, за исключением мест с идентификаторами из exclude.
+func placeQuery(group string, exclude []string) bson.M {
+	var query = bson.M{"group": group}
+	if len(exclude) > 0 {
+		query["_id"] = bson.M{"$nin": exclude}
+	}
+	return query
+}
+
+// parsePoint разбирает координаты точки в формате "lon,lat".
+func parsePoint(s string) (geo.Point, error) {
+	var point geo.Point
+	values := strings.Split(s, ",")
+	if len(values) != 2 {
+		return point, ErrBadPoint
+	}
+	for i, value := range values {
+		var err error
+		if point[i], err = strconv.ParseFloat(strings.TrimSpace(value), 64); err != nil {
+			return point, ErrBadPoint
+		}
+	}
+	if !validPoint(point) {
+		return point, ErrBadPoint
+	}
+	return point, nil
+}
+
+// placesSpatial возвращает места группы, содержащие точку, заданную
+// параметром contains, или места, ближайшие к точке, заданной параметром near.
+// Максимальное расстояние в метрах для ближайших мест задается параметром max,
+// а их количество — параметром limit. Места с идентификаторами из exclude не
+// возвращаются. Места выбираются только из географического индекса.
+func (s *Store) placesSpatial(c *rest.Context, group string, exclude []string) error {
+	query := c.Request.URL.Query()
+	if err := s.syncPlaceIndex(c.Request.Context(), group); err != nil {
+		return err
+	}
+	if value := query.Get("contains"); value != "" {
+		point, err := parsePoint(value)
+		if err != nil {
+			return badRequest(c, err)
+		}
+		found, err := s.placesContaining(c.Request.Context(), group, exclude, point)
+		if err != nil {
+			return err
+		}
+		return sendTotal(c, found)
+	}
+
+	point, err := parsePoint(query.Get("near"))
+	if err != nil {
+		return badRequest(c, err)
+	}
+	max, limit := nearDistance, nearLimit
+	if value := query.Get("max"); value != "" {
+		if max, err = strconv.ParseFloat(value, 64); err != nil || max <= 0 {
+			return sendProblem(c, http.StatusBadRequest, "bad max parameter")
+		}
+	}
+	if value := query.Get("limit"); value != "" {
+		if limit, err = strconv.Atoi(value); err != nil || limit <= 0 {
+			return sendProblem(c, http.StatusBadRequest, "bad limit parameter")
+		}
+	}
+	session, coll := s.collContext(c.Request.Context(), "placegeo")
+	defer session.Close()
+	var near []struct {
+		Place    model.Place `bson:"place"`
+		Distance float64     `bson:"distance"`
+	}
+	if err := coll.Pipe([]bson.M{
+		{"$geoNear": bson.M{
+			"near":          bson.M{"type": "Point", "coordinates": point},
+			"distanceField": "distance",
+			"maxDistance":   max,
+			"spherical":     true,
+			"query":         placeQuery(group, exclude),
+		}},
+		{"$limit": limit},
+	}).All(&near); err != nil {
+		return err
+	}
+	var result = make([]*PlaceDistance, len(near))
+	for i, item := range near {
+		result[i] = &PlaceDistance{Place: item.Place, Distance: item.Distance}
+	}
+	return sendTotal(c, result)
+}
+
+// placesContaining возвращает места группы из географического индекса,
+// которые содержат точку, за исключением мест с идентификаторами из exclude.
+func (s *Store) placesContaining(ctx context.Context, group string, exclude []string, point geo.Point) ([]*model.Place, error) {
+	session, coll := s.collContext(ctx, "placegeo")
+	defer session.Close()
+	geometry := bson.M{"type": "Point", "coordinates": point}
+	var found []*placeGeo
+	query := placeQuery(group, exclude)
+	query["geometry"] = bson.M{"$geoIntersects": bson.M{"$geometry": geometry}}
+	if err := coll.Find(query).All(&found); err != nil {
+		return nil, err
+	}
+	// центр круга, содержащего точку, находится от нее не дальше
+	// максимального допустимого радиуса круга (см. validatePlace)
+	var circles []*placeGeo
+	query = placeQuery(group, exclude)
+	query["radius"] = bson.M{"$gt": 0}
+	query["geometry"] = bson.M{"$nearSphere": bson.M{
+		"$geometry":    geometry,
+		"$maxDistance": placeRadiusMax,
+	}}
+	if err := coll.Find(query).All(&circles); err != nil {
+		return nil, err
+	}
+	var result = make([]*model.Place, 0)
+	var seen = make(map[string]bool)
+	for _, index := range append(found, circles...) {
+		if seen[index.ID] || !Contains(&index.Place, point) {
+			continue
+		}
+		seen[index.ID] = true // исключаем повторы
+		result = append(result, &index.Place)
+	}
+	return result, nil
+}
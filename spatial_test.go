@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"testing"
+
+	"github.com/geotrace/geo"
+	"github.com/mdigger/rest"
+)
+
+func TestParsePoint(t *testing.T) {
+	point, err := parsePoint("37.6, 55.7")
+	if err != nil || point != (geo.Point{37.6, 55.7}) {
+		t.Errorf("bad point %v: %v", point, err)
+	}
+	for _, value := range []string{"", "37.6", "a,b", "37.6,95", "1,2,3"} {
+		if _, err := parsePoint(value); err != ErrBadPoint {
+			t.Errorf("point %q must be bad", value)
+		}
+	}
+}
+
+func TestPlacesSpatial(t *testing.T) {
+	token, err := getUserToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := request(TestRequest{
+		"Создание места для пространственного поиска",
+		"POST",
+		"places",
+		rest.JSON{
+			"name": "test_spatial_place",
+			"circle": rest.JSON{
+				"center": geo.Point{30.3, 59.9},
+				"radius": 1000,
+			},
+		},
+		201,
+	}, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var created struct {
+		ID string `json:"id"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []TestRequest{
+		{
+			"Ошибка поиска мест с неверными координатами",
+			"GET",
+			"places?contains=30.3",
+			nil,
+			400,
+		},
+		{
+			"Поиск ближайших мест",
+			"GET",
+			"places?near=30.31,59.9&max=5000",
+			nil,
+			200,
+		},
+	} {
+		if _, err := request(test, token); err != nil {
+			t.Error(err)
+		}
+	}
+	// contains возвращает true, если место найдено среди мест, содержащих
+	// точку
+	contains := func(point string) bool {
+		resp, err := request(TestRequest{
+			"Поиск мест, содержащих точку",
+			"GET",
+			"places?contains=" + point,
+			nil,
+			200,
+		}, token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var places []PlaceDistance
+		if err := json.NewDecoder(resp.Body).Decode(&places); err != nil {
+			t.Fatal(err)
+		}
+		if total := resp.Header.Get("X-Total-Count"); total != strconv.Itoa(len(places)) {
+			t.Errorf("bad total count: %q", total)
+		}
+		for _, place := range places {
+			if place.ID == created.ID {
+				return true
+			}
+		}
+		return false
+	}
+	if !contains("30.301,59.9") {
+		t.Error("place not found")
+	}
+	if _, err := request(TestRequest{
+		"Перемещение места",
+		"PUT",
+		"places/" + created.ID,
+		rest.JSON{
+			"name": "test_spatial_place",
+			"circle": rest.JSON{
+				"center": geo.Point{31.3, 59.9},
+				"radius": 1000,
+			},
+		},
+		204,
+	}, token); err != nil {
+		t.Fatal(err)
+	}
+	if contains("30.301,59.9") {
+		t.Error("moved place found at old point")
+	}
+	if !contains("31.301,59.9") {
+		t.Error("moved place not found")
+	}
+}
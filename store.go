@@ -9,11 +9,17 @@ import (
 
 // Store позволяет работать с функциями хранилища.
 type Store struct {
-	db *model.DB // хранилище
+	db      *model.DB      // хранилище
+	session *mgo.Session   // соединение с MongoDB
+	name    string         // название базы данных
+	roles   *memberCache   // кеш участия пользователей в группах
+	hooks   *WebhookSender // доставка уведомлений подписчикам
 }
 
-// Connect устанавливает соединение с MongoDB.
-func Connect(url string) (*Store, error) {
+// Connect устанавливает соединение с MongoDB и создает индексы. Если указан
+// health, то в нем отмечается состояние подключения и создания индексов;
+// дальше состояние соединения отслеживает WatchMongo.
+func Connect(url string, health *Health) (*Store, error) {
 	// устанавливаем соединение с MongoDB
 	di, err := mgo.ParseURL(url)
 	if err != nil {
@@ -26,15 +32,84 @@ func Connect(url string) (*Store, error) {
 		if err == nil {
 			break
 		}
+		if health != nil {
+			health.Set("storage", err)
+		}
 		if i >= retry {
 			return nil, err // это была последняя попытка
 		}
 		time.Sleep(time.Duration(i) * delay)
 	}
+	store := NewStore(session, di.Database)
+	if health != nil {
+		health.Set("storage", nil)
+	}
+	if err := store.EnsureIndexes(); err != nil {
+		store.Close()
+		return nil, err
+	}
+	if health != nil {
+		health.Set("indexes", nil)
+	}
 	// возвращаем инициализированное хранилище
+	return store, nil
+}
+
+// NewStore возвращает хранилище, использующее уже установленное соединение с
+// MongoDB.
+func NewStore(session *mgo.Session, name string) *Store {
 	return &Store{
-		db: model.InitDB(session, di.Database),
-	}, nil
+		db:      model.InitDB(session, name),
+		session: session,
+		name:    name,
+		roles:   new(memberCache),
+		hooks:   NewWebhookSender(webhookWorkers, webhookQueue),
+	}
+}
+
+// EnsureIndexes создает индексы для коллекций, с которыми хранилище работает
+// напрямую.
+func (s *Store) EnsureIndexes() error {
+	session := s.session.Copy()
+	defer session.Close()
+	db := session.DB(s.name)
+	for name, indexes := range map[string][]mgo.Index{
+		"webhooks":   {{Key: []string{"group", "events"}}},
+		"deliveries": {{Key: []string{"webhook", "-created"}}},
+		"events":     {{Key: []string{"group", "device", "time"}}},
+		"positions":  {{Key: []string{"group"}}, {Key: []string{"online", "time"}}},
+		"placegeo":   {{Key: []string{"group"}}, {Key: []string{"$2dsphere:geometry"}}},
+		"placemeta":  {{Key: []string{"group"}}},
+		"trash":      {{Key: []string{"group", "-deleted"}}, {Key: []string{"expires"}}},
+		"members":    {{Key: []string{"login"}}, {Key: []string{"group"}}},
+		"invitations": {{Key: []string{"group", "-created"}},
+			{Key: []string{"expires"}}},
+		"audit": {{Key: []string{"group", "-time"}},
+			{Key: []string{"group", "actor", "-time"}},
+			{Key: []string{"group", "target", "-time"}}},
+		"ratelimits": {{Key: []string{"expires"}, ExpireAfter: time.Second}},
+	} {
+		for _, index := range indexes {
+			if err := db.C(name).EnsureIndex(index); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// coll возвращает копию соединения и коллекцию с заданным именем. Соединение
+// необходимо закрыть после использования.
+func (s *Store) coll(name string) (*mgo.Session, *mgo.Collection) {
+	session := s.session.Copy()
+	return session, session.DB(s.name).C(name)
+}
+
+// Ping проверяет соединение с MongoDB.
+func (s *Store) Ping() error {
+	session := s.session.Copy()
+	defer session.Close()
+	return session.Ping()
 }
 
 // Close закрывает соединение с MongoDB.
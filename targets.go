@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/geotrace/model"
+	"github.com/mdigger/rest"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// PlaceDeviceAttach назначает место устройству группы. Место, назначенное
+// хотя бы одному устройству, перестает действовать для остальных устройств
+// группы.
+func (s *Store) PlaceDeviceAttach(c *rest.Context) error {
+	return s.placeTarget(c, "devices", c.Param("device-id"), true)
+}
+
+// PlaceDeviceDetach отменяет назначение места устройству. Последнее
+// устройство из назначения места удалить нельзя: место без назначенных
+// устройств действует для всех устройств группы.
+func (s *Store) PlaceDeviceDetach(c *rest.Context) error {
+	return s.placeTarget(c, "devices", c.Param("device-id"), false)
+}
+
+// PlaceUserAttach добавляет пользователя группы в список получателей
+// уведомлений о месте.
+func (s *Store) PlaceUserAttach(c *rest.Context) error {
+	return s.placeTarget(c, "users", c.Param("login"), true)
+}
+
+// PlaceUserDetach удаляет пользователя из списка получателей уведомлений о
+// месте.
+func (s *Store) PlaceUserDetach(c *rest.Context) error {
+	return s.placeTarget(c, "users", c.Param("login"), false)
+}
+
+// placeTarget добавляет или удаляет устройство или пользователя из списка
+// назначения места. Место, устройство и пользователь должны принадлежать
+// группе из токена. Как и при изменении места, проверяется заголовок
+// If-Match и меняется версия места.
+func (s *Store) placeTarget(c *rest.Context, field, id string, attach bool) error {
+	token := GetToken(c)
+	if token == nil {
+		return ErrBadToken
+	}
+	place, err := s.model(c.Request.Context()).Places.Get(token.Group, c.Param("place-id"))
+	if err == model.ErrNotFound {
+		return notFound(c)
+	}
+	if err != nil {
+		return err
+	}
+	if attach {
+		if field == "devices" {
+			_, err = s.device(c.Request.Context(), token.Group, id)
+		} else {
+			_, err = s.user(c.Request.Context(), token.Group, id)
+		}
+		if err == model.ErrNotFound {
+			return notFound(c)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	meta, err := s.placeMeta(place.ID)
+	if err != nil {
+		return err
+	}
+	version, err := s.checkVersion(c, "placemeta", place.ID)
+	if version == 0 {
+		return err
+	}
+	if attach {
+		err = s.updatePlaceMeta(token.Group, place.ID, bson.M{"$addToSet": bson.M{field: id}})
+	} else if meta != nil {
+		err = s.detachPlaceTarget(place.ID, field, id)
+	}
+	if err == ErrLastPlaceDevice {
+		return sendProblem(c, http.StatusConflict, err.Error())
+	}
+	if err != nil {
+		return err
+	}
+	if version, err = s.commitVersion("placemeta", token.Group, place.ID, version); err != nil {
+		return err
+	}
+	action, change := "place.detach", rest.JSON{field: id}
+	if attach {
+		action = "place.attach"
+		s.audit(c, action, place.ID, nil, change)
+	} else {
+		s.audit(c, action, place.ID, change, nil)
+	}
+	c.Header().Set("ETag", versionTag(version))
+	return c.Send(nil)
+}
+
+// ErrLastPlaceDevice возвращается при попытке удалить последнее устройство из
+// назначения места.
+var ErrLastPlaceDevice = errors.New("can't detach the last device of the place")
+
+// detachPlaceTarget удаляет устройство или пользователя из списка назначения
+// места. Проверка последнего устройства выполняется в том же запросе, что и
+// удаление, поэтому одновременные запросы не могут очистить список.
+func (s *Store) detachPlaceTarget(id, field, target string) error {
+	session, coll := s.coll("placemeta")
+	defer session.Close()
+	var query = bson.M{"_id": id}
+	if field == "devices" {
+		query[field] = bson.M{"$ne": []string{target}}
+	}
+	err := coll.Update(query, bson.M{"$pull": bson.M{field: target}})
+	if err != mgo.ErrNotFound {
+		return err
+	}
+	if field == "devices" {
+		return ErrLastPlaceDevice
+	}
+	return nil
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/geotrace/geo"
+	"github.com/mdigger/rest"
+)
+
+func TestPlaceTargets(t *testing.T) {
+	token, err := getUserToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	device, err := getDeviceToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := request(TestRequest{
+		"Создание места для назначения устройствам",
+		"POST",
+		"places",
+		rest.JSON{
+			"name": "test_target_place",
+			"circle": rest.JSON{
+				"center": geo.Point{88, 55},
+				"radius": 100,
+			},
+		},
+		201,
+	}, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var created struct {
+		ID string `json:"id"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []TestRequest{
+		{
+			"Назначение места устройству",
+			"PUT",
+			fmt.Sprintf("places/%s/devices/test2", created.ID),
+			nil,
+			204,
+		},
+		{
+			"Ошибка назначения места несуществующему устройству",
+			"PUT",
+			fmt.Sprintf("places/%s/devices/bad_device", created.ID),
+			nil,
+			404,
+		},
+		{
+			"Ошибка назначения несуществующего места",
+			"PUT",
+			"places/bad_place/devices/test2",
+			nil,
+			404,
+		},
+		{
+			"Добавление пользователя в получатели уведомлений",
+			"PUT",
+			fmt.Sprintf("places/%s/users/test2", created.ID),
+			nil,
+			204,
+		},
+	} {
+		if _, err := request(test, token); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// место назначено другому устройству и не должно быть в списке
+	resp, err = request(TestRequest{
+		"Получение списка мест устройства",
+		"GET",
+		"device/places",
+		nil,
+		200,
+	}, device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var places []PlaceInfo
+	if err := json.NewDecoder(resp.Body).Decode(&places); err != nil {
+		t.Fatal(err)
+	}
+	for _, place := range places {
+		if place.ID == created.ID {
+			t.Error("place assigned to other device must be hidden")
+		}
+	}
+
+	for _, test := range []TestRequest{
+		{
+			"Ошибка отмены назначения последнего устройства места",
+			"DELETE",
+			fmt.Sprintf("places/%s/devices/test2", created.ID),
+			nil,
+			409,
+		},
+		{
+			"Удаление пользователя из получателей уведомлений",
+			"DELETE",
+			fmt.Sprintf("places/%s/users/test2", created.ID),
+			nil,
+			204,
+		},
+	} {
+		if _, err := request(test, token); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// назначение меняет версию места и учитывает заголовок If-Match
+	url := fmt.Sprintf("places/%s/users/test", created.ID)
+	for _, test := range []struct {
+		TestRequest
+		tag string
+	}{
+		{TestRequest{"Ошибка назначения места с устаревшей версией", "PUT", url,
+			nil, 412}, versionTag(1)},
+		{TestRequest{"Назначение места с совпадающей версией", "PUT", url,
+			nil, 204}, versionTag(4)},
+	} {
+		if _, err := requestWithHeader(test.TestRequest, token,
+			http.Header{"If-Match": {test.tag}}); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestPlaceTargetsInBody(t *testing.T) {
+	token, err := getUserToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	circle := rest.JSON{"center": geo.Point{88, 55}, "radius": 100}
+	if _, err := request(TestRequest{
+		"Ошибка создания места для неизвестного устройства",
+		"POST",
+		"places",
+		rest.JSON{"name": "test_body_targets", "circle": circle,
+			"devices": []string{"unknown_device"}},
+		400,
+	}, token); err != nil {
+		t.Error(err)
+	}
+	resp, err := request(TestRequest{
+		"Создание места с получателями уведомлений",
+		"POST",
+		"places",
+		rest.JSON{"name": "test_body_targets", "circle": circle,
+			"users": []string{"test"}},
+		201,
+	}, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var created struct {
+		ID string `json:"id"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+	url := fmt.Sprintf("places/%s", created.ID)
+	// users возвращает получателей уведомлений о месте
+	users := func() []string {
+		resp, err := request(TestRequest{"Получение места", "GET", url, nil, 200}, token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var place PlaceInfo
+		if err := json.NewDecoder(resp.Body).Decode(&place); err != nil {
+			t.Fatal(err)
+		}
+		return place.Users
+	}
+	if list := users(); len(list) != 1 || list[0] != "test" {
+		t.Errorf("users not saved: %v", list)
+	}
+	if _, err := request(TestRequest{
+		"Изменение места без получателей уведомлений",
+		"PUT",
+		url,
+		rest.JSON{"name": "test_body_targets", "circle": circle},
+		204,
+	}, token); err != nil {
+		t.Error(err)
+	}
+	if list := users(); len(list) != 0 {
+		t.Errorf("users not removed: %v", list)
+	}
+	if _, err := request(TestRequest{"Удаление места", "DELETE", url, nil, 204}, token); err != nil {
+		t.Error(err)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net/http"
@@ -8,11 +9,19 @@ import (
 
 	"github.com/mdigger/jwt"
 	"github.com/mdigger/rest"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 // TokenTemplate описывает шаблон для генерации токена.
 type TokenTemplate struct {
 	jwt.Template // шаблон токена
+	// вызывается после каждой попытки авторизации с указанием ее типа (user
+	// или device), логина и полученного токена или ошибки
+	Audit func(c *rest.Context, kind, login string, token *Token, err error)
+	// вызывается для каждого запроса с токеном после проверки подписи;
+	// проверяет, что владелец токена по-прежнему имеет доступ к группе, и
+	// обновляет в токене данные, которые могли измениться после его выдачи
+	Check func(c *rest.Context, token *Token) error
 }
 
 // Token описывает основное содержимое токена.
@@ -21,6 +30,7 @@ type Token struct {
 	Id    string `json:"id"`
 	Group string `json:"group,omitempty"`
 	Name  string `json:"name,omitempty"`
+	Role  string `json:"role,omitempty"` // роль при выдаче токена
 }
 
 var (
@@ -45,54 +55,111 @@ func (t *TokenTemplate) ParseRequest(req *http.Request) (*Token, error) {
 // Get проверяет токен, считывая его из заголовка. В случае неверного
 // токена возвращает ошибку, что запрос не авторизован. Так же проверяет, что
 // тип токена соответствует указанному в параметрах, в противном случае тоже
-// будет ошибка. Сам токен сохраняется в контексте запроса.
+// будет ошибка. Сам токен сохраняется в контексте запроса. Проверка токена и
+// выполнение обработчика трассируются в отдельных span одного уровня.
 func (t *TokenTemplate) Get(h rest.Handler, allowSubs ...string) rest.Handler {
 	return func(c *rest.Context) error {
-		token, err := t.ParseRequest(c.Request) // читаем токен из заголовка
-		if err == ErrTokenNotFound {            // нет токена
-			c.Header().Set("WWW-Authenticate",
-				fmt.Sprintf("Bearer realm=%q", Realm))
-			return c.Error(http.StatusUnauthorized, "authorization token required")
+		ctx := c.Request.Context()
+		token, err := t.authorize(c, allowSubs)
+		// span обработчика не вкладывается в завершенный span проверки токена
+		c.Request = c.Request.WithContext(ctx)
+		if token == nil || err != nil {
+			return err
 		}
-		if err != nil { // токен не валиден
-			return c.Error(http.StatusForbidden, err.Error())
-		}
-		if len(allowSubs) > 0 { // проверяем тип токена на допустимость
-			var allow bool
-			for _, sub := range allowSubs {
-				if token.Type == sub {
-					allow = true
-					break
-				}
-			}
-			if !allow { // токен не подходит под допустимый тип
-				return c.Error(http.StatusForbidden, "unauthorized token subject")
+		return traceHandler(c, h)
+	}
+}
+
+// authorize проверяет токен запроса в отдельном span и сохраняет его в
+// контексте запроса. Если токен не прошел проверку, то ошибка уже отдана в
+// ответ и возвращается пустой токен.
+func (t *TokenTemplate) authorize(c *rest.Context, allowSubs []string) (token *Token, err error) {
+	ctx, span := startSpan(c.Request.Context(), "TokenTemplate.Get")
+	defer func() { endSpan(span, err) }()
+	c.Request = c.Request.WithContext(ctx)
+	token, err = t.ParseRequest(c.Request) // читаем токен из заголовка
+	if err == ErrTokenNotFound {           // нет токена
+		c.Header().Set("WWW-Authenticate",
+			fmt.Sprintf("Bearer realm=%q", Realm))
+		return nil, sendProblem(c, http.StatusUnauthorized, "authorization token required")
+	}
+	if err != nil { // токен не валиден
+		return nil, sendProblem(c, http.StatusForbidden, err.Error())
+	}
+	if len(allowSubs) > 0 { // проверяем тип токена на допустимость
+		var allow bool
+		for _, sub := range allowSubs {
+			if token.Type == sub {
+				allow = true
+				break
 			}
 		}
-		c.SetData(ctxType(99), token) // сохраняем токен в контексте запроса
-		return h(c)
+		if !allow { // токен не подходит под допустимый тип
+			return nil, sendProblem(c, http.StatusForbidden, "unauthorized token subject")
+		}
+	}
+	if t.Check != nil { // проверяем доступ владельца токена к группе
+		if err := t.Check(c, token); err != nil {
+			return nil, err
+		}
 	}
+	c.SetData(ctxType(99), token) // сохраняем токен в контексте запроса
+	if info := requestInfo(c.Request); info != nil {
+		info.Token = token // для вывода в лог запросов
+	}
+	span.SetAttributes(attribute.String("token.type", token.Type),
+		attribute.String("token.id", token.Id),
+		attribute.String("token.group", token.Group))
+	return token, nil
 }
 
 // Basic осуществляет HTTP Basic авторизацию и возвращает авторизационный токен.
-func (t *TokenTemplate) Basic(auth func(login, password string) (*Token, error)) rest.Handler {
+// Тип авторизации kind передается в функцию Audit вместе с результатом.
+func (t *TokenTemplate) Basic(kind string,
+	auth func(ctx context.Context, login, password string) (*Token, error)) rest.Handler {
 	return func(c *rest.Context) error {
 		login, password, ok := c.BasicAuth()
 		if !ok {
 			c.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", Realm))
-			return c.Send(rest.ErrUnauthorized)
+			return sendProblem(c, http.StatusUnauthorized, "")
+		}
+		token, err := auth(c.Request.Context(), login, password)
+		if t.Audit != nil {
+			t.Audit(c, kind, login, token, err)
+		}
+		observeLogin(kind, err)
+		if isNotFound(err) || err == ErrBadPassword {
+			// не сообщаем, что именно неверно: логин или пароль
+			return sendError(c, ErrBadPassword)
 		}
-		token, err := auth(login, password)
 		if err != nil {
-			return c.Error(http.StatusForbidden, err.Error())
+			return err
 		}
-		tokenData, err := t.Template.Token(token)
+		return t.send(c, token)
+	}
+}
+
+// Issue возвращает новый авторизационный токен, описание которого возвращает
+// обработчик h. Используется для выдачи токена уже авторизованному
+// пользователю, например, при смене активной группы.
+func (t *TokenTemplate) Issue(h func(c *rest.Context) (*Token, error)) rest.Handler {
+	return func(c *rest.Context) error {
+		token, err := h(c)
 		if err != nil {
-			return c.Error(http.StatusInternalServerError, err.Error())
+			return err
 		}
-		c.ContentType = "application/jwt"
-		return c.Send(tokenData)
+		return t.send(c, token)
+	}
+}
+
+// send отдает в ответ подписанный токен в формате JWT.
+func (t *TokenTemplate) send(c *rest.Context, token *Token) error {
+	tokenData, err := t.Template.Token(token)
+	if err != nil {
+		return sendProblem(c, http.StatusInternalServerError, err.Error())
 	}
+	c.ContentType = "application/jwt"
+	return c.Send(tokenData)
 }
 
 type ctxType byte // тип для сохранения данных в контексте запроса
@@ -20,6 +20,46 @@ func TestTokens(t *testing.T) {
 		store.PlaceDelete,
 		store.PlaceChange,
 		store.UsersList,
+		store.WebhooksList,
+		store.WebhookAdd,
+		store.WebhookGet,
+		store.WebhookDelete,
+		store.WebhookTest,
+		store.WebhookDeliveries,
+		store.EventsAdd,
+		store.TrackGet,
+		store.PlacesImport,
+		store.PlaceDeviceAttach,
+		store.PlaceDeviceDetach,
+		store.PlaceUserAttach,
+		store.PlaceUserDetach,
+		store.DeviceGet,
+		store.DeviceChange,
+		store.DeviceDelete,
+		store.PlacePatch,
+		store.DevicePatch,
+		store.TrashList,
+		store.TrashRestore,
+		store.TrashDelete,
+		store.AuditList,
+		store.GroupsList,
+		store.GroupAdd,
+		store.GroupGet,
+		store.GroupChange,
+		store.GroupDelete,
+		store.GroupOwner,
+		store.MemberDelete,
+		store.InvitationsList,
+		store.InvitationAdd,
+		store.InvitationDelete,
+		store.InvitationAccept,
+		store.ProfileGet,
+		store.ProfileChange,
+		store.ProfilePatch,
+		store.UserGet,
+		store.UserRole,
+		store.UserDisable,
+		store.UserEnable,
 	} {
 		if err := f(c); err != ErrBadToken {
 			t.Error(err)
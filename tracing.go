@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/geotrace/model"
+	"github.com/mdigger/rest"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"gopkg.in/mgo.v2"
+)
+
+// название сервиса и библиотеки трассировки
+const tracerName = "github.com/geotrace/api"
+
+// InitTracing настраивает трассировку запросов. Параметр exporter задает,
+// куда отправляются данные: otlp — коллектору по протоколу OTLP (адрес
+// задается переменной окружения OTEL_EXPORTER_OTLP_ENDPOINT), stdout — в
+// стандартный вывод. Если exporter не указан, то трассировка выключена, но
+// контекст трассировки из заголовков запросов все равно передается дальше.
+// Возвращает функцию, которая отправляет оставшиеся данные при остановке.
+func InitTracing(exporter string) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{}, propagation.Baggage{}))
+	var spanExporter sdktrace.SpanExporter
+	var err error
+	switch strings.ToLower(exporter) {
+	case "":
+		return func(context.Context) error { return nil }, nil
+	case "otlp":
+		spanExporter, err = otlptracehttp.New(context.Background())
+	case "stdout":
+		spanExporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	default:
+		return nil, fmt.Errorf("bad trace exporter %q", exporter)
+	}
+	if err != nil {
+		return nil, err
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(
+		attribute.String("service.name", "geotrace-api")))
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(spanExporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// startSpan начинает новый span в контексте ctx.
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan завершает span и отмечает в нем ошибку err. Отсутствие документа
+// ошибкой не считается.
+func endSpan(span trace.Span, err error) {
+	if err != nil && !isNotFound(err) {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Traced создает для каждого запроса к обработчику h span, продолжая
+// трассировку, переданную в заголовках traceparent и tracestate (W3C Trace
+// Context).
+func Traced(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(),
+			propagation.HeaderCarrier(r.Header))
+		ctx, span := otel.Tracer(tracerName).Start(ctx, r.Method,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.method", r.Method),
+				attribute.String("http.target", r.URL.Path),
+			))
+		defer span.End()
+		response := &responseLog{ResponseWriter: w}
+		h.ServeHTTP(response, r.WithContext(ctx))
+		if response.status == 0 {
+			response.status = http.StatusOK
+		}
+		span.SetAttributes(attribute.Int("http.status_code", response.status))
+		if response.status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(response.status))
+		}
+	})
+}
+
+// traceHandler выполняет обработчик h в отдельном span с названием
+// обработчика, сохраненным в запросе функцией Route.
+func traceHandler(c *rest.Context, h rest.Handler) error {
+	name, _ := c.Data(ctxType(98)).(string)
+	if name == "" {
+		name = "handler"
+	}
+	ctx, span := startSpan(c.Request.Context(), name)
+	c.Request = c.Request.WithContext(ctx)
+	err := h(c)
+	endSpan(span, err)
+	return err
+}
+
+// startOperation начинает span обращения к хранилищу. Возвращаемая функция
+// завершает span и сохраняет время выполнения операции в метриках.
+func startOperation(ctx context.Context, name string, attrs ...attribute.KeyValue) func(error) {
+	start := time.Now()
+	_, span := startSpan(ctx, name, attrs...)
+	return func(err error) {
+		endSpan(span, err)
+		observeMongo(strings.ToLower(strings.TrimPrefix(name, "model.")), start)
+	}
+}
+
+// tracedSession описывает копию соединения с MongoDB, полученную с помощью
+// collContext. Закрытие соединения завершает span работы с коллекцией.
+type tracedSession struct {
+	*mgo.Session
+	end func(error)
+}
+
+// Close закрывает соединение и завершает span.
+func (s *tracedSession) Close() {
+	s.Session.Close()
+	s.end(nil)
+}
+
+// collContext возвращает копию соединения и коллекцию с заданным именем, как
+// и coll, но работа с коллекцией до закрытия соединения выполняется в
+// отдельном span в контексте ctx и учитывается в метриках времени выполнения
+// операций с MongoDB.
+func (s *Store) collContext(ctx context.Context, name string) (*tracedSession, *mgo.Collection) {
+	end := startOperation(ctx, "mongodb."+name, attribute.String("collection", name))
+	session := s.session.Copy()
+	return &tracedSession{Session: session, end: end}, session.DB(s.name).C(name)
+}
+
+// Model описывает работу с пользователями, устройствами и местами хранилища.
+// Каждое обращение к ним выполняется в отдельном span и учитывается в
+// метриках времени выполнения операций с MongoDB.
+type Model struct {
+	Users   tracedUsers
+	Devices tracedDevices
+	Places  tracedPlaces
+}
+
+// model возвращает описание работы с хранилищем для запроса с контекстом
+// трассировки ctx.
+func (s *Store) model(ctx context.Context) *Model {
+	return &Model{
+		Users:   tracedUsers{ctx, (*model.Users)(s.db)},
+		Devices: tracedDevices{ctx, (*model.Devices)(s.db)},
+		Places:  tracedPlaces{ctx, (*model.Places)(s.db)},
+	}
+}
+
+// tracedUsers выполняет запросы к пользователям хранилища в отдельных span.
+type tracedUsers struct {
+	ctx context.Context
+	db  *model.Users
+}
+
+// Login возвращает пользователя с указанным логином.
+func (m tracedUsers) Login(login string) (*model.User, error) {
+	end := startOperation(m.ctx, "model.Users.Login", attribute.String("login", login))
+	user, err := m.db.Login(login)
+	end(err)
+	return user, err
+}
+
+// List возвращает список пользователей группы.
+func (m tracedUsers) List(group string) ([]model.User, error) {
+	end := startOperation(m.ctx, "model.Users.List", attribute.String("group", group))
+	users, err := m.db.List(group)
+	end(err)
+	return users, err
+}
+
+// tracedDevices выполняет запросы к устройствам хранилища в отдельных span.
+type tracedDevices struct {
+	ctx context.Context
+	db  *model.Devices
+}
+
+// Login возвращает устройство с указанным логином.
+func (m tracedDevices) Login(login string) (*model.Device, error) {
+	end := startOperation(m.ctx, "model.Devices.Login", attribute.String("login", login))
+	device, err := m.db.Login(login)
+	end(err)
+	return device, err
+}
+
+// List возвращает список устройств группы.
+func (m tracedDevices) List(group string) ([]model.Device, error) {
+	end := startOperation(m.ctx, "model.Devices.List", attribute.String("group", group))
+	devices, err := m.db.List(group)
+	end(err)
+	return devices, err
+}
+
+// Get возвращает устройство группы с указанным идентификатором.
+func (m tracedDevices) Get(group, id string) (*model.Device, error) {
+	end := startOperation(m.ctx, "model.Devices.Get", attribute.String("group", group),
+		attribute.String("id", id))
+	device, err := m.db.Get(group, id)
+	end(err)
+	return device, err
+}
+
+// Create добавляет новое устройство в группу.
+func (m tracedDevices) Create(group string, device *model.Device) error {
+	end := startOperation(m.ctx, "model.Devices.Create", attribute.String("group", group))
+	err := m.db.Create(group, device)
+	end(err)
+	return err
+}
+
+// Update сохраняет измененное описание устройства группы.
+func (m tracedDevices) Update(group string, device *model.Device) error {
+	end := startOperation(m.ctx, "model.Devices.Update", attribute.String("group", group),
+		attribute.String("id", device.ID))
+	err := m.db.Update(group, device)
+	end(err)
+	return err
+}
+
+// Delete удаляет устройство группы.
+func (m tracedDevices) Delete(group, id string) error {
+	end := startOperation(m.ctx, "model.Devices.Delete", attribute.String("group", group),
+		attribute.String("id", id))
+	err := m.db.Delete(group, id)
+	end(err)
+	return err
+}
+
+// tracedPlaces выполняет запросы к местам хранилища в отдельных span.
+type tracedPlaces struct {
+	ctx context.Context
+	db  *model.Places
+}
+
+// List возвращает список мест группы.
+func (m tracedPlaces) List(group string) ([]model.Place, error) {
+	end := startOperation(m.ctx, "model.Places.List", attribute.String("group", group))
+	places, err := m.db.List(group)
+	end(err)
+	return places, err
+}
+
+// Get возвращает место группы с указанным идентификатором.
+func (m tracedPlaces) Get(group, id string) (*model.Place, error) {
+	end := startOperation(m.ctx, "model.Places.Get", attribute.String("group", group),
+		attribute.String("id", id))
+	place, err := m.db.Get(group, id)
+	end(err)
+	return place, err
+}
+
+// Create добавляет новое место в группу.
+func (m tracedPlaces) Create(group string, place *model.Place) error {
+	end := startOperation(m.ctx, "model.Places.Create", attribute.String("group", group))
+	err := m.db.Create(group, place)
+	end(err)
+	return err
+}
+
+// Update сохраняет измененное описание места группы.
+func (m tracedPlaces) Update(group string, place *model.Place) error {
+	end := startOperation(m.ctx, "model.Places.Update", attribute.String("group", group),
+		attribute.String("id", place.ID))
+	err := m.db.Update(group, place)
+	end(err)
+	return err
+}
+
+// Delete удаляет место группы.
+func (m tracedPlaces) Delete(group, id string) error {
+	end := startOperation(m.ctx, "model.Places.Delete", attribute.String("group", group),
+		attribute.String("id", id))
+	err := m.db.Delete(group, id)
+	end(err)
+	return err
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mdigger/rest"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// testTracing включает трассировку с сохранением данных в памяти до
+// окончания теста.
+func testTracing(t *testing.T) *tracetest.InMemoryExporter {
+	provider, propagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	t.Cleanup(func() {
+		otel.SetTracerProvider(provider)
+		otel.SetTextMapPropagator(propagator)
+	})
+	exporter := tracetest.NewInMemoryExporter()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return exporter
+}
+
+func TestTraced(t *testing.T) {
+	exporter := testTracing(t)
+	handler := Traced(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, span := startSpan(r.Context(), "child")
+		span.End()
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	r := httptest.NewRequest("GET", "/api/v0/places", nil)
+	r.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	spans := exporter.GetSpans()
+	if len(spans) != 2 {
+		t.Fatalf("bad spans count: %d", len(spans))
+	}
+	child, server := spans[0], spans[1]
+	if server.SpanKind != trace.SpanKindServer || server.Name != "GET" {
+		t.Errorf("bad server span: %s %v", server.Name, server.SpanKind)
+	}
+	if id := server.SpanContext.TraceID().String(); id != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("trace context not propagated: %s", id)
+	}
+	if server.Parent.SpanID().String() != "00f067aa0ba902b7" {
+		t.Errorf("bad server span parent: %s", server.Parent.SpanID())
+	}
+	if child.Parent.SpanID() != server.SpanContext.SpanID() {
+		t.Errorf("child span is not nested")
+	}
+	if server.Status.Code != codes.Error {
+		t.Errorf("bad server span status: %v", server.Status.Code)
+	}
+}
+
+func TestHandlerSpan(t *testing.T) {
+	exporter := testTracing(t)
+	// название span не зависит от оберток вокруг обработчика
+	handler := Route("group", func(c *rest.Context) error {
+		return traceHandler(c, Roles(func(c *rest.Context) error {
+			return c.Send(nil)
+		}, RoleOwner))
+	})
+	r := httptest.NewRequest("GET", "/api/v0/group", nil)
+	c := &rest.Context{Request: r, ResponseWriter: httptest.NewRecorder()}
+	c.SetData(ctxType(99), &Token{Type: "user", Role: RoleOwner})
+	if err := handler(c); err != nil {
+		t.Fatal(err)
+	}
+	spans := exporter.GetSpans()
+	if len(spans) != 1 || spans[0].Name != "handler GET group" {
+		t.Errorf("bad handler spans: %v", spans)
+	}
+}
+
+func TestRequestTracing(t *testing.T) {
+	token, err := getUserToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	exporter := testTracing(t)
+	if _, err := request(TestRequest{"Список мест", "GET", "places", nil, 200}, token); err != nil {
+		t.Fatal(err)
+	}
+	spans := make(map[string]tracetest.SpanStub)
+	for _, span := range exporter.GetSpans() {
+		spans[span.Name] = span
+	}
+	root, ok := spans["GET places"]
+	if !ok {
+		t.Fatalf("request span not found: %v", spans)
+	}
+	for _, name := range []string{"TokenTemplate.Get", "handler GET places", "model.Places.List"} {
+		span, ok := spans[name]
+		if !ok {
+			t.Errorf("span %s not found", name)
+		} else if span.SpanContext.TraceID() != root.SpanContext.TraceID() {
+			t.Errorf("span %s from other trace", name)
+		}
+	}
+	// обработчик выполняется после проверки токена, а не внутри нее
+	for _, name := range []string{"TokenTemplate.Get", "handler GET places"} {
+		if spans[name].Parent.SpanID() != root.SpanContext.SpanID() {
+			t.Errorf("span %s is not nested in request span", name)
+		}
+	}
+}
+
+func TestCollTracing(t *testing.T) {
+	token, err := getUserToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	exporter := testTracing(t)
+	if _, err := request(TestRequest{"Список подписок", "GET", "webhooks", nil, 200}, token); err != nil {
+		t.Fatal(err)
+	}
+	spans := make(map[string]tracetest.SpanStub)
+	for _, span := range exporter.GetSpans() {
+		spans[span.Name] = span
+	}
+	handler, ok := spans["handler GET webhooks"]
+	if !ok {
+		t.Fatalf("handler span not found: %v", spans)
+	}
+	// работа с коллекцией выполняется внутри обработчика
+	span, ok := spans["mongodb.webhooks"]
+	if !ok {
+		t.Fatal("collection span not found")
+	}
+	if span.Parent.SpanID() != handler.SpanContext.SpanID() {
+		t.Error("collection span is not nested in handler span")
+	}
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/geotrace/geo"
+	"github.com/geotrace/model"
+	"github.com/mdigger/rest"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var (
+	// радиус, в пределах которого устройство считается стоящим на месте
+	stopRadius = 50.0
+	// минимальная продолжительность остановки
+	stopDuration = time.Minute * 5
+	// точность упрощения трека в метрах по умолчанию
+	trackTolerance = 10.0
+	// период, за который строится трек по умолчанию
+	trackPeriod = time.Hour * 24
+	// максимальный период, за который можно построить трек
+	trackPeriodMax = time.Hour * 24 * 31
+	// максимальное количество событий в треке
+	trackEventsMax = 100000
+)
+
+// Track описывает маршрут устройства за указанный период времени, разбитый на
+// поездки и остановки.
+type Track struct {
+	Device string    `json:"device"`
+	From   time.Time `json:"from"`
+	To     time.Time `json:"to"`
+	Trips  []*Trip   `json:"trips"`
+	Stops  []*Stop   `json:"stops"`
+}
+
+// Trip описывает поездку между двумя остановками. Расстояние указывается в
+// метрах, продолжительность — в секундах, а скорость — в метрах в секунду.
+type Trip struct {
+	Start    time.Time   `json:"start"`
+	End      time.Time   `json:"end"`
+	Distance float64     `json:"distance"`
+	Duration float64     `json:"duration"`
+	AvgSpeed float64     `json:"avgSpeed"`
+	MaxSpeed float64     `json:"maxSpeed"`
+	Points   []geo.Point `json:"points"`
+	Times    []time.Time `json:"-"` // время каждой точки для экспорта
+}
+
+// Stop описывает остановку устройства.
+type Stop struct {
+	Location geo.Point `json:"location"`
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Duration float64   `json:"duration"`
+}
+
+// TrackGet возвращает упрощенный маршрут устройства за указанный период,
+// разбитый на поездки. Период задается параметрами from и to в формате
+// RFC 3339, а точность упрощения в метрах — параметром tolerance. Маршрут
+// может быть экспортирован в форматах GeoJSON, GPX и KML.
+func (s *Store) TrackGet(c *rest.Context) error {
+	token := GetToken(c)
+	if token == nil {
+		return ErrBadToken
+	}
+	format := exportFormat(c)
+	if _, ok := exportFormats[format]; format != "" && !ok {
+		return sendProblem(c, http.StatusNotAcceptable, "unsupported format")
+	}
+	query := c.Request.URL.Query()
+	to, from := time.Now().UTC(), time.Time{}
+	var err error
+	if value := query.Get("to"); value != "" {
+		if to, err = time.Parse(time.RFC3339, value); err != nil {
+			return sendProblem(c, http.StatusBadRequest, "bad to parameter")
+		}
+	}
+	if value := query.Get("from"); value != "" {
+		if from, err = time.Parse(time.RFC3339, value); err != nil {
+			return sendProblem(c, http.StatusBadRequest, "bad from parameter")
+		}
+	} else {
+		from = to.Add(-trackPeriod)
+	}
+	if from.After(to) {
+		return sendProblem(c, http.StatusBadRequest, "from must be before to")
+	}
+	if to.Sub(from) > trackPeriodMax {
+		return sendProblem(c, http.StatusBadRequest, fmt.Sprintf(
+			"period must be at most %d days", trackPeriodMax/(time.Hour*24)))
+	}
+	tolerance := trackTolerance
+	if value := query.Get("tolerance"); value != "" {
+		if tolerance, err = strconv.ParseFloat(value, 64); err != nil || tolerance < 0 {
+			return sendProblem(c, http.StatusBadRequest, "bad tolerance parameter")
+		}
+	}
+	device, err := s.device(c.Request.Context(), token.Group, c.Param("device-id"))
+	if err == model.ErrNotFound {
+		return notFound(c)
+	}
+	if err != nil {
+		return err
+	}
+	events, err := s.trackEvents(token.Group, device.ID, from, to)
+	if err != nil {
+		return err
+	}
+	if len(events) > trackEventsMax {
+		return sendProblem(c, http.StatusBadRequest, fmt.Sprintf(
+			"period contains more than %d events", trackEventsMax))
+	}
+	track := BuildTrack(events, tolerance)
+	track.Device = device.ID
+	track.From, track.To = from, to
+	var data []byte
+	switch format {
+	case "geojson":
+		data, err = TrackGeoJSON(track)
+	case "gpx":
+		data, err = TrackGPX(track)
+	case "kml":
+		data, err = TrackKML(track)
+	default:
+		return c.Send(track)
+	}
+	if err != nil {
+		return err
+	}
+	return sendExport(c, format, data)
+}
+
+// trackEvents возвращает события устройства за указанный период в порядке
+// их возникновения. Возвращается не больше trackEventsMax+1 событий, чтобы
+// можно было определить, что их больше допустимого.
+func (s *Store) trackEvents(group, device string, from, to time.Time) ([]*Event, error) {
+	session, coll := s.coll("events")
+	defer session.Close()
+	var events []*Event
+	err := coll.Find(bson.M{
+		"group":  group,
+		"device": device,
+		"time":   bson.M{"$gte": from, "$lte": to},
+	}).Sort("time").Limit(trackEventsMax + 1).All(&events)
+	return events, err
+}
+
+// BuildTrack разбивает события на поездки с помощью определения остановок и
+// упрощает маршрут каждой поездки с заданной точностью в метрах.
+func BuildTrack(events []*Event, tolerance float64) *Track {
+	var track = &Track{
+		Trips: make([]*Trip, 0),
+		Stops: make([]*Stop, 0),
+	}
+	var start int // начало текущей поездки
+	for i := 0; i < len(events); {
+		// ищем последнюю точку, находящуюся в радиусе остановки
+		j := i
+		for j+1 < len(events) &&
+			Distance(events[i].Location, events[j+1].Location) <= stopRadius {
+			j++
+		}
+		if events[j].Time.Sub(events[i].Time) < stopDuration {
+			i++
+			continue
+		}
+		if trip := newTrip(events[start : i+1]); trip != nil {
+			track.Trips = append(track.Trips, trip)
+		}
+		track.Stops = append(track.Stops, &Stop{
+			Location: events[i].Location,
+			Start:    events[i].Time,
+			End:      events[j].Time,
+			Duration: events[j].Time.Sub(events[i].Time).Seconds(),
+		})
+		start, i = j, j+1
+	}
+	if len(events) > 0 {
+		if trip := newTrip(events[start:]); trip != nil {
+			track.Trips = append(track.Trips, trip)
+		}
+	}
+	for _, trip := range track.Trips {
+		keep := simplifyKeep(trip.Points, tolerance)
+		if keep == nil {
+			continue
+		}
+		var points, times = trip.Points[:0], trip.Times[:0]
+		for i := range keep {
+			if keep[i] {
+				points = append(points, trip.Points[i])
+				times = append(times, trip.Times[i])
+			}
+		}
+		trip.Points, trip.Times = points, times
+	}
+	return track
+}
+
+// newTrip возвращает описание поездки по списку событий. Если событий меньше
+// двух, то возвращается nil.
+func newTrip(events []*Event) *Trip {
+	if len(events) < 2 {
+		return nil
+	}
+	trip := &Trip{
+		Start:  events[0].Time,
+		End:    events[len(events)-1].Time,
+		Points: make([]geo.Point, len(events)),
+		Times:  make([]time.Time, len(events)),
+	}
+	for i, event := range events {
+		trip.Points[i], trip.Times[i] = event.Location, event.Time
+		if i == 0 {
+			continue
+		}
+		d := Distance(events[i-1].Location, event.Location)
+		trip.Distance += d
+		if dt := event.Time.Sub(events[i-1].Time).Seconds(); dt > 0 {
+			trip.MaxSpeed = math.Max(trip.MaxSpeed, d/dt)
+		}
+	}
+	trip.Duration = trip.End.Sub(trip.Start).Seconds()
+	if trip.Duration > 0 {
+		trip.AvgSpeed = trip.Distance / trip.Duration
+	}
+	return trip
+}
+
+// Simplify упрощает ломаную линию алгоритмом Дугласа-Пекера. Точность
+// задается в метрах.
+func Simplify(points []geo.Point, tolerance float64) []geo.Point {
+	keep := simplifyKeep(points, tolerance)
+	if keep == nil {
+		return points
+	}
+	var result = make([]geo.Point, 0, len(points))
+	for i, p := range points {
+		if keep[i] {
+			result = append(result, p)
+		}
+	}
+	return result
+}
+
+// simplifyKeep отмечает точки, которые остаются после упрощения ломаной
+// линии. Если упрощение не требуется, то возвращает nil.
+func simplifyKeep(points []geo.Point, tolerance float64) []bool {
+	if len(points) < 3 || tolerance <= 0 {
+		return nil
+	}
+	// переводим координаты в метры относительно первой точки
+	var (
+		origin = points[0]
+		kx     = math.Pi / 180 * earthRadius * math.Cos(origin[1]*math.Pi/180)
+		ky     = math.Pi / 180 * earthRadius
+		xy     = make([][2]float64, len(points))
+	)
+	for i, p := range points {
+		xy[i] = [2]float64{(p[0] - origin[0]) * kx, (p[1] - origin[1]) * ky}
+	}
+	var keep = make([]bool, len(points))
+	keep[0], keep[len(points)-1] = true, true
+	var stack = [][2]int{{0, len(points) - 1}}
+	for len(stack) > 0 {
+		first, last := stack[len(stack)-1][0], stack[len(stack)-1][1]
+		stack = stack[:len(stack)-1]
+		var index, max = 0, 0.0
+		for i := first + 1; i < last; i++ {
+			if d := segmentDistance(xy[i], xy[first], xy[last]); d > max {
+				index, max = i, d
+			}
+		}
+		if max > tolerance {
+			keep[index] = true
+			stack = append(stack, [2]int{first, index}, [2]int{index, last})
+		}
+	}
+	return keep
+}
+
+// segmentDistance возвращает расстояние от точки p до отрезка ab на
+// плоскости.
+func segmentDistance(p, a, b [2]float64) float64 {
+	dx, dy := b[0]-a[0], b[1]-a[1]
+	if dx != 0 || dy != 0 {
+		t := ((p[0]-a[0])*dx + (p[1]-a[1])*dy) / (dx*dx + dy*dy)
+		if t > 1 {
+			a = b
+		} else if t > 0 {
+			a = [2]float64{a[0] + dx*t, a[1] + dy*t}
+		}
+	}
+	return math.Hypot(p[0]-a[0], p[1]-a[1])
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/geotrace/geo"
+)
+
+func TestSimplify(t *testing.T) {
+	// почти прямая линия вдоль экватора с небольшим отклонением
+	points := []geo.Point{{0, 0}, {0.001, 0.00001}, {0.002, 0}, {0.003, 0.001}, {0.004, 0}}
+	result := Simplify(points, 5)
+	if len(result) != 4 {
+		t.Errorf("bad simplified length: %v", result)
+	}
+	if result[0] != points[0] || result[len(result)-1] != points[len(points)-1] {
+		t.Error("end points must be kept")
+	}
+	if len(Simplify(points, 0)) != len(points) {
+		t.Error("zero tolerance must keep all points")
+	}
+}
+
+func TestBuildTrack(t *testing.T) {
+	start := time.Date(2016, 1, 1, 10, 0, 0, 0, time.UTC)
+	var events []*Event
+	add := func(minute int, lon float64) {
+		events = append(events, &Event{
+			Time:     start.Add(time.Duration(minute) * time.Minute),
+			Location: geo.Point{lon, 55},
+		})
+	}
+	// первая поездка
+	for i := 0; i < 5; i++ {
+		add(i, 37+float64(i)*0.01)
+	}
+	// остановка на 10 минут
+	for i := 5; i < 15; i++ {
+		add(i, 37.04)
+	}
+	// вторая поездка
+	for i := 15; i < 20; i++ {
+		add(i, 37.04+float64(i-14)*0.01)
+	}
+	track := BuildTrack(events, 10)
+	if len(track.Trips) != 2 {
+		t.Fatalf("bad trips count: %d", len(track.Trips))
+	}
+	if len(track.Stops) != 1 {
+		t.Fatalf("bad stops count: %d", len(track.Stops))
+	}
+	if track.Stops[0].Duration != 600 {
+		t.Errorf("bad stop duration: %f", track.Stops[0].Duration)
+	}
+	for _, trip := range track.Trips {
+		if trip.Distance <= 0 || trip.AvgSpeed <= 0 || trip.MaxSpeed < trip.AvgSpeed*0.999 {
+			t.Errorf("bad trip: %+v", trip)
+		}
+		if len(trip.Points) != 2 { // прямые участки упрощаются до концов
+			t.Errorf("bad trip points: %v", trip.Points)
+		}
+		if len(trip.Times) != 2 || !trip.Times[0].Equal(trip.Start) ||
+			!trip.Times[1].Equal(trip.End) {
+			t.Errorf("bad trip times: %v", trip.Times)
+		}
+	}
+	if len(BuildTrack(nil, 10).Trips) != 0 {
+		t.Error("empty track must have no trips")
+	}
+}
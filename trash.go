@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"time"
+
+	"github.com/geotrace/model"
+	"github.com/mdigger/rest"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// время хранения удаленных мест и устройств в корзине
+var trashRetention = time.Hour * 24 * 30
+
+// TrashItem описывает удаленное место или устройство, которое можно
+// восстановить до истечения срока хранения.
+type TrashItem struct {
+	ID      string        `bson:"_id" json:"id"`
+	Group   string        `bson:"group" json:"-"`
+	Kind    string        `bson:"kind" json:"kind"`
+	Target  string        `bson:"target" json:"target"`
+	Name    string        `bson:"name,omitempty" json:"name,omitempty"`
+	By      string        `bson:"by,omitempty" json:"by,omitempty"`
+	Deleted time.Time     `bson:"deleted" json:"deleted"`
+	Expires time.Time     `bson:"expires" json:"expires"`
+	Place   *PlaceInfo    `bson:"place,omitempty" json:"place,omitempty"`
+	Device  *model.Device `bson:"device,omitempty" json:"device,omitempty"`
+}
+
+// toTrash сохраняет удаляемое место или устройство в корзине группы.
+func (s *Store) toTrash(ctx context.Context, token *Token, item *TrashItem) error {
+	item.ID = bson.NewObjectId().Hex()
+	item.Group = token.Group
+	item.By = token.Id
+	item.Deleted = time.Now().UTC()
+	item.Expires = item.Deleted.Add(trashRetention)
+	session, coll := s.collContext(ctx, "trash")
+	defer session.Close()
+	return coll.Insert(item)
+}
+
+// dropTrash удаляет из корзины запись, сохраненную перед удалением места или
+// устройства, если само удаление не удалось.
+func (s *Store) dropTrash(item *TrashItem) {
+	session, coll := s.coll("trash")
+	defer session.Close()
+	if err := coll.RemoveId(item.ID); err != nil && err != mgo.ErrNotFound {
+		llog.Error("Error remove trash item", "id", item.ID, "err", err)
+	}
+}
+
+// TrashList возвращает список удаленных мест и устройств группы. С
+// параметром kind возвращаются только места (place) или устройства (device).
+func (s *Store) TrashList(c *rest.Context) error {
+	token := GetToken(c)
+	if token == nil {
+		return ErrBadToken
+	}
+	var query = bson.M{"group": token.Group}
+	if kind := c.Request.URL.Query().Get("kind"); kind != "" {
+		query["kind"] = kind
+	}
+	session, coll := s.collContext(c.Request.Context(), "trash")
+	defer session.Close()
+	var items = make([]*TrashItem, 0)
+	if err := coll.Find(query).Sort("-deleted").All(&items); err != nil {
+		return err
+	}
+	return sendTotal(c, items)
+}
+
+// TrashRestore восстанавливает удаленное место или устройство из корзины с
+// прежним идентификатором. Элемент сначала забирается из корзины, поэтому
+// одновременные запросы не восстановят его дважды; если восстановить не
+// удалось, то он возвращается в корзину. Пароль устройства в корзине не
+// хранится: восстановленное устройство получает новый пароль, который
+// возвращается в ответе.
+func (s *Store) TrashRestore(c *rest.Context) error {
+	token := GetToken(c)
+	if token == nil {
+		return ErrBadToken
+	}
+	session, coll := s.collContext(c.Request.Context(), "trash")
+	defer session.Close()
+	var item = new(TrashItem)
+	_, err := coll.Find(bson.M{"_id": c.Param("item-id"), "group": token.Group}).
+		Apply(mgo.Change{Remove: true}, item)
+	if err == mgo.ErrNotFound {
+		return notFound(c)
+	}
+	if err != nil {
+		return err
+	}
+	var result = rest.JSON{"id": item.Target}
+	switch {
+	case item.Place != nil:
+		err = s.restorePlace(c.Request.Context(), token.Group, item.Place)
+	case item.Device != nil:
+		var password string
+		if password, err = s.restoreDevice(c, token.Group, item.Device); err == nil {
+			result["password"] = password
+		}
+	}
+	if err != nil {
+		if err := coll.Insert(item); err != nil {
+			llog.Error("Error return item to trash", "id", item.ID, "err", err)
+		}
+		if mgo.IsDup(err) {
+			return sendProblem(c, http.StatusConflict, item.Kind+" already exists")
+		}
+		return err
+	}
+	s.audit(c, item.Kind+".restore", item.Target, nil, nil)
+	return c.Status(http.StatusCreated).Send(result)
+}
+
+// restorePlace восстанавливает место с прежним идентификатором вместе с
+// расписанием и получателями уведомлений. Место сохраняется напрямую в
+// коллекции библиотеки model, потому что при создании через нее место
+// получает новый идентификатор.
+func (s *Store) restorePlace(ctx context.Context, group string, info *PlaceInfo) error {
+	place := &info.Place
+	place.GroupID = group
+	session, coll := s.collContext(ctx, placesSource.coll)
+	defer session.Close()
+	if err := coll.Insert(place); err != nil {
+		return err
+	}
+	var set = bson.M{"version": 1}
+	if info.Schedule != nil {
+		set["schedule"] = info.Schedule
+	}
+	if len(info.Devices) > 0 {
+		set["devices"] = info.Devices
+	}
+	if len(info.Users) > 0 {
+		set["users"] = info.Users
+	}
+	if err := s.setPlaceMeta(group, place.ID, set); err != nil {
+		coll.RemoveId(place.ID)
+		return err
+	}
+	s.indexPlace(ctx, group, place)
+	return nil
+}
+
+// restoreDevice восстанавливает устройство с новым паролем и возвращает этот
+// пароль.
+func (s *Store) restoreDevice(c *rest.Context, group string, device *model.Device) (string, error) {
+	key := make([]byte, 12)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	password := hex.EncodeToString(key)
+	device.Password = model.NewPassword(password)
+	err := s.model(c.Request.Context()).Devices.Create(group, device)
+	device.Password = nil // элемент может вернуться в корзину
+	return password, err
+}
+
+// TrashDelete окончательно удаляет место или устройство из корзины.
+func (s *Store) TrashDelete(c *rest.Context) error {
+	token := GetToken(c)
+	if token == nil {
+		return ErrBadToken
+	}
+	session, coll := s.collContext(c.Request.Context(), "trash")
+	defer session.Close()
+	err := coll.Remove(bson.M{"_id": c.Param("item-id"), "group": token.Group})
+	if err == mgo.ErrNotFound {
+		return notFound(c)
+	}
+	if err != nil {
+		return err
+	}
+	s.audit(c, "trash.delete", c.Param("item-id"), nil, nil)
+	return c.Send(nil)
+}
+
+// PurgeTrash периодически окончательно удаляет из корзины места и
+// устройства с истекшим сроком хранения.
+func (s *Store) PurgeTrash(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := s.purgeTrash(); err != nil {
+			llog.Error("Error purge trash", "err", err)
+		}
+	}
+}
+
+// purgeTrash удаляет из корзины места и устройства с истекшим сроком
+// хранения.
+func (s *Store) purgeTrash() error {
+	session, coll := s.coll("trash")
+	defer session.Close()
+	info, err := coll.RemoveAll(bson.M{"expires": bson.M{"$lt": time.Now()}})
+	if err != nil {
+		return err
+	}
+	if info.Removed > 0 {
+		llog.Info("Trash purged", "removed", info.Removed)
+	}
+	return nil
+}
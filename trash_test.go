@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/geotrace/geo"
+	"github.com/mdigger/rest"
+)
+
+func TestTrash(t *testing.T) {
+	token, err := getUserToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := request(TestRequest{
+		"Создание места для удаления в корзину",
+		"POST",
+		"places",
+		rest.JSON{
+			"name": "test_trash_place",
+			"circle": rest.JSON{
+				"center": geo.Point{88, 55},
+				"radius": 100,
+			},
+		},
+		201,
+	}, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var created struct {
+		ID string `json:"id"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := request(TestRequest{
+		"Удаление места в корзину",
+		"DELETE",
+		fmt.Sprintf("places/%s", created.ID),
+		nil,
+		204,
+	}, token); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err = request(TestRequest{
+		"Получение списка удаленных мест",
+		"GET",
+		"trash?kind=place",
+		nil,
+		200,
+	}, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var items []TrashItem
+	if err := json.NewDecoder(resp.Body).Decode(&items); err != nil {
+		t.Fatal(err)
+	}
+	var item *TrashItem
+	for i := range items {
+		if items[i].Target == created.ID {
+			item = &items[i]
+		}
+	}
+	if item == nil {
+		t.Fatal("deleted place not found in trash")
+	}
+	if item.Place == nil || item.Place.Name != "test_trash_place" {
+		t.Error("bad deleted place data")
+	}
+
+	resp, err = request(TestRequest{
+		"Восстановление места из корзины",
+		"POST",
+		fmt.Sprintf("trash/%s", item.ID),
+		nil,
+		201,
+	}, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var restored struct {
+		ID string `json:"id"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&restored); err != nil {
+		t.Fatal(err)
+	}
+	if restored.ID != created.ID {
+		t.Errorf("restored place must keep its id: %s != %s", restored.ID, created.ID)
+	}
+	for _, test := range []TestRequest{
+		{
+			"Получение восстановленного места",
+			"GET",
+			fmt.Sprintf("places/%s", created.ID),
+			nil,
+			200,
+		},
+		{
+			"Ошибка повторного восстановления места",
+			"POST",
+			fmt.Sprintf("trash/%s", item.ID),
+			nil,
+			404,
+		},
+		{
+			"Ошибка удаления несуществующего элемента корзины",
+			"DELETE",
+			"trash/bad_item",
+			nil,
+			404,
+		},
+	} {
+		if _, err := request(test, token); err != nil {
+			t.Error(err)
+		}
+	}
+}
@@ -1,22 +1,224 @@
 package main
 
 import (
+	"context"
+	"net/http"
+
 	"github.com/geotrace/model"
 	"github.com/mdigger/rest"
+	"gopkg.in/mgo.v2/bson"
 )
 
+// UserInfo описывает пользователя группы вместе с его ролью, состоянием и
+// профилем.
+type UserInfo struct {
+	model.User `bson:",inline"`
+	Role       string   `json:"role"`
+	Disabled   bool     `json:"disabled,omitempty"`
+	Profile    *Profile `json:"profile,omitempty"`
+}
+
 // UsersList возвращает список пользователей, которые входят в ту же группу.
+// Список поддерживает постраничный вывод, сортировку и фильтрацию (см.
+// ListQuery).
 func (s *Store) UsersList(c *rest.Context) error {
 	token := GetToken(c)
 	if token == nil {
 		return ErrBadToken
 	}
-	users, err := (*model.Users)(s.db).List(token.Group)
+	query, err := parseListQuery(c)
+	if err != nil {
+		return err
+	}
+	if !query.Supports(usersSource) {
+		users, err := s.users(c.Request.Context(), token.Group)
+		if err != nil {
+			return err
+		}
+		return sendList(c, query, users, usersSource.Key())
+	}
+	members, err := s.members(token.Group)
+	if err != nil {
+		return err
+	}
+	var users = make([]model.User, 0)
+	page, err := query.Find(s, usersSource, usersFilter(token.Group, members), &users)
+	if err != nil {
+		return err
+	}
+	return sendPage(c, users, page)
+}
+
+// usersFilter возвращает условие выборки пользователей группы: пользователей,
+// для которых она основная, кроме удаленных из нее, и участников группы.
+func usersFilter(group string, members []*Membership) bson.M {
+	var removed, logins = make([]string, 0), make([]string, 0)
+	for _, member := range members {
+		if member.Removed {
+			removed = append(removed, member.Login)
+		} else {
+			logins = append(logins, member.Login)
+		}
+	}
+	_, login := usersSource.names(usersSource.key)
+	primary := usersSource.Group(group)
+	if len(removed) > 0 {
+		primary[login] = bson.M{"$nin": removed}
+	}
+	return bson.M{"$or": []bson.M{primary, {login: bson.M{"$in": logins}}}}
+}
+
+// users возвращает список пользователей группы, включая пользователей, для
+// которых она не является основной.
+func (s *Store) users(ctx context.Context, group string) ([]model.User, error) {
+	list, err := s.model(ctx).Users.List(group)
+	if err != nil && err != model.ErrNotFound {
+		return nil, err
+	}
+	members, err := s.members(group)
+	if err != nil {
+		return nil, err
+	}
+	var removed = make(map[string]bool) // удаленные из основной группы
+	for _, member := range members {
+		if member.Removed {
+			removed[member.Login] = true
+		}
+	}
+	var users = make([]model.User, 0, len(list))
+	for _, user := range list {
+		if !removed[user.Login] {
+			users = append(users, user)
+		}
+	}
+	for _, member := range members {
+		if member.Removed {
+			continue
+		}
+		user, err := s.model(ctx).Users.Login(member.Login)
+		if err == model.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if user.GroupID != group {
+			users = append(users, *user)
+		}
+	}
+	return users, nil
+}
+
+// user возвращает описание пользователя группы: пользователь должен входить
+// в группу как в основную или как участник.
+func (s *Store) user(ctx context.Context, group, login string) (*model.User, error) {
+	user, err := s.model(ctx).Users.Login(login)
+	if isNotFound(err) {
+		return nil, model.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err := s.membership(user, group); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// groupUser возвращает пользователя группы из запроса и его участие в
+// группе. Если пользователь не входит в группу из токена, то в ответ уже
+// отправлена ошибка 404 и возвращается nil.
+func (s *Store) groupUser(c *rest.Context) (*model.User, *Membership, error) {
+	token := GetToken(c)
+	if token == nil {
+		return nil, nil, ErrBadToken
+	}
+	user, err := s.user(c.Request.Context(), token.Group, c.Param("login"))
 	if err == model.ErrNotFound {
-		return c.Send(rest.ErrNotFound)
+		return nil, nil, notFound(c)
 	}
 	if err != nil {
+		return nil, nil, err
+	}
+	member, err := s.membership(user, token.Group)
+	if err != nil {
+		return nil, nil, err
+	}
+	return user, member, nil
+}
+
+// UserGet возвращает описание пользователя группы с его ролью и профилем.
+func (s *Store) UserGet(c *rest.Context) error {
+	user, member, err := s.groupUser(c)
+	if user == nil {
+		return err
+	}
+	profile, err := s.profile(user)
+	if err != nil {
+		return err
+	}
+	return sendFields(c, &UserInfo{
+		User:     *user,
+		Role:     member.Role,
+		Disabled: member.Disabled,
+		Profile:  profile,
+	})
+}
+
+// UserRole изменяет роль пользователя в группе. Роль владельца группы
+// изменяется только при передаче владения группой.
+func (s *Store) UserRole(c *rest.Context) error {
+	user, member, err := s.groupUser(c)
+	if user == nil {
+		return err
+	}
+	var data struct {
+		Role string `json:"role"`
+	}
+	if err := bind(c, &data); err != nil {
 		return err
 	}
-	return c.Send(users)
+	if !validRole(data.Role) || data.Role == RoleOwner {
+		return sendProblem(c, http.StatusBadRequest, "bad role")
+	}
+	if member.Role == RoleOwner {
+		return sendProblem(c, http.StatusConflict, "group owner role can't be changed")
+	}
+	if err := s.updateMember(member, bson.M{"role": data.Role}); err != nil {
+		return err
+	}
+	s.audit(c, "user.role", user.Login,
+		rest.JSON{"role": member.Role}, rest.JSON{"role": data.Role})
+	return c.Send(nil)
+}
+
+// UserDisable запрещает пользователю работу с группой. Уже выданные токены
+// перестают действовать сразу (см. CheckToken).
+func (s *Store) UserDisable(c *rest.Context) error {
+	return s.userDisabled(c, true)
+}
+
+// UserEnable снова разрешает пользователю работу с группой.
+func (s *Store) UserEnable(c *rest.Context) error {
+	return s.userDisabled(c, false)
+}
+
+// userDisabled изменяет состояние пользователя в группе.
+func (s *Store) userDisabled(c *rest.Context, disabled bool) error {
+	user, member, err := s.groupUser(c)
+	if user == nil {
+		return err
+	}
+	if member.Role == RoleOwner {
+		return sendProblem(c, http.StatusConflict, "group owner can't be disabled")
+	}
+	if err := s.updateMember(member, bson.M{"disabled": disabled}); err != nil {
+		return err
+	}
+	action := "user.enable"
+	if disabled {
+		action = "user.disable"
+	}
+	s.audit(c, action, user.Login, nil, nil)
+	return c.Send(nil)
 }
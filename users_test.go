@@ -2,9 +2,11 @@ package main
 
 import (
 	"encoding/json"
+	"net/http"
 	"testing"
 
 	"github.com/geotrace/model"
+	"github.com/mdigger/rest"
 )
 
 func TestUsers(t *testing.T) {
@@ -38,3 +40,108 @@ func TestUsers(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestUserProfile(t *testing.T) {
+	token, err := getUserToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		TestRequest
+		contentType string
+	}{
+		{TestRequest{"Изменение профиля пользователя", "PUT", "user/profile",
+			rest.JSON{"name": "Test User", "email": "test@example.com",
+				"preferences": rest.JSON{"lang": "ru"}}, 204}, "application/json"},
+		{TestRequest{"Ошибка в адресе почты", "PUT", "user/profile",
+			rest.JSON{"email": "test"}, 400}, "application/json"},
+		{TestRequest{"Частичное изменение профиля", "PATCH", "user/profile",
+			rest.JSON{"phone": "+70000000000"}, 204}, MergePatchType},
+	} {
+		if _, err := requestWithHeader(test.TestRequest, token,
+			http.Header{"Content-Type": {test.contentType}}); err != nil {
+			t.Error(err)
+		}
+	}
+	resp, err := request(TestRequest{"Профиль пользователя", "GET",
+		"user/profile", nil, 200}, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var profile Profile
+	if err := json.NewDecoder(resp.Body).Decode(&profile); err != nil {
+		t.Fatal(err)
+	}
+	if profile.Login != "test" || profile.Email != "test@example.com" ||
+		profile.Phone != "+70000000000" || profile.Preferences["lang"] != "ru" {
+		t.Errorf("bad profile: %+v", profile)
+	}
+}
+
+func TestUserManagement(t *testing.T) {
+	token, err := getUserToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	member, err := getToken("user", "test3", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []TestRequest{
+		{"Описание пользователя группы", "GET", "users/test3", nil, 200},
+		{"Ошибка получения пользователя другой группы", "GET",
+			"users/bad_user", nil, 404},
+		{"Ошибка назначения роли владельца", "PUT", "users/test3/role",
+			rest.JSON{"role": RoleOwner}, 400},
+		{"Изменение роли пользователя", "PUT", "users/test3/role",
+			rest.JSON{"role": RoleMember}, 204},
+		{"Запрет работы пользователя", "PUT", "users/test3/disabled", nil, 204},
+	} {
+		if _, err := request(test, token); err != nil {
+			t.Error(err)
+		}
+	}
+	if _, err := getToken("user", "test3", "test"); err == nil {
+		t.Error("disabled user must not login")
+	}
+	if _, err := request(TestRequest{"Ошибка доступа с токеном, выданным до запрета",
+		"GET", "users", nil, 403}, member); err != nil {
+		t.Error(err)
+	}
+	for _, test := range []TestRequest{
+		{"Разрешение работы пользователя", "DELETE", "users/test3/disabled", nil, 204},
+		{"Восстановление роли пользователя", "PUT", "users/test3/role",
+			rest.JSON{"role": defaultRole}, 204},
+	} {
+		if _, err := request(test, token); err != nil {
+			t.Error(err)
+		}
+	}
+	if _, err := getToken("user", "test3", "test"); err != nil {
+		t.Error(err)
+	}
+
+	for _, test := range []struct {
+		TestRequest
+		token []byte
+	}{
+		{TestRequest{"Удаление пользователя из основной группы", "DELETE",
+			"users/test3", nil, 204}, token},
+		{TestRequest{"Удаленный пользователь не входит в группу", "GET",
+			"users/test3", nil, 404}, token},
+		{TestRequest{"Ошибка доступа удаленного пользователя", "GET",
+			"users", nil, 403}, member},
+	} {
+		if _, err := request(test.TestRequest, test.token); err != nil {
+			t.Error(err)
+		}
+	}
+	// возвращаем пользователя в основную группу
+	if err := store.addMember("test_group", "test3", defaultRole); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := request(TestRequest{"Доступ возвращенного пользователя", "GET",
+		"users", nil, 200}, member); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/geotrace/geo"
+	"github.com/mdigger/rest"
+)
+
+// Ограничения на значения полей в запросах.
+var (
+	placeNameMax     = 200       // максимальная длина названия места
+	placeRadiusMin   = 10.0      // минимальный радиус круга места в метрах
+	placeRadiusMax   = 100000.0  // максимальный радиус круга места в метрах
+	polygonPointsMax = 1000      // максимальное количество точек контура
+	eventFutureMax   = time.Hour // допустимое опережение времени события
+	eventPowerMax    = 100       // максимальный заряд батареи в процентах
+
+	bodyMax int64 = 1 << 20 // максимальный размер тела запроса в JSON
+)
+
+// Validation накапливает ошибки в значениях полей запроса, чтобы вернуть их
+// все сразу одним ответом.
+type Validation []*FieldError
+
+// Add добавляет ошибку в значении поля.
+func (v *Validation) Add(field, code, message string) {
+	*v = append(*v, &FieldError{Field: field, Code: code, Message: message})
+}
+
+// Check добавляет ошибку, если условие ok не выполнено, и возвращает ok.
+func (v *Validation) Check(ok bool, field, code, message string) bool {
+	if !ok {
+		v.Add(field, code, message)
+	}
+	return ok
+}
+
+// Err возвращает ошибку запроса со списком ошибок в значениях полей или nil,
+// если ошибок нет.
+func (v Validation) Err() error {
+	if len(v) == 0 {
+		return nil
+	}
+	return NewProblem(http.StatusBadRequest, "validation_failed",
+		"request contains invalid fields", v...)
+}
+
+// bindStrict разбирает тело запроса в формате JSON в v. В отличие от bind,
+// поля, которые не описаны в v, считаются ошибкой. Ошибки типов значений и
+// неизвестные поля возвращаются как ошибки отдельных полей. Тело запроса
+// ограничено размером bodyMax и должно содержать только одно значение.
+// Тела запросов в других форматах разбираются с помощью bind с учетом их
+// типа содержимого, но без строгих проверок.
+func bindStrict(c *rest.Context, v interface{}) error {
+	data, err := readBody(c, bodyMax)
+	if err != nil {
+		return err
+	}
+	if !jsonContent(c.Request.Header.Get("Content-Type")) {
+		c.Request.Body = ioutil.NopCloser(bytes.NewReader(data))
+		return bind(c, v)
+	}
+	return decodeStrict(data, v)
+}
+
+// jsonContent возвращает true, если тип содержимого запроса не указан или
+// описывает JSON: application/json или тип с суффиксом +json.
+func jsonContent(contentType string) bool {
+	if contentType == "" {
+		return true
+	}
+	media, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return media == "application/json" || strings.HasSuffix(media, "+json")
+}
+
+// decodeStrict разбирает JSON из data в v по тем же правилам, что и
+// bindStrict.
+func decodeStrict(data []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(v)
+	if err == nil {
+		if _, err := decoder.Token(); err != io.EOF {
+			return NewProblem(http.StatusBadRequest, "bad_body",
+				"unexpected data after JSON value")
+		}
+		return nil
+	}
+	var errs Validation
+	if e, ok := err.(*json.UnmarshalTypeError); ok {
+		errs.Add(e.Field, "type", "must be "+e.Type.String())
+	} else if field, ok := unknownField(err); ok {
+		errs.Add(field, "unknown", "unknown field")
+	} else {
+		return NewProblem(http.StatusBadRequest, "bad_body", err.Error())
+	}
+	return errs.Err()
+}
+
+// unknownField возвращает название неизвестного поля из ошибки разбора JSON
+// с DisallowUnknownFields. Пакет encoding/json не описывает для нее
+// отдельный тип, поэтому поле берется из текста ошибки.
+func unknownField(err error) (string, bool) {
+	const prefix = "json: unknown field "
+	msg := err.Error()
+	if !strings.HasPrefix(msg, prefix) {
+		return "", false
+	}
+	field, err := strconv.Unquote(msg[len(prefix):])
+	if err != nil {
+		return "", false
+	}
+	return field, true
+}
+
+// validatePlace проверяет описание места: название, координаты и радиус
+// круга, точки многоугольника и расписание.
+func validatePlace(place *PlaceInfo) error {
+	var errs Validation
+	name := strings.TrimSpace(place.Name)
+	if errs.Check(name != "", "name", "required", "name is required") {
+		errs.Check(utf8.RuneCountInString(name) <= placeNameMax, "name", "too_long",
+			fmt.Sprintf("must be at most %d characters", placeNameMax))
+	}
+	switch {
+	case place.Circle == nil && place.Polygon == nil:
+		errs.Add("circle", "required", "circle or polygon is required")
+	case place.Circle != nil && place.Polygon != nil:
+		errs.Add("polygon", "conflict", "circle and polygon are mutually exclusive")
+	case place.Circle != nil:
+		errs.Check(validPoint(place.Circle.Center), "circle.center", "out_of_range",
+			"longitude must be within ±180 and latitude within ±90")
+		radius := place.Circle.Radius
+		errs.Check(radius >= placeRadiusMin && radius <= placeRadiusMax,
+			"circle.radius", "out_of_range", fmt.Sprintf(
+				"must be between %v and %v meters", placeRadiusMin, placeRadiusMax))
+	default:
+		validatePolygon(&errs, *place.Polygon)
+	}
+	if place.Schedule != nil {
+		if err := place.Schedule.Validate(); err != nil {
+			errs.Add("schedule", "invalid", err.Error())
+		}
+	}
+	return errs.Err()
+}
+
+// validatePolygon проверяет контуры многоугольника: в каждом должно быть не
+// меньше трех точек с допустимыми координатами.
+func validatePolygon(errs *Validation, polygon geo.Polygon) {
+	if !errs.Check(len(polygon) > 0, "polygon", "required", "polygon has no rings") {
+		return
+	}
+	for i, ring := range polygon {
+		field := fmt.Sprintf("polygon[%d]", i)
+		if !errs.Check(len(ring) >= 3 && len(ring) <= polygonPointsMax, field,
+			"bad_length", fmt.Sprintf("ring must have 3 to %d points", polygonPointsMax)) {
+			continue
+		}
+		for j, point := range ring {
+			errs.Check(validPoint(point), fmt.Sprintf("%s[%d]", field, j),
+				"out_of_range", "longitude must be within ±180 and latitude within ±90")
+		}
+	}
+}
+
+// validateEvents проверяет события устройства: координаты, время, точность
+// и заряд батареи. Координаты обязательны. Время события не может опережать
+// время сервера больше, чем на eventFutureMax.
+func validateEvents(events []*eventRequest, now time.Time) error {
+	var errs Validation
+	for i, event := range events {
+		field := fmt.Sprintf("[%d].", i)
+		if !errs.Check(event != nil, fmt.Sprintf("[%d]", i), "required",
+			"event is required") {
+			continue
+		}
+		if errs.Check(event.Location != nil, field+"location", "required",
+			"location is required") {
+			errs.Check(validPoint(*event.Location), field+"location", "out_of_range",
+				"longitude must be within ±180 and latitude within ±90")
+		}
+		errs.Check(!event.Time.After(now.Add(eventFutureMax)), field+"time", "future",
+			"time is too far in the future")
+		errs.Check(event.Accuracy >= 0, field+"accuracy", "out_of_range",
+			"must not be negative")
+		errs.Check(event.Power >= 0 && event.Power <= eventPowerMax, field+"power",
+			"out_of_range", fmt.Sprintf("must be between 0 and %d", eventPowerMax))
+	}
+	return errs.Err()
+}
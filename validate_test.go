@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/geotrace/geo"
+	"github.com/geotrace/model"
+	"github.com/mdigger/rest"
+)
+
+// fieldErrors возвращает список полей с ошибками.
+func fieldErrors(err error) []string {
+	problem, ok := err.(*Problem)
+	if !ok {
+		return nil
+	}
+	var fields []string
+	for _, field := range problem.Errors {
+		fields = append(fields, field.Field+":"+field.Code)
+	}
+	return fields
+}
+
+func TestValidatePlace(t *testing.T) {
+	circle := func(lon, lat, radius float64) *geo.Circle {
+		return &geo.Circle{Center: geo.Point{lon, lat}, Radius: radius}
+	}
+	for _, test := range []struct {
+		place  model.Place
+		fields []string
+	}{
+		{model.Place{Name: "ok", Circle: circle(37.6, 55.7, 100)}, nil},
+		{model.Place{Name: "ok", Polygon: &geo.Polygon{{{0, 0}, {1, 0}, {1, 1}, {0, 0}}}}, nil},
+		{model.Place{Name: " ", Circle: circle(37.6, 55.7, 100)}, []string{"name:required"}},
+		{model.Place{Name: strings.Repeat("я", placeNameMax+1), Circle: circle(37.6, 55.7, 100)},
+			[]string{"name:too_long"}},
+		{model.Place{Name: "no geometry"}, []string{"circle:required"}},
+		{model.Place{Name: "bad", Circle: circle(181, 91, 1)},
+			[]string{"circle.center:out_of_range", "circle.radius:out_of_range"}},
+		{model.Place{Name: "bad", Circle: circle(37.6, 55.7, placeRadiusMax+1)},
+			[]string{"circle.radius:out_of_range"}},
+		{model.Place{Name: "bad", Polygon: &geo.Polygon{{{0, 0}, {1, 0}}, {{0, 0}, {0, 95}, {1, 1}}}},
+			[]string{"polygon[0]:bad_length", "polygon[1][1]:out_of_range"}},
+		{model.Place{Name: "both", Circle: circle(37.6, 55.7, 100), Polygon: &geo.Polygon{}},
+			[]string{"polygon:conflict"}},
+	} {
+		fields := fieldErrors(validatePlace(&PlaceInfo{Place: test.place}))
+		if !reflect.DeepEqual(fields, test.fields) {
+			t.Errorf("%q: %v != %v", test.place.Name, fields, test.fields)
+		}
+	}
+}
+
+func TestValidateEvents(t *testing.T) {
+	now := time.Now()
+	point := &geo.Point{37.6, 55.7}
+	err := validateEvents([]*eventRequest{
+		{Event{Time: now, Accuracy: 5, Power: 50}, point},
+		{Event{Time: now.Add(eventFutureMax * 2)}, &geo.Point{-200, 55.7}},
+		{Event{Time: now.Add(-time.Hour), Accuracy: -1, Power: 101}, point},
+		{Event{Time: now}, nil},
+		nil,
+	}, now)
+	fields := fieldErrors(err)
+	expected := []string{"[1].location:out_of_range", "[1].time:future",
+		"[2].accuracy:out_of_range", "[2].power:out_of_range", "[3].location:required",
+		"[4]:required"}
+	if !reflect.DeepEqual(fields, expected) {
+		t.Errorf("%v != %v", fields, expected)
+	}
+}
+
+func TestBindStrict(t *testing.T) {
+	for _, test := range []struct {
+		body   string
+		code   string
+		fields []string
+	}{
+		{`{"name":"test"}`, "", nil},
+		{`{"name":"test","color":"red"}`, "validation_failed", []string{"color:unknown"}},
+		{`{"name":10}`, "validation_failed", []string{"name:type"}},
+		{`{"name":`, "bad_body", nil},
+		{`{"name":"test"} {"name":"other"}`, "bad_body", nil},
+		{`{"name":"test"}}`, "bad_body", nil},
+		{`{"name":"test"}` + "\n", "", nil},
+		{`{"name":"` + strings.Repeat("x", int(bodyMax)) + `"}`, "body_too_large", nil},
+	} {
+		req, _ := http.NewRequest("POST", "/test", strings.NewReader(test.body))
+		var place PlaceInfo
+		err := bindStrict(&rest.Context{Request: req}, &place)
+		if test.code == "" {
+			if err != nil {
+				t.Errorf("%s: %v", test.body, err)
+			}
+			continue
+		}
+		if err == nil || errorProblem(err).Code != test.code {
+			t.Errorf("%.40s: bad error %v", test.body, err)
+			continue
+		}
+		if fields := fieldErrors(err); !reflect.DeepEqual(fields, test.fields) {
+			t.Errorf("%s: %v != %v", test.body, fields, test.fields)
+		}
+	}
+}
+
+func TestJSONContent(t *testing.T) {
+	for contentType, ok := range map[string]bool{
+		"":                                true,
+		"application/json":                true,
+		"Application/JSON; charset=utf-8": true,
+		"application/merge-patch+json":    true,
+		"application/xml":                 false,
+		"application/x-msgpack":           false,
+		"text/plain":                      false,
+		"bad type;":                       false,
+	} {
+		if jsonContent(contentType) != ok {
+			t.Errorf("%q: must be %v", contentType, ok)
+		}
+	}
+}
+
+func TestUnknownField(t *testing.T) {
+	var v struct {
+		Name string `json:"name"`
+	}
+	for body, field := range map[string]string{
+		`{"color":"red"}`: "color",
+		`{"a \"b\"":1}`:   `a "b"`,
+		`{"name":1}`:      "",
+		`{"name":"test"`:  "",
+	} {
+		decoder := json.NewDecoder(strings.NewReader(body))
+		decoder.DisallowUnknownFields()
+		name, ok := unknownField(decoder.Decode(&v))
+		if name != field || ok != (field != "") {
+			t.Errorf("%s: %q %v", body, name, ok)
+		}
+	}
+}
+
+func TestPlaceValidation(t *testing.T) {
+	token, err := getUserToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := request(TestRequest{
+		"Ошибки в значениях полей нового места",
+		"POST",
+		"places",
+		rest.JSON{
+			"name": "",
+			"circle": rest.JSON{
+				"center": geo.Point{200, 55},
+				"radius": 0,
+			},
+		},
+		400,
+	}, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var problem Problem
+	err = json.NewDecoder(resp.Body).Decode(&problem)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := fieldErrors(&problem)
+	expected := []string{"name:required", "circle.center:out_of_range",
+		"circle.radius:out_of_range"}
+	if problem.Code != "validation_failed" || !reflect.DeepEqual(fields, expected) {
+		t.Errorf("bad problem: %+v", problem)
+	}
+	for _, test := range []TestRequest{
+		{"Неизвестное поле места", "POST", "places", rest.JSON{
+			"name":   "test_unknown_field",
+			"circle": rest.JSON{"center": geo.Point{88, 55}, "radius": 100},
+			"color":  "red",
+		}, 400},
+	} {
+		if _, err := request(test, token); err != nil {
+			t.Error(err)
+		}
+	}
+}
@@ -0,0 +1,455 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/mdigger/rest"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Типы событий, на которые можно подписаться.
+const (
+	EventGeofenceEnter = "geofence.enter" // устройство вошло в место
+	EventGeofenceExit  = "geofence.exit"  // устройство покинуло место
+	EventLowBattery    = "battery.low"    // низкий заряд батареи
+	EventDeviceOffline = "device.offline" // устройство не выходит на связь
+	EventPing          = "ping"           // проверка подписки
+)
+
+// webhookEvents содержит список поддерживаемых для подписки событий.
+var webhookEvents = []string{
+	EventGeofenceEnter,
+	EventGeofenceExit,
+	EventLowBattery,
+	EventDeviceOffline,
+}
+
+var (
+	// количество попыток доставки уведомления
+	webhookRetry = 5
+	// задержка перед повторной доставкой, удваивается с каждой попыткой
+	webhookDelay = time.Second
+	// количество одновременных доставок уведомлений
+	webhookWorkers = 10
+	// размер очереди уведомлений, ожидающих доставки
+	webhookQueue = 1000
+)
+
+var (
+	ErrBadWebhookData   = errors.New("bad webhook data")
+	ErrPrivateWebhookIP = errors.New("webhook address is not public")
+)
+
+// WebhookSender доставляет уведомления подписчикам. Уведомления ставятся в
+// очередь ограниченного размера и доставляются фиксированным количеством
+// обработчиков. Параметры доставки можно менять, только пока нет
+// доставляемых уведомлений (см. Wait).
+type WebhookSender struct {
+	Retry int           // количество попыток доставки уведомления
+	Delay time.Duration // задержка перед повторной доставкой
+	// разрешить доставку уведомлений на внутренние адреса: loopback,
+	// частные и link-local сети
+	Private bool
+
+	client *http.Client
+	queue  chan func()
+	wg     sync.WaitGroup
+}
+
+// NewWebhookSender возвращает отправителя уведомлений с workers
+// обработчиками и очередью размером queue.
+func NewWebhookSender(workers, queue int) *WebhookSender {
+	sender := &WebhookSender{
+		Retry: webhookRetry,
+		Delay: webhookDelay,
+		queue: make(chan func(), queue),
+	}
+	// адреса проверяются при каждом соединении, в том числе после
+	// перенаправлений
+	sender.client = &http.Client{
+		Timeout: time.Second * 10,
+		Transport: &http.Transport{
+			DialContext: (&net.Dialer{
+				Timeout: time.Second * 5,
+				Control: sender.dialControl,
+			}).DialContext,
+			TLSHandshakeTimeout: time.Second * 5,
+		},
+	}
+	for i := 0; i < workers; i++ {
+		go func() {
+			for deliver := range sender.queue {
+				deliver()
+				sender.wg.Done()
+			}
+		}()
+	}
+	return sender
+}
+
+// send ставит доставку уведомления в очередь. Если очередь заполнена, то
+// уведомление не доставляется и возвращается false.
+func (w *WebhookSender) send(deliver func()) bool {
+	w.wg.Add(1)
+	select {
+	case w.queue <- deliver:
+		return true
+	default:
+		w.wg.Done()
+		return false
+	}
+}
+
+// Wait дожидается доставки всех уведомлений из очереди.
+func (w *WebhookSender) Wait() {
+	w.wg.Wait()
+}
+
+// dialControl запрещает соединения с внутренними адресами при доставке
+// уведомлений, если они не разрешены. Адрес проверяется после разрешения
+// имени, поэтому подмена DNS не позволяет обойти проверку.
+func (w *WebhookSender) dialControl(network, address string, _ syscall.RawConn) error {
+	if w.Private {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !publicIP(ip) {
+		return ErrPrivateWebhookIP
+	}
+	return nil
+}
+
+// Webhook описывает подписку группы на уведомления о событиях.
+type Webhook struct {
+	ID      string    `bson:"_id" json:"id"`
+	Group   string    `bson:"group" json:"-"`
+	URL     string    `bson:"url" json:"url"`
+	Secret  string    `bson:"secret" json:"secret,omitempty"`
+	Events  []string  `bson:"events" json:"events"`
+	Created time.Time `bson:"created" json:"created"`
+}
+
+// Delivery описывает запись в журнале доставки уведомлений.
+type Delivery struct {
+	ID        string     `bson:"_id" json:"id"`
+	Webhook   string     `bson:"webhook" json:"webhook"`
+	Group     string     `bson:"group" json:"-"`
+	Event     string     `bson:"event" json:"event"`
+	Attempts  int        `bson:"attempts" json:"attempts"`
+	Status    int        `bson:"status,omitempty" json:"status,omitempty"`
+	Error     string     `bson:"error,omitempty" json:"error,omitempty"`
+	Created   time.Time  `bson:"created" json:"created"`
+	Delivered *time.Time `bson:"delivered,omitempty" json:"delivered,omitempty"`
+}
+
+// valid возвращает true, если описание подписки корректно. Внутренние адреса
+// допустимы, только если private установлен.
+func (w *Webhook) valid(private bool) bool {
+	u, err := url.Parse(w.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return false
+	}
+	if !private {
+		// адреса, заданные именем, проверяются при соединении
+		host := strings.ToLower(u.Hostname())
+		if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+			return false
+		}
+		if ip := net.ParseIP(host); ip != nil && !publicIP(ip) {
+			return false
+		}
+	}
+	if len(w.Events) == 0 {
+		return false
+	}
+	for _, event := range w.Events {
+		var known bool
+		for _, name := range webhookEvents {
+			if event == name {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return false
+		}
+	}
+	return true
+}
+
+// publicIP возвращает true, если адрес не относится к loopback, частным,
+// link-local, multicast или неопределенным адресам.
+func publicIP(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() ||
+		ip.IsMulticast() || ip.IsUnspecified())
+}
+
+// SignPayload возвращает подпись содержимого уведомления в формате
+// "sha256=<hex>", вычисленную с помощью HMAC-SHA256 и секретного ключа
+// подписки.
+func SignPayload(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// WebhooksList возвращает список подписок группы.
+func (s *Store) WebhooksList(c *rest.Context) error {
+	token := GetToken(c)
+	if token == nil {
+		return ErrBadToken
+	}
+	session, coll := s.collContext(c.Request.Context(), "webhooks")
+	defer session.Close()
+	var hooks = make([]*Webhook, 0)
+	if err := coll.Find(bson.M{"group": token.Group}).
+		Sort("created").All(&hooks); err != nil {
+		return err
+	}
+	for _, hook := range hooks {
+		hook.Secret = "" // секретный ключ отдается только при создании
+	}
+	return sendTotal(c, hooks)
+}
+
+// WebhookAdd регистрирует новую подписку для группы. Если секретный ключ для
+// подписи не указан, то он генерируется автоматически и возвращается в ответе.
+func (s *Store) WebhookAdd(c *rest.Context) error {
+	token := GetToken(c)
+	if token == nil {
+		return ErrBadToken
+	}
+	hook := new(Webhook)
+	if err := bind(c, hook); err != nil {
+		return err
+	}
+	if !hook.valid(s.hooks.Private) {
+		return sendProblem(c, http.StatusBadRequest, ErrBadWebhookData.Error())
+	}
+	if hook.Secret == "" {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return err
+		}
+		hook.Secret = hex.EncodeToString(key)
+	}
+	hook.ID = bson.NewObjectId().Hex()
+	hook.Group = token.Group
+	hook.Created = time.Now().UTC()
+	session, coll := s.collContext(c.Request.Context(), "webhooks")
+	defer session.Close()
+	if err := coll.Insert(hook); err != nil {
+		return err
+	}
+	s.audit(c, "webhook.create", hook.ID, nil, hook)
+	return c.Status(http.StatusCreated).Send(rest.JSON{
+		"id":     hook.ID,
+		"secret": hook.Secret,
+	})
+}
+
+// webhook возвращает описание подписки группы.
+func (s *Store) webhook(ctx context.Context, group, id string) (*Webhook, error) {
+	session, coll := s.collContext(ctx, "webhooks")
+	defer session.Close()
+	hook := new(Webhook)
+	if err := coll.Find(bson.M{"_id": id, "group": group}).One(hook); err != nil {
+		return nil, err
+	}
+	return hook, nil
+}
+
+// WebhookGet возвращает описание подписки.
+func (s *Store) WebhookGet(c *rest.Context) error {
+	token := GetToken(c)
+	if token == nil {
+		return ErrBadToken
+	}
+	hook, err := s.webhook(c.Request.Context(), token.Group, c.Param("webhook-id"))
+	if err == mgo.ErrNotFound {
+		return notFound(c)
+	}
+	if err != nil {
+		return err
+	}
+	hook.Secret = ""
+	return c.Send(hook)
+}
+
+// WebhookDelete удаляет подписку группы.
+func (s *Store) WebhookDelete(c *rest.Context) error {
+	token := GetToken(c)
+	if token == nil {
+		return ErrBadToken
+	}
+	session, coll := s.collContext(c.Request.Context(), "webhooks")
+	defer session.Close()
+	err := coll.Remove(bson.M{"_id": c.Param("webhook-id"), "group": token.Group})
+	if err == mgo.ErrNotFound {
+		return notFound(c)
+	}
+	if err != nil {
+		return err
+	}
+	s.audit(c, "webhook.delete", c.Param("webhook-id"), nil, nil)
+	return c.Send(nil)
+}
+
+// WebhookTest отправляет тестовое уведомление и возвращает результат его
+// доставки. Выполняется только одна попытка доставки без повторов, чтобы
+// ответ уложился во время ожидания запроса.
+func (s *Store) WebhookTest(c *rest.Context) error {
+	token := GetToken(c)
+	if token == nil {
+		return ErrBadToken
+	}
+	hook, err := s.webhook(c.Request.Context(), token.Group, c.Param("webhook-id"))
+	if err == mgo.ErrNotFound {
+		return notFound(c)
+	}
+	if err != nil {
+		return err
+	}
+	return c.Send(s.deliver(hook, EventPing, rest.JSON{"id": hook.ID}, 1))
+}
+
+// WebhookDeliveries возвращает журнал доставки уведомлений для подписки.
+func (s *Store) WebhookDeliveries(c *rest.Context) error {
+	token := GetToken(c)
+	if token == nil {
+		return ErrBadToken
+	}
+	session, coll := s.collContext(c.Request.Context(), "deliveries")
+	defer session.Close()
+	var deliveries = make([]*Delivery, 0)
+	filter := bson.M{
+		"webhook": c.Param("webhook-id"),
+		"group":   token.Group,
+	}
+	if err := coll.Find(filter).Sort("-created").Limit(100).All(&deliveries); err != nil {
+		return err
+	}
+	// количество считается отдельным запросом без ограничения Limit
+	total, err := coll.Find(filter).Count()
+	if err != nil {
+		return err
+	}
+	c.Header().Set("X-Total-Count", strconv.Itoa(total))
+	return c.Send(deliveries)
+}
+
+// Notify асинхронно рассылает уведомление о событии всем подписчикам группы.
+// Если очередь доставки заполнена, то уведомление записывается в лог и
+// отбрасывается.
+func (s *Store) Notify(group, event string, data interface{}) {
+	session, coll := s.coll("webhooks")
+	var hooks []*Webhook
+	err := coll.Find(bson.M{"group": group, "events": event}).All(&hooks)
+	session.Close()
+	if err != nil {
+		llog.Error("Error get webhooks", "group", group, "err", err)
+		return
+	}
+	for _, hook := range hooks {
+		hook := hook
+		if !s.hooks.send(func() { s.deliver(hook, event, data, s.hooks.Retry) }) {
+			llog.Error("Webhook queue is full", "webhook", hook.ID, "event", event)
+		}
+	}
+}
+
+// deliver доставляет уведомление подписчику не больше чем за attempts
+// попыток. В случае ошибки доставка повторяется с экспоненциально
+// увеличивающейся задержкой. Результат каждой попытки сохраняется в журнале
+// доставки.
+func (s *Store) deliver(hook *Webhook, event string, data interface{}, attempts int) *Delivery {
+	delivery := &Delivery{
+		ID:      bson.NewObjectId().Hex(),
+		Webhook: hook.ID,
+		Group:   hook.Group,
+		Event:   event,
+		Created: time.Now().UTC(),
+	}
+	payload, err := json.Marshal(rest.JSON{
+		"id":    delivery.ID,
+		"event": event,
+		"time":  delivery.Created,
+		"data":  data,
+	})
+	if err != nil {
+		delivery.Error = err.Error()
+		s.logDelivery(delivery)
+		return delivery
+	}
+	pause := s.hooks.Delay
+	for delivery.Attempts < attempts {
+		if delivery.Attempts > 0 {
+			time.Sleep(pause)
+			pause *= 2
+		}
+		delivery.Attempts++
+		delivery.Status, err = s.hooks.post(hook, delivery, payload)
+		if err == nil {
+			delivery.Error = ""
+			delivered := time.Now().UTC()
+			delivery.Delivered = &delivered
+			break
+		}
+		delivery.Error = err.Error()
+		s.logDelivery(delivery)
+	}
+	s.logDelivery(delivery)
+	return delivery
+}
+
+// post отправляет подписанное уведомление и возвращает HTTP-статус ответа.
+func (w *WebhookSender) post(hook *Webhook, delivery *Delivery, payload []byte) (int, error) {
+	req, err := http.NewRequest("POST", hook.URL, bytes.NewReader(payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "GeoTrace-Webhook")
+	req.Header.Set("X-GeoTrace-Event", delivery.Event)
+	req.Header.Set("X-GeoTrace-Delivery", delivery.ID)
+	req.Header.Set("X-GeoTrace-Signature", SignPayload(hook.Secret, payload))
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// logDelivery сохраняет состояние доставки уведомления в журнале.
+func (s *Store) logDelivery(delivery *Delivery) {
+	session, coll := s.coll("deliveries")
+	defer session.Close()
+	if _, err := coll.UpsertId(delivery.ID, delivery); err != nil {
+		llog.Error("Error log webhook delivery", "id", delivery.ID, "err", err)
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mdigger/rest"
+)
+
+func TestWebhooks(t *testing.T) {
+	token, err := getUserToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// параметры доставки меняются, только пока нет доставляемых уведомлений
+	store.hooks.Wait()
+	delay := store.hooks.Delay
+	store.hooks.Delay = time.Millisecond * 10
+	if _, err := request(TestRequest{
+		"Ошибка регистрации подписки на внутренний адрес",
+		"POST",
+		"webhooks",
+		rest.JSON{
+			"url":    "http://127.0.0.1:8080/hook",
+			"events": []string{EventLowBattery},
+		},
+		400,
+	}, token); err != nil {
+		t.Error(err)
+	}
+	// получатель уведомлений в тесте работает на локальном адресе
+	store.hooks.Private = true
+	defer func() {
+		store.hooks.Wait()
+		store.hooks.Private, store.hooks.Delay = false, delay
+	}()
+
+	var fail = 1 // первый запрос возвращает ошибку
+	received := make(chan string, 10)
+	var secret string
+	receiver := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			data, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				t.Error(err)
+			}
+			if fail > 0 {
+				fail--
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			if sign := r.Header.Get("X-GeoTrace-Signature"); sign != SignPayload(secret, data) {
+				t.Errorf("bad signature %q", sign)
+			}
+			received <- r.Header.Get("X-GeoTrace-Event")
+		}))
+	defer receiver.Close()
+
+	tests := []TestRequest{
+		{
+			"Ошибка регистрации подписки с неизвестным событием",
+			"POST",
+			"webhooks",
+			rest.JSON{
+				"url":    receiver.URL,
+				"events": []string{"unknown"},
+			},
+			400,
+		},
+		{
+			"Ошибка регистрации подписки без адреса",
+			"POST",
+			"webhooks",
+			rest.JSON{
+				"events": []string{EventLowBattery},
+			},
+			400,
+		},
+	}
+	for _, test := range tests {
+		if _, err := request(test, token); err != nil {
+			t.Error(err)
+		}
+	}
+
+	resp, err := request(TestRequest{
+		"Регистрация подписки",
+		"POST",
+		"webhooks",
+		rest.JSON{
+			"url":    receiver.URL,
+			"events": []string{EventLowBattery, EventGeofenceEnter},
+		},
+		201,
+	}, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var created struct {
+		ID     string `json:"id"`
+		Secret string `json:"secret"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+	secret = created.Secret
+
+	// testDelivery отправляет тестовое уведомление и возвращает результат
+	testDelivery := func() *Delivery {
+		resp, err := request(TestRequest{
+			"Проверка доставки уведомления",
+			"POST",
+			fmt.Sprintf("webhooks/%s/test", created.ID),
+			nil,
+			200,
+		}, token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var delivery Delivery
+		if err := json.NewDecoder(resp.Body).Decode(&delivery); err != nil {
+			t.Fatal(err)
+		}
+		return &delivery
+	}
+	// тестовое уведомление доставляется за одну попытку без повторов
+	if delivery := testDelivery(); delivery.Attempts != 1 || delivery.Status != 503 ||
+		delivery.Delivered != nil {
+		t.Errorf("bad failed delivery: %+v", delivery)
+	}
+	if delivery := testDelivery(); delivery.Attempts != 1 || delivery.Status != 200 ||
+		delivery.Delivered == nil {
+		t.Errorf("bad delivery: %+v", delivery)
+	}
+	if event := <-received; event != EventPing {
+		t.Errorf("bad event %q", event)
+	}
+
+	store.Notify("test_group", EventLowBattery, rest.JSON{"device": "test"})
+	select {
+	case event := <-received:
+		if event != EventLowBattery {
+			t.Errorf("bad event %q", event)
+		}
+	case <-time.After(time.Second * 5):
+		t.Error("notification not delivered")
+	}
+
+	for _, test := range []TestRequest{
+		{
+			"Журнал доставки уведомлений",
+			"GET",
+			fmt.Sprintf("webhooks/%s/deliveries", created.ID),
+			nil,
+			200,
+		},
+		{
+			"Удаление подписки",
+			"DELETE",
+			fmt.Sprintf("webhooks/%s", created.ID),
+			nil,
+			204,
+		},
+		{
+			"Ошибка получения удаленной подписки",
+			"GET",
+			fmt.Sprintf("webhooks/%s", created.ID),
+			nil,
+			404,
+		},
+	} {
+		if _, err := request(test, token); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestWebhookAddress(t *testing.T) {
+	for _, test := range []struct {
+		url   string
+		valid bool
+	}{
+		{"https://example.com/hook", true},
+		{"http://93.184.216.34:8080/hook", true},
+		{"http://localhost/hook", false},
+		{"http://127.0.0.1/hook", false},
+		{"http://10.1.2.3/hook", false},
+		{"http://192.168.0.1/hook", false},
+		{"http://169.254.169.254/latest/meta-data", false},
+		{"http://[::1]/hook", false},
+		{"ftp://example.com/hook", false},
+	} {
+		hook := &Webhook{URL: test.url, Events: []string{EventLowBattery}}
+		if hook.valid(false) != test.valid {
+			t.Errorf("%s: valid must be %v", test.url, test.valid)
+		}
+	}
+	sender := NewWebhookSender(0, 0)
+	if err := sender.dialControl("tcp", "127.0.0.1:80", nil); err != ErrPrivateWebhookIP {
+		t.Errorf("loopback dial must be denied: %v", err)
+	}
+	if err := sender.dialControl("tcp", "93.184.216.34:443", nil); err != nil {
+		t.Errorf("public dial must be allowed: %v", err)
+	}
+}
+
+func TestWebhookSender(t *testing.T) {
+	sender := NewWebhookSender(1, 1)
+	started, release := make(chan struct{}, 2), make(chan struct{})
+	var delivered int32
+	deliver := func() {
+		started <- struct{}{}
+		<-release
+		atomic.AddInt32(&delivered, 1)
+	}
+	// первое уведомление занимает обработчик, второе ждет в очереди, а для
+	// третьего места уже нет
+	if !sender.send(deliver) {
+		t.Fatal("first delivery must be queued")
+	}
+	<-started
+	if !sender.send(deliver) {
+		t.Fatal("second delivery must be queued")
+	}
+	if sender.send(deliver) {
+		t.Error("queue must be bounded")
+	}
+	close(release)
+	sender.Wait()
+	if n := atomic.LoadInt32(&delivered); n != 2 {
+		t.Errorf("bad delivered count: %d", n)
+	}
+}